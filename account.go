@@ -0,0 +1,405 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Credentials are the username and password of "POST /login" and "POST /signup" as JSON or form.
+type Credentials struct {
+	Username string `json:"Username"`
+	Password string `json:"Password"`
+}
+
+// Account is the logged in user. CSRFToken must be sent with requests changing state.
+type Account struct {
+	Username  string `json:"Username"`
+	Role      string `json:"Role"`
+	CSRFToken string `json:"CSRFToken"`
+}
+
+func accountOf(session *Session) *Account {
+	if session == nil {
+		return nil
+	}
+	return &Account{Username: session.User.Username, Role: session.User.Role, CSRFToken: session.CSRFToken}
+}
+
+// myPage is the data of myTemplate. Account is nil if the user is not logged in.
+type myPage struct {
+	Account     *Account
+	AllowSignup bool
+	OIDC        bool
+	Error       string
+}
+
+// readCredentials reads credentials in the body of JSON or form, and reports whether it is form.
+func readCredentials(cfg *Config, w http.ResponseWriter, r *http.Request) (credentials Credentials, isForm bool, err error) {
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == MEDIA_TYPE_FORM {
+		body, err := readBody(cfg, w, r)
+		if err != nil {
+			return credentials, true, err
+		}
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return credentials, true, err
+		}
+		return Credentials{Username: form.Get("username"), Password: form.Get("password")}, true, nil
+	}
+	err = readJSON(cfg, w, r, &credentials)
+	return credentials, false, err
+}
+
+// writeAccountError responds message as JSON, or as my page with status for forms.
+func writeAccountError(cfg *Config, w http.ResponseWriter, isForm bool, status int, message string) {
+	if !isForm {
+		writeJSON(w, status, ErrorResponse{Error: message})
+		return
+	}
+	if myTemplate == nil {
+		w.WriteHeader(status)
+		w.Write([]byte(message))
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := myTemplate.Execute(w, myPage{AllowSignup: cfg.AllowSignup, OIDC: cfg.OIDC != nil, Error: message}); err != nil {
+		Errorf("Executing my template is failed. Error: %v\n", err)
+	}
+}
+
+// startSession logs in user by the session cookie. Forms are redirected to my page, and JSON gets Account.
+func startSession(cfg *Config, d *Domain, db *DB, w http.ResponseWriter, user *User, isForm bool) {
+	token, session, err := db.CreateSession(user, cfg.SessionTTL)
+	if err != nil {
+		Errorf("Creating session of '%s' is failed. Error: %v\n", user.Username, err)
+		writeAccountError(cfg, w, isForm, http.StatusInternalServerError, "Internal server error.\n")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     SESSION_COOKIE,
+		Value:    token,
+		Path:     cfg.basePath() + "/",
+		MaxAge:   int(cfg.SessionTTL.Seconds()),
+		Secure:   strings.HasPrefix(d.baseURL, "https://"),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	Infof("User '%s' is logged in.\n", user.Username)
+	if isForm {
+		w.Header().Set("Location", cfg.basePath()+"/my")
+		w.WriteHeader(http.StatusSeeOther)
+		return
+	}
+	writeJSON(w, http.StatusOK, accountOf(session))
+}
+
+func loginHandleMiddle(cfg *Config, db *DB) func(http.ResponseWriter, *http.Request) {
+	limiter := NewAttemptLimiter(cfg.PasswordMaxAttempts, cfg.PasswordLockDuration)
+	return func(w http.ResponseWriter, r *http.Request) {
+		d, ok := requestDomain(cfg, w, r)
+		if !ok {
+			return
+		}
+		if r.Method != "POST" {
+			Debugf("Request not allowed method '%s'\n", r.Method)
+			writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: fmt.Sprintf("HTTP method '%s' is not allowed.\n", r.Method)})
+			return
+		}
+		credentials, isForm, err := readCredentials(cfg, w, r)
+		if err != nil {
+			if err == errBodyTooLarge || !isForm {
+				writeBodyError(w, err, "Request body must be JSON of Username and Password.\n")
+				return
+			}
+			writeAccountError(cfg, w, isForm, http.StatusBadRequest, "Form is invalid.\n")
+			return
+		}
+
+		// failures are counted per client, so that others can't lock the user out.
+		username := strings.ToLower(strings.TrimSpace(credentials.Username))
+		ip := clientIP(cfg, r)
+		key := username + "\x00" + ip
+		if ok, retryAfter := limiter.Allow(key); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+			writeAccountError(cfg, w, isForm, http.StatusTooManyRequests, "Too many wrong passwords. Try again later.\n")
+			return
+		}
+		user, err := db.Authenticate(credentials.Username, credentials.Password)
+		if err == errInvalidCredentials {
+			Infof("Login of '%s' is failed from %s\n", username, ip)
+			writeAccountError(cfg, w, isForm, http.StatusUnauthorized, "Username or password is wrong.\n")
+			return
+		}
+		if err != nil {
+			limiter.Release(key)
+			Errorf("Authenticating '%s' is failed. Error: %v\n", username, err)
+			writeAccountError(cfg, w, isForm, http.StatusInternalServerError, "Internal server error.\n")
+			return
+		}
+		limiter.Reset(key)
+		startSession(cfg, d, db, w, user, isForm)
+	}
+}
+
+func signupHandleMiddle(cfg *Config, db *DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		d, ok := requestDomain(cfg, w, r)
+		if !ok {
+			return
+		}
+		if !cfg.AllowSignup {
+			writeJSON(w, http.StatusNotFound, ErrorResponse{Error: "Signup is disabled.\n"})
+			return
+		}
+		if r.Method != "POST" {
+			Debugf("Request not allowed method '%s'\n", r.Method)
+			writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: fmt.Sprintf("HTTP method '%s' is not allowed.\n", r.Method)})
+			return
+		}
+		credentials, isForm, err := readCredentials(cfg, w, r)
+		if err != nil {
+			if err == errBodyTooLarge || !isForm {
+				writeBodyError(w, err, "Request body must be JSON of Username and Password.\n")
+				return
+			}
+			writeAccountError(cfg, w, isForm, http.StatusBadRequest, "Form is invalid.\n")
+			return
+		}
+
+		user, err := db.AddUser(credentials.Username, credentials.Password, ROLE_USER)
+		if err == errUserExists {
+			writeAccountError(cfg, w, isForm, http.StatusConflict, "Username is already used.\n")
+			return
+		}
+		if err != nil {
+			writeAccountError(cfg, w, isForm, http.StatusBadRequest, strings.TrimSuffix(err.Error(), ".")+".\n")
+			return
+		}
+		startSession(cfg, d, db, w, user, isForm)
+	}
+}
+
+func logoutHandleMiddle(cfg *Config, db *DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			Debugf("Request not allowed method '%s'\n", r.Method)
+			writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: fmt.Sprintf("HTTP method '%s' is not allowed.\n", r.Method)})
+			return
+		}
+		session := requestSession(r)
+		if session == nil {
+			writeJSON(w, http.StatusUnauthorized, ErrorResponse{Error: "Login and CSRF token are required.\n"})
+			return
+		}
+		if cookie, err := r.Cookie(SESSION_COOKIE); err == nil {
+			if err = db.DeleteSession(cookie.Value); err != nil {
+				Errorf("Deleting session of '%s' is failed. Error: %v\n", session.User.Username, err)
+				writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "Internal server error.\n"})
+				return
+			}
+		}
+		http.SetCookie(w, &http.Cookie{Name: SESSION_COOKIE, Value: "", Path: cfg.basePath() + "/", MaxAge: -1, HttpOnly: true})
+		Infof("User '%s' is logged out.\n", session.User.Username)
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == MEDIA_TYPE_FORM {
+			w.Header().Set("Location", cfg.basePath()+"/my")
+			w.WriteHeader(http.StatusSeeOther)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// accountHandleMiddle returns Account of the logged in user, which has the CSRF token for scripts.
+func accountHandleMiddle(cfg *Config, db *DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			Debugf("Request not allowed method '%s'\n", r.Method)
+			writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: fmt.Sprintf("HTTP method '%s' is not allowed.\n", r.Method)})
+			return
+		}
+		account := accountOf(requestSession(r))
+		if account == nil {
+			writeJSON(w, http.StatusUnauthorized, ErrorResponse{Error: "Login is required.\n"})
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, http.StatusOK, account)
+	}
+}
+
+// myHandleMiddle shows the login form, or links of the logged in user.
+func myHandleMiddle(cfg *Config, db *DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requestDomain(cfg, w, r); !ok {
+			return
+		}
+		if r.Method != "GET" {
+			Debugf("Request not allowed method '%s'\n", r.Method)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			w.Write([]byte(fmt.Sprintf("HTTP method '%s' is not allowed.\n", r.Method)))
+			return
+		}
+		if myTemplate == nil {
+			writePageNotFound(w)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		if err := myTemplate.Execute(w, myPage{Account: accountOf(requestSession(r)), AllowSignup: cfg.AllowSignup, OIDC: cfg.OIDC != nil}); err != nil {
+			Errorf("Executing my template is failed. Error: %v\n", err)
+		}
+	}
+}
+
+// myLinksHandleMiddle serves links of the logged in user in the same way as "/admin/links".
+// "GET /my/links" lists them, and admins see links of all users.
+func myLinksHandleMiddle(cfg *Config, db *DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := requestUser(r)
+		if user == nil {
+			writeJSON(w, http.StatusUnauthorized, ErrorResponse{Error: "Login and CSRF token are required.\n"})
+			return
+		}
+		tiny, sub := splitTinyPath(strings.TrimPrefix(r.URL.Path, "/my/links"))
+		if tiny == "" {
+			if r.Method != "GET" {
+				Debugf("Request not allowed method '%s'\n", r.Method)
+				writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: fmt.Sprintf("HTTP method '%s' is not allowed.\n", r.Method)})
+				return
+			}
+			ownerID := user.ID
+			if user.IsAdmin() {
+				ownerID = 0
+			}
+			links, err := db.GetLinks(ownerID)
+			if err != nil {
+				Errorf("Getting links of '%s' is failed. Error: %v\n", user.Username, err)
+				writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "Internal server error.\n"})
+				return
+			}
+			writeJSON(w, http.StatusOK, links)
+			return
+		}
+
+		domain, ok := requestLinkDomain(cfg, w, r)
+		if !ok {
+			return
+		}
+		// links of others are not found, so that their tiny paths are not revealed.
+		link, err := db.GetLink(domain, tiny)
+		if err != nil || (link.OwnerID != user.ID && !user.IsAdmin()) {
+			writeJSON(w, http.StatusNotFound, ErrorResponse{Error: fmt.Sprintf("'%s' is not found.\n", tiny)})
+			return
+		}
+		linkHandle(cfg, db, w, r, domain, tiny, sub, requestActor(cfg, r))
+	}
+}
+
+const myHTML string = `
+<!DOCTYPE html>
+<html>
+  <head>
+    <meta charset="UTF-8" />
+    <title>tiny-url - my links</title>
+    <meta name="viewport" content="width=device-width,initial-scale=1.0,minimum-scale=1.0" />
+  </head>
+  <body>
+    <div class="title">tiny-url</div>
+    {{with .Account}}
+    <div class="account">
+      {{.Username}}{{if eq .Role "admin"}} (admin){{end}} ·
+      <a href="page">shorten</a> ·
+      <form class="logout" method="POST" action="logout">
+        <input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+        <button type="submit">logout</button>
+      </form>
+    </div>
+    <table class="links" data-csrf-token="{{.CSRFToken}}">
+      <thead><tr><th>tiny</th><th>origin</th><th>clicks</th><th></th></tr></thead>
+      <tbody></tbody>
+    </table>
+    <script>
+      const table = document.querySelector(".links");
+      const csrfToken = table.dataset.csrfToken;
+      const request = (method, link, body) => {
+        let url = "my/links/" + encodeURIComponent(link.Tiny) + (link.Domain ? "?domain=" + encodeURIComponent(link.Domain) : "");
+        return fetch(url, {method: method, headers: {"Content-Type": "application/json", "X-CSRF-Token": csrfToken}, body: body && JSON.stringify(body)})
+          .then((res) => res.ok ? res : res.json().then((e) => { throw new Error(e.Error); }));
+      };
+      fetch("my/links").then((res) => res.json()).then((links) => {
+        for (const link of links) {
+          const row = table.tBodies[0].insertRow();
+          const tiny = document.createElement("a");
+          tiny.textContent = (link.Domain ? link.Domain + "/" : "") + link.Tiny;
+          if (!link.Domain) tiny.href = link.Tiny + "+";
+          row.insertCell().appendChild(tiny);
+          const origin = document.createElement("input");
+          origin.value = link.Origin;
+          row.insertCell().appendChild(origin);
+          row.insertCell().textContent = link.Clicks;
+          const save = document.createElement("button");
+          save.textContent = "save";
+          save.onclick = () => request("PATCH", link, {Origin: origin.value}).then(() => alert("Saved.")).catch((e) => alert(e.message));
+          const remove = document.createElement("button");
+          remove.textContent = "delete";
+          remove.onclick = () => confirm("Delete " + link.Tiny + "?") && request("DELETE", link).then(() => row.remove()).catch((e) => alert(e.message));
+          const actions = row.insertCell();
+          actions.appendChild(save);
+          actions.appendChild(remove);
+        }
+      });
+    </script>
+    {{else}}
+    <form class="login" method="POST" action="login">
+      <input name="username" type="text" placeholder="username" autocomplete="username" required>
+      <input name="password" type="password" placeholder="password" autocomplete="current-password" required>
+      <button type="submit">login</button>
+      {{if .AllowSignup}}<button type="submit" formaction="signup">sign up</button>{{end}}
+    </form>
+    {{if .OIDC}}<div class="login"><a href="oidc/login">login with SSO</a></div>{{end}}
+    {{end}}
+    <div class="error">{{.Error}}</div>
+  </body>
+  <style>
+    body {
+      margin: 0px;
+      color: rgb(68, 67, 67);
+      font-family: 'Segoe UI', Tahoma, Geneva, Verdana, sans-serif;
+    }
+    .title {
+      margin-top: 80px;
+      margin-bottom: 15px;
+      font-size: 40px;
+      text-align: center;
+    }
+    .account, .login, .error {
+      text-align: center;
+      margin: 10px auto;
+    }
+    .logout {
+      display: inline;
+    }
+    .links {
+      width: 80vw;
+      margin: 20px auto;
+      border-collapse: collapse;
+    }
+    .links td, .links th {
+      padding: 4px 8px;
+      border-bottom: 1px solid rgb(220, 220, 220);
+      text-align: left;
+    }
+    .links input {
+      width: 100%;
+    }
+    .error {
+      color: rgb(200, 60, 60);
+    }
+  </style>
+</html>
+`
@@ -0,0 +1,551 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DEFAULT_AUDIT_LIMIT int = 100
+const MAX_AUDIT_LIMIT int = 1000
+
+type ErrorResponse struct {
+	Error string `json:"Error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	rBody, err := json.Marshal(v)
+	if err != nil {
+		Errorf("JsonMarshalError: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(rBody)
+}
+
+var errBodyTooLarge = errors.New("request body is too large")
+
+// readBody reads the whole request body up to cfg.MaxBodySize bytes. Content-Length is not trusted,
+// and bodies without it (chunked) are limited while they are read.
+func readBody(cfg *Config, w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	if r.ContentLength > cfg.MaxBodySize {
+		return nil, errBodyTooLarge
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, cfg.MaxBodySize))
+	if err != nil {
+		if int64(len(body)) >= cfg.MaxBodySize {
+			return nil, errBodyTooLarge
+		}
+		return nil, err
+	}
+	return body, nil
+}
+
+// decodeJSON decodes a JSON value in body into v. Unknown fields and data after the value are rejected.
+func decodeJSON(body []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("unexpected data after JSON value")
+	}
+	return nil
+}
+
+// readJSON reads the request body by readBody and decodes it by decodeJSON.
+func readJSON(cfg *Config, w http.ResponseWriter, r *http.Request, v interface{}) error {
+	body, err := readBody(cfg, w, r)
+	if err != nil {
+		return err
+	}
+	return decodeJSON(body, v)
+}
+
+// writeBodyError responds err of readJSON. It is 413 for too large body, and 400 with message for others.
+func writeBodyError(w http.ResponseWriter, err error, message string) {
+	if err == errBodyTooLarge {
+		writeJSON(w, http.StatusRequestEntityTooLarge, ErrorResponse{Error: "Request body is too large.\n"})
+		return
+	}
+	writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("%s (%v)\n", strings.TrimSuffix(message, "\n"), err)})
+}
+
+// adminHandleMiddle allows only requests having one of cfg.APIKeys or from logged in admins to reach next.
+// If no API key is configured, admin API is only for admins.
+func adminHandleMiddle(cfg *Config, next func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if user := requestUser(r); user != nil && user.IsAdmin() {
+			next(w, r)
+			return
+		}
+		if len(cfg.APIKeys) == 0 {
+			writeJSON(w, http.StatusForbidden, ErrorResponse{Error: "Admin API is disabled.\n"})
+			return
+		}
+		if _, ok := apiKeyName(cfg, r); !ok {
+			Infof("Unauthorized admin request '%s %s' from %s\n", r.Method, r.URL.Path, r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSON(w, http.StatusUnauthorized, ErrorResponse{Error: "Valid API key is required.\n"})
+			return
+		}
+		next(w, r)
+	}
+}
+
+func auditHandleMiddle(cfg *Config, db *DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			Debugf("Request not allowed method '%s'\n", r.Method)
+			writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: fmt.Sprintf("HTTP method '%s' is not allowed.\n", r.Method)})
+			return
+		}
+
+		q := r.URL.Query()
+		f := AuditFilter{
+			Actor:  q.Get("actor"),
+			Action: q.Get("action"),
+			Tiny:   q.Get("tiny"),
+			Limit:  DEFAULT_AUDIT_LIMIT,
+		}
+		if host := q.Get("domain"); host != "" {
+			domain, ok := cfg.linkDomain(host)
+			if !ok {
+				writeJSON(w, http.StatusNotFound, ErrorResponse{Error: fmt.Sprintf("Domain '%s' is not found.\n", host)})
+				return
+			}
+			f.Domain = domain
+		}
+		var err error
+		if f.Since, err = parseTimeParam(q.Get("since")); err != nil {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "'since' must be RFC3339 time.\n"})
+			return
+		}
+		if f.Until, err = parseTimeParam(q.Get("until")); err != nil {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "'until' must be RFC3339 time.\n"})
+			return
+		}
+		if l := q.Get("limit"); l != "" {
+			if f.Limit, err = strconv.Atoi(l); err != nil || f.Limit < 1 || f.Limit > MAX_AUDIT_LIMIT {
+				writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("'limit' must be 1-%d.\n", MAX_AUDIT_LIMIT)})
+				return
+			}
+		}
+
+		logs, err := db.GetAuditLogs(f)
+		if err != nil {
+			Errorf("GetAuditLogsError: %v\n", err)
+			writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "Internal server error.\n"})
+			return
+		}
+		writeJSON(w, http.StatusOK, logs)
+	}
+}
+
+// parseTimeParam parses RFC3339 time. Empty string is zero time.
+func parseTimeParam(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func exportHandleMiddle(cfg *Config, db *DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			Debugf("Request not allowed method '%s'\n", r.Method)
+			writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: fmt.Sprintf("HTTP method '%s' is not allowed.\n", r.Method)})
+			return
+		}
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = FORMAT_JSONL
+		}
+		if !IsValidFormat(format) {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "'format' must be jsonl or csv.\n"})
+			return
+		}
+
+		if format == FORMAT_JSONL {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+		} else {
+			w.Header().Set("Content-Type", "text/csv")
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"tinyurl.%s\"", format))
+		// the status can't be changed after streaming is started, so errors are only logged.
+		if err := db.ExportLinks(w, format); err != nil {
+			Errorf("ExportLinksError: %v\n", err)
+		}
+	}
+}
+
+func importHandleMiddle(cfg *Config, db *DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			Debugf("Request not allowed method '%s'\n", r.Method)
+			writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: fmt.Sprintf("HTTP method '%s' is not allowed.\n", r.Method)})
+			return
+		}
+		q := r.URL.Query()
+		format := q.Get("format")
+		if format == "" {
+			format = FORMAT_JSONL
+		}
+		policy := q.Get("conflict")
+		if policy == "" {
+			policy = CONFLICT_FAIL
+		}
+		if !IsValidFormat(format) {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "'format' must be jsonl or csv.\n"})
+			return
+		}
+		if !IsValidConflictPolicy(policy) {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "'conflict' must be skip, overwrite or fail.\n"})
+			return
+		}
+
+		result, err := db.ImportLinks(r.Body, format, policy, requestActor(cfg, r))
+		if err != nil {
+			Warnf("ImportLinksError: %v\n", err)
+			writeJSON(w, http.StatusUnprocessableEntity, ErrorResponse{Error: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, result)
+	}
+}
+
+func cacheHandleMiddle(cfg *Config, db *DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			Debugf("Request not allowed method '%s'\n", r.Method)
+			writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: fmt.Sprintf("HTTP method '%s' is not allowed.\n", r.Method)})
+			return
+		}
+		if db.cache == nil {
+			writeJSON(w, http.StatusNotFound, ErrorResponse{Error: "Redirect cache is disabled.\n"})
+			return
+		}
+		writeJSON(w, http.StatusOK, db.cache.Stats())
+	}
+}
+
+// brokenHandleMiddle lists links whose origins are broken.
+func brokenHandleMiddle(cfg *Config, db *DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			Debugf("Request not allowed method '%s'\n", r.Method)
+			writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: fmt.Sprintf("HTTP method '%s' is not allowed.\n", r.Method)})
+			return
+		}
+		links, err := db.GetBrokenLinks()
+		if err != nil {
+			Errorf("GetBrokenLinksError: %v\n", err)
+			writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "Internal server error.\n"})
+			return
+		}
+		writeJSON(w, http.StatusOK, links)
+	}
+}
+
+// LinkPatch is the request body of "PATCH /admin/links/{tiny}". Nil fields are not changed.
+type LinkPatch struct {
+	Origin       *string `json:"Origin"`
+	RedirectCode *int    `json:"RedirectCode"`
+	// Password "" removes the password.
+	Password *string `json:"Password"`
+	// RemainingClicks -1 removes the limit.
+	RemainingClicks *int64 `json:"RemainingClicks"`
+	ForwardQuery    *bool  `json:"ForwardQuery"`
+	ForwardPath     *bool  `json:"ForwardPath"`
+	// UTMTemplate "" removes the template.
+	UTMTemplate *string `json:"UTMTemplate"`
+	// FallbackURL "" removes the fallback.
+	FallbackURL *string `json:"FallbackURL"`
+
+	// passwordHash is the hash of Password set by hashPassword.
+	passwordHash string
+	// metadata is of Origin set by fetchMetadata.
+	metadata *LinkMetadata
+}
+
+// hashPassword hashes Password before the link is updated, so that slow bcrypt doesn't hold the write transaction.
+func (patch *LinkPatch) hashPassword() error {
+	if patch.Password == nil || *patch.Password == "" {
+		return nil
+	}
+	hash, err := HashPassword(*patch.Password)
+	if err != nil {
+		return err
+	}
+	patch.passwordHash = hash
+	return nil
+}
+
+// fetchMetadata reads the metadata of Origin before the link is updated, so that requesting the origin doesn't hold the write transaction.
+func (patch *LinkPatch) fetchMetadata() {
+	if patch.Origin != nil {
+		patch.metadata = FetchMetadata(*patch.Origin)
+	}
+}
+
+// apply validates and applies patch to link. hashPassword and fetchMetadata must be called before.
+func (patch *LinkPatch) apply(link *Link) error {
+	if patch.Origin != nil && *patch.Origin != link.Origin {
+		link.Origin = *patch.Origin
+		// the metadata of the old origin would be shown in previews of the new one.
+		link.Metadata = patch.metadata
+	}
+	if patch.RedirectCode != nil {
+		link.RedirectCode = *patch.RedirectCode
+	}
+	if patch.Password != nil {
+		link.PasswordHash = patch.passwordHash
+	}
+	if patch.RemainingClicks != nil {
+		link.RemainingClicks = nil
+		if *patch.RemainingClicks != -1 {
+			link.RemainingClicks = patch.RemainingClicks
+		}
+	}
+	if patch.ForwardQuery != nil {
+		link.ForwardQuery = *patch.ForwardQuery
+	}
+	if patch.ForwardPath != nil {
+		link.ForwardPath = *patch.ForwardPath
+	}
+	if patch.UTMTemplate != nil {
+		link.UTMTemplate = *patch.UTMTemplate
+	}
+	if patch.FallbackURL != nil {
+		link.FallbackURL = *patch.FallbackURL
+	}
+	return NormalizeLink(link)
+}
+
+func linkHandleMiddle(cfg *Config, db *DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tiny, sub := splitTinyPath(strings.TrimPrefix(r.URL.Path, "/admin/links"))
+		domain, ok := requestLinkDomain(cfg, w, r)
+		if !ok {
+			return
+		}
+		linkHandle(cfg, db, w, r, domain, tiny, sub, requestActor(cfg, r))
+	}
+}
+
+// requestLinkDomain returns Link.Domain of links on "domain" parameter, which specifies links on other than the first domain.
+func requestLinkDomain(cfg *Config, w http.ResponseWriter, r *http.Request) (string, bool) {
+	domain, ok := cfg.linkDomain(r.URL.Query().Get("domain"))
+	if !ok {
+		writeJSON(w, http.StatusNotFound, ErrorResponse{Error: fmt.Sprintf("Domain '%s' is not found.\n", r.URL.Query().Get("domain"))})
+	}
+	return domain, ok
+}
+
+// linkHandle serves the link of tiny on domain and its sub resource (e.g. "/targets").
+func linkHandle(cfg *Config, db *DB, w http.ResponseWriter, r *http.Request, domain string, tiny string, sub string, actor string) {
+	switch sub {
+	case "":
+	case "/targets":
+		linkTargetsHandle(cfg, db, w, r, domain, tiny, actor)
+		return
+	case "/variants":
+		linkVariantsHandle(cfg, db, w, r, domain, tiny, actor)
+		return
+	case "/schedule":
+		linkScheduleHandle(cfg, db, w, r, domain, tiny, actor)
+		return
+	default:
+		writeJSON(w, http.StatusNotFound, ErrorResponse{Error: fmt.Sprintf("'%s' is not found.\n", r.URL.Path)})
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		link, err := db.GetLink(domain, tiny)
+		if err != nil {
+			writeJSON(w, http.StatusNotFound, ErrorResponse{Error: fmt.Sprintf("'%s' is not found.\n", tiny)})
+			return
+		}
+		writeJSON(w, http.StatusOK, link)
+	case "PATCH":
+		var patch LinkPatch
+		if err := readJSON(cfg, w, r, &patch); err != nil {
+			writeBodyError(w, err, "Request body must be JSON.\n")
+			return
+		}
+		if t := patch.UTMTemplate; t != nil && *t != "" {
+			if _, ok := db.UTMTemplate(cfg, *t); !ok {
+				writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("UTM template '%s' is not found.\n", *t)})
+				return
+			}
+		}
+		if err := patch.hashPassword(); err != nil {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error() + "\n"})
+			return
+		}
+		patch.fetchMetadata()
+		var invalid error
+		link, err := db.UpdateLink(domain, tiny, actor, func(link *Link) error {
+			invalid = patch.apply(link)
+			return invalid
+		})
+		if err != nil {
+			writeLinkError(w, tiny, err, invalid)
+			return
+		}
+		writeJSON(w, http.StatusOK, link)
+	case "DELETE":
+		if err := db.DeleteLink(domain, tiny, actor); err != nil {
+			writeLinkError(w, tiny, err, nil)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		Debugf("Request not allowed method '%s'\n", r.Method)
+		writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: fmt.Sprintf("HTTP method '%s' is not allowed.\n", r.Method)})
+	}
+}
+
+// linkTargetsHandle serves "/admin/links/{tiny}/targets". PUT replaces all targeting rules of the link.
+func linkTargetsHandle(cfg *Config, db *DB, w http.ResponseWriter, r *http.Request, domain string, tiny string, actor string) {
+	switch r.Method {
+	case "GET":
+		link, err := db.LoadLink(domain, tiny)
+		if err != nil {
+			writeJSON(w, http.StatusNotFound, ErrorResponse{Error: fmt.Sprintf("'%s' is not found.\n", tiny)})
+			return
+		}
+		writeJSON(w, http.StatusOK, nonNilTargets(link.Targets))
+	case "PUT":
+		var targets []*LinkTarget
+		if err := readJSON(cfg, w, r, &targets); err != nil {
+			writeBodyError(w, err, "Request body must be JSON array of targets.\n")
+			return
+		}
+		if err := NormalizeTargets(targets); err != nil {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error() + "\n"})
+			return
+		}
+		link, err := db.SetTargets(domain, tiny, actor, targets)
+		if err != nil {
+			writeLinkError(w, tiny, err, nil)
+			return
+		}
+		writeJSON(w, http.StatusOK, nonNilTargets(link.Targets))
+	default:
+		Debugf("Request not allowed method '%s'\n", r.Method)
+		writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: fmt.Sprintf("HTTP method '%s' is not allowed.\n", r.Method)})
+	}
+}
+
+// nonNilTargets makes JSON of no targets "[]" instead of "null".
+func nonNilTargets(targets []*LinkTarget) []*LinkTarget {
+	if targets == nil {
+		return []*LinkTarget{}
+	}
+	return targets
+}
+
+// linkVariantsHandle serves "/admin/links/{tiny}/variants". PUT replaces all variants of the link.
+func linkVariantsHandle(cfg *Config, db *DB, w http.ResponseWriter, r *http.Request, domain string, tiny string, actor string) {
+	switch r.Method {
+	case "GET":
+		link, err := db.LoadLink(domain, tiny)
+		if err != nil {
+			writeJSON(w, http.StatusNotFound, ErrorResponse{Error: fmt.Sprintf("'%s' is not found.\n", tiny)})
+			return
+		}
+		writeJSON(w, http.StatusOK, nonNilVariants(link.Variants))
+	case "PUT":
+		var variants []*LinkVariant
+		if err := readJSON(cfg, w, r, &variants); err != nil {
+			writeBodyError(w, err, "Request body must be JSON array of variants.\n")
+			return
+		}
+		if err := NormalizeVariants(variants); err != nil {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error() + "\n"})
+			return
+		}
+		link, err := db.SetVariants(domain, tiny, actor, variants)
+		if err != nil {
+			writeLinkError(w, tiny, err, nil)
+			return
+		}
+		writeJSON(w, http.StatusOK, nonNilVariants(link.Variants))
+	default:
+		Debugf("Request not allowed method '%s'\n", r.Method)
+		writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: fmt.Sprintf("HTTP method '%s' is not allowed.\n", r.Method)})
+	}
+}
+
+// nonNilVariants makes JSON of no variants "[]" instead of "null".
+func nonNilVariants(variants []*LinkVariant) []*LinkVariant {
+	if variants == nil {
+		return []*LinkVariant{}
+	}
+	return variants
+}
+
+// linkScheduleHandle serves "/admin/links/{tiny}/schedule". PUT replaces the schedule of the link.
+func linkScheduleHandle(cfg *Config, db *DB, w http.ResponseWriter, r *http.Request, domain string, tiny string, actor string) {
+	switch r.Method {
+	case "GET":
+		link, err := db.LoadLink(domain, tiny)
+		if err != nil {
+			writeJSON(w, http.StatusNotFound, ErrorResponse{Error: fmt.Sprintf("'%s' is not found.\n", tiny)})
+			return
+		}
+		writeJSON(w, http.StatusOK, nonNilSchedule(link.Schedule))
+	case "PUT":
+		var schedule []*ScheduleEntry
+		if err := readJSON(cfg, w, r, &schedule); err != nil {
+			writeBodyError(w, err, "Request body must be JSON array of schedule entries.\n")
+			return
+		}
+		if err := NormalizeSchedule(schedule); err != nil {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error() + "\n"})
+			return
+		}
+		link, err := db.SetSchedule(domain, tiny, actor, schedule)
+		if err != nil {
+			writeLinkError(w, tiny, err, nil)
+			return
+		}
+		writeJSON(w, http.StatusOK, nonNilSchedule(link.Schedule))
+	default:
+		Debugf("Request not allowed method '%s'\n", r.Method)
+		writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: fmt.Sprintf("HTTP method '%s' is not allowed.\n", r.Method)})
+	}
+}
+
+// nonNilSchedule makes JSON of no schedule "[]" instead of "null".
+func nonNilSchedule(schedule []*ScheduleEntry) []*ScheduleEntry {
+	if schedule == nil {
+		return []*ScheduleEntry{}
+	}
+	return schedule
+}
+
+// writeLinkError responds err of updating or deleting a link. invalid is the validation error of the request if any.
+func writeLinkError(w http.ResponseWriter, tiny string, err error, invalid error) {
+	switch {
+	case err == errLinkNotFound:
+		writeJSON(w, http.StatusNotFound, ErrorResponse{Error: fmt.Sprintf("'%s' is not found.\n", tiny)})
+	case invalid != nil && err == invalid:
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: invalid.Error()})
+	default:
+		Errorf("LinkError: %v\n", err)
+		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "Internal server error.\n"})
+	}
+}
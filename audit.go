@@ -0,0 +1,146 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+const SQL_CREATE_AUDIT_LOGS = `
+	create table audit_logs (
+		id integer primary key autoincrement,
+		actor text not null,
+		action text not null,
+		tiny text not null,
+		before text,
+		after text,
+		created_at datetime not null
+	);
+	create index audit_logs_tiny on audit_logs(tiny);
+	create index audit_logs_created_at on audit_logs(created_at);
+`
+
+// SQL_ADD_AUDIT_LOGS_DOMAIN records the domain of links, since the same tiny can be used on each domain.
+const SQL_ADD_AUDIT_LOGS_DOMAIN = `
+	alter table audit_logs add column domain text not null default '';
+`
+
+const (
+	AUDIT_CREATE string = "create"
+	AUDIT_UPDATE string = "update"
+	AUDIT_DELETE string = "delete"
+)
+
+type AuditLog struct {
+	ID        int64           `json:"ID"`
+	Actor     string          `json:"Actor"`
+	Action    string          `json:"Action"`
+	Domain    string          `json:"Domain,omitempty"`
+	Tiny      string          `json:"Tiny"`
+	Before    json.RawMessage `json:"Before"`
+	After     json.RawMessage `json:"After"`
+	CreatedAt time.Time       `json:"CreatedAt"`
+}
+
+// AuditFilter narrows down audit logs. Zero values mean "no condition".
+type AuditFilter struct {
+	Actor  string
+	Action string
+	Domain string
+	Tiny   string
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+}
+
+// writeAuditLog appends a record to audit_logs in tx, so that it is committed or rollbacked together with the mutation.
+// before and after are snapshots of the link and are stored as json. nil is stored as NULL.
+func writeAuditLog(tx *sql.Tx, actor string, action string, domain string, tiny string, before interface{}, after interface{}) error {
+	b, err := marshalAuditValue(before)
+	if err != nil {
+		return err
+	}
+	a, err := marshalAuditValue(after)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO audit_logs(actor, action, domain, tiny, before, after, created_at) VALUES(?, ?, ?, ?, ?, ?, ?)",
+		actor, action, domain, tiny, b, a, time.Now().UTC())
+	return err
+}
+
+func marshalAuditValue(v interface{}) (sql.NullString, error) {
+	if v == nil {
+		return sql.NullString{}, nil
+	}
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(buf), Valid: true}, nil
+}
+
+// GetAuditLogs returns audit logs matched with f in order of creation.
+func (db *DB) GetAuditLogs(f AuditFilter) ([]AuditLog, error) {
+	var conds []string
+	var args []interface{}
+	if f.Actor != "" {
+		conds = append(conds, "actor = ?")
+		args = append(args, f.Actor)
+	}
+	if f.Action != "" {
+		conds = append(conds, "action = ?")
+		args = append(args, f.Action)
+	}
+	if f.Domain != "" {
+		conds = append(conds, "domain = ?")
+		args = append(args, f.Domain)
+	}
+	if f.Tiny != "" {
+		conds = append(conds, "tiny = ?")
+		args = append(args, f.Tiny)
+	}
+	if !f.Since.IsZero() {
+		conds = append(conds, "created_at >= ?")
+		args = append(args, f.Since.UTC())
+	}
+	if !f.Until.IsZero() {
+		conds = append(conds, "created_at < ?")
+		args = append(args, f.Until.UTC())
+	}
+
+	query := "SELECT id, actor, action, domain, tiny, before, after, created_at FROM audit_logs"
+	if len(conds) > 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+	query += " ORDER BY id"
+	if f.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, f.Limit)
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		Warnf("Select query of audit_logs table is failed. Error: %v\n", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	logs := []AuditLog{}
+	for rows.Next() {
+		var l AuditLog
+		var before, after sql.NullString
+		if err = rows.Scan(&l.ID, &l.Actor, &l.Action, &l.Domain, &l.Tiny, &before, &after, &l.CreatedAt); err != nil {
+			return nil, err
+		}
+		if before.Valid {
+			l.Before = json.RawMessage(before.String)
+		}
+		if after.Valid {
+			l.After = json.RawMessage(after.String)
+		}
+		logs = append(logs, l)
+	}
+	return logs, rows.Err()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestAuditLogOfAddTinyURL(t *testing.T) {
+	db := connectTempDB(t)
+
+	origin := "https://example.com/audit"
+	tiny, err := db.AddTinyURL(origin, "ip:192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// same origin is not a mutation, so no log is expected.
+	if _, err = db.AddTinyURL(origin, "ip:192.0.2.2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.AddTinyURL("https://example.com/other", "key:admin"); err != nil {
+		t.Fatal(err)
+	}
+
+	logs, err := db.GetAuditLogs(AuditFilter{Tiny: tiny})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 1 {
+		t.Fatalf("real: %d logs  expected: 1 log\n", len(logs))
+	}
+	l := logs[0]
+	if l.Actor != "ip:192.0.2.1" || l.Action != AUDIT_CREATE || l.Before != nil {
+		t.Fatalf("unexpected log: %+v\n", l)
+	}
+	var after Link
+	if err = json.Unmarshal(l.After, &after); err != nil {
+		t.Fatal(err)
+	}
+	if after.Origin != origin || after.Tiny != tiny {
+		t.Fatalf("real: %+v  expected origin: %s\n", after, origin)
+	}
+
+	logs, err = db.GetAuditLogs(AuditFilter{Actor: "key:admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 1 {
+		t.Fatalf("real: %d logs  expected: 1 log\n", len(logs))
+	}
+
+	logs, err = db.GetAuditLogs(AuditFilter{Since: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 0 {
+		t.Fatalf("real: %d logs  expected: no log\n", len(logs))
+	}
+}
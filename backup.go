@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+const BACKUP_FILE_PREFIX string = "tinyurl-"
+const BACKUP_FILE_SUFFIX string = ".db"
+const BACKUP_TIME_FORMAT string = "20060102T150405Z"
+
+// pages copied by a backup step. The database is unlocked between steps, so writers are not blocked long.
+const BACKUP_PAGES_PER_STEP int = 128
+
+// Backup copies the database to fileName by SQLite online backup API.
+// It is safe to run while the server is writing. The file is written atomically.
+func (db *DB) Backup(fileName string) error {
+	tmpFileName := fileName + ".tmp"
+	os.Remove(tmpFileName)
+	if err := backupDatabase(db.DB, tmpFileName); err != nil {
+		os.Remove(tmpFileName)
+		return err
+	}
+	return os.Rename(tmpFileName, fileName)
+}
+
+func backupDatabase(src *sql.DB, fileName string) error {
+	ctx := context.Background()
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+
+	dst, err := sql.Open("sqlite3", sqliteURI(fileName, nil))
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	dstConn, err := dst.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer dstConn.Close()
+
+	return dstConn.Raw(func(dc interface{}) error {
+		return srcConn.Raw(func(sc interface{}) error {
+			d, ok := dc.(*sqlite3.SQLiteConn)
+			s, ok2 := sc.(*sqlite3.SQLiteConn)
+			if !ok || !ok2 {
+				return errors.New("BackupError: Connection is not sqlite3.")
+			}
+			b, err := d.Backup("main", s, "main")
+			if err != nil {
+				return err
+			}
+			for {
+				done, err := b.Step(BACKUP_PAGES_PER_STEP)
+				if err != nil {
+					b.Close()
+					return err
+				}
+				if done {
+					break
+				}
+				// source is locked by a writer or more pages remain. Give writers a chance.
+				time.Sleep(10 * time.Millisecond)
+			}
+			return b.Finish()
+		})
+	})
+}
+
+// BackupToDir creates a timestamped backup in dir and removes old backups exceeding retention.
+// retention <= 0 keeps all backups.
+func (db *DB) BackupToDir(dir string, retention int) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	fileName := filepath.Join(dir, BACKUP_FILE_PREFIX+time.Now().UTC().Format(BACKUP_TIME_FORMAT)+BACKUP_FILE_SUFFIX)
+	if err := db.Backup(fileName); err != nil {
+		return "", err
+	}
+	Infof("Database is backed up to \"%s\".\n", fileName)
+
+	if retention > 0 {
+		if err := pruneBackups(dir, retention); err != nil {
+			Warnf("Removing old backups in \"%s\" was failed. Error: %v\n", dir, err)
+		}
+	}
+	return fileName, nil
+}
+
+func pruneBackups(dir string, retention int) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var backups []string
+	for _, e := range entries {
+		name := e.Name()
+		if !e.IsDir() && strings.HasPrefix(name, BACKUP_FILE_PREFIX) && strings.HasSuffix(name, BACKUP_FILE_SUFFIX) {
+			backups = append(backups, name)
+		}
+	}
+	// timestamp format sorts by name.
+	sort.Strings(backups)
+	for i := 0; i < len(backups)-retention; i++ {
+		if err = os.Remove(filepath.Join(dir, backups[i])); err != nil {
+			return err
+		}
+		Infof("Old backup \"%s\" is removed.\n", backups[i])
+	}
+	return nil
+}
+
+// StartBackupScheduler backs up the database to cfg.BackupDir every cfg.BackupInterval until ctx is done.
+func StartBackupScheduler(ctx context.Context, cfg *Config, db *DB) {
+	if cfg.BackupInterval <= 0 {
+		return
+	}
+	Infof("Database will be backed up to \"%s\" every %v.\n", cfg.BackupDir, cfg.BackupInterval)
+	go func() {
+		ticker := time.NewTicker(cfg.BackupInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if _, err := db.BackupToDir(cfg.BackupDir, cfg.BackupRetention); err != nil {
+					Errorf("BackupError: %v\n", err)
+				}
+			}
+		}
+	}()
+}
+
+// VerifyBackup checks that fileName is a healthy tiny-url database.
+func VerifyBackup(fileName string) error {
+	if _, err := os.Stat(fileName); err != nil {
+		return err
+	}
+	db, err := sql.Open("sqlite3", sqliteURI(fileName, url.Values{"mode": {"ro"}}))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("PRAGMA integrity_check")
+	if err != nil {
+		return err
+	}
+	var results []string
+	for rows.Next() {
+		var result string
+		if err = rows.Scan(&result); err != nil {
+			rows.Close()
+			return err
+		}
+		results = append(results, result)
+	}
+	rows.Close()
+	if len(results) != 1 || results[0] != "ok" {
+		return errors.New(fmt.Sprintf("RestoreError: Integrity check of \"%s\" was failed. %s", fileName, strings.Join(results, "; ")))
+	}
+
+	var n int
+	if err = db.QueryRow("SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = 'urls'").Scan(&n); err != nil {
+		return err
+	}
+	if n != 1 {
+		return errors.New(fmt.Sprintf("RestoreError: \"%s\" is not tiny-url database.", fileName))
+	}
+	return nil
+}
+
+// RestoreDB verifies backupFileName and swaps dbFileName with it.
+// The current database is kept as "<dbFileName>.before-restore" with its journal files,
+// so that pages committed to the WAL but not checkpointed yet are kept. The server must be stopped.
+func RestoreDB(backupFileName string, dbFileName string) error {
+	if err := VerifyBackup(backupFileName); err != nil {
+		return err
+	}
+
+	tmpFileName := dbFileName + ".restore"
+	if err := copyFile(backupFileName, tmpFileName); err != nil {
+		os.Remove(tmpFileName)
+		return err
+	}
+	beforeFileName := dbFileName + ".before-restore"
+	if _, err := os.Stat(dbFileName); err == nil {
+		// journal files of an older copy must not be applied to this one.
+		for _, suffix := range []string{"-wal", "-shm", "-journal"} {
+			os.Remove(beforeFileName + suffix)
+		}
+		if err = os.Rename(dbFileName, beforeFileName); err != nil {
+			os.Remove(tmpFileName)
+			return err
+		}
+	}
+	// journal files of the old database must not be applied to the restored one, and belong to its copy.
+	for _, suffix := range []string{"-wal", "-shm", "-journal"} {
+		if _, err := os.Stat(dbFileName + suffix); err != nil {
+			continue
+		}
+		if err := os.Rename(dbFileName+suffix, beforeFileName+suffix); err != nil {
+			os.Remove(tmpFileName)
+			return err
+		}
+	}
+	if err := os.Rename(tmpFileName, dbFileName); err != nil {
+		return err
+	}
+	Infof("Database \"%s\" is restored from \"%s\".\n", dbFileName, backupFileName)
+	return nil
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err = out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBackupAndRestore(t *testing.T) {
+	db := connectTempDB(t)
+	origin := "https://example.com/backup"
+	tiny, err := db.AddTinyURL(origin, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "tinyurl-backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// only the newest 2 backups are expected to be kept.
+	// backups are renamed to old timestamps so that they don't collide within a second.
+	var backup string
+	for i := 0; i < 3; i++ {
+		if backup, err = db.BackupToDir(dir, 2); err != nil {
+			t.Fatal(err)
+		}
+		if err = os.Rename(backup, filepath.Join(dir, fmt.Sprintf("%s2000010%dT000000Z%s", BACKUP_FILE_PREFIX, i+1, BACKUP_FILE_SUFFIX))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backups, err := filepath.Glob(filepath.Join(dir, BACKUP_FILE_PREFIX+"*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 2 {
+		t.Fatalf("real: %v  expected: 2 backups\n", backups)
+	}
+	backup = backups[len(backups)-1]
+
+	dbFileName := filepath.Join(dir, "restored.db")
+	if err = RestoreDB(backup, dbFileName); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := ConnectDB(testDBConfig(dbFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	result, err := restored.GetOriginURL("", tiny)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != origin {
+		t.Fatalf("real: %s  expected: %s\n", result, origin)
+	}
+}
+
+func TestRestoreBrokenBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tinyurl-backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	broken := filepath.Join(dir, "broken.db")
+	if err = ioutil.WriteFile(broken, []byte("this is not sqlite database"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dbFileName := filepath.Join(dir, "tinyurl.db")
+	if err = ioutil.WriteFile(dbFileName, []byte("current"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = RestoreDB(broken, dbFileName); err == nil {
+		t.Fatal("restoring broken backup is expected to fail")
+	}
+	if buf, _ := ioutil.ReadFile(dbFileName); string(buf) != "current" {
+		t.Fatal("current database is expected not to be changed")
+	}
+}
+
+func TestRestoreKeepsWAL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tinyurl-backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dbFileName := filepath.Join(dir, "tinyurl.db")
+	db, err := ConnectDB(testDBConfig(dbFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	backup, err := db.BackupToDir(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the link is only in the WAL while the database is open.
+	origin := "https://example.com/wal"
+	tiny, err := db.AddTinyURL(origin, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(dbFileName + "-wal"); err != nil || info.Size() == 0 {
+		t.Fatalf("WAL is expected to have the link. real: %v %v\n", info, err)
+	}
+
+	if err = RestoreDB(backup, dbFileName); err != nil {
+		t.Fatal(err)
+	}
+	before, err := ConnectDB(testDBConfig(dbFileName + ".before-restore"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer before.Close()
+	result, err := before.GetOriginURL("", tiny)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != origin {
+		t.Fatalf("real: %s  expected: %s\n", result, origin)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// BATCH_MAX_PASSWORDS is the number of URLs with password in a batch request, because hashing passwords is slow on purpose.
+const BATCH_MAX_PASSWORDS int = 10
+
+// BatchResult is the result of an URL in the batch request.
+type BatchResult struct {
+	// Status is HTTP status the URL gets by "POST /" alone.
+	Status int `json:"Status"`
+	TinyPost
+}
+
+// batchHandleMiddle shortens URLs in the JSON array of TinyPost. URLs are validated concurrently,
+// and valid ones are added in a single transaction. Results are returned in the same order as URLs.
+// A batch makes the server request many origins, so it requires an API key or a signed in user.
+func batchHandleMiddle(cfg *Config, db *DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		d, ok := requestDomain(cfg, w, r)
+		if !ok {
+			return
+		}
+		if r.Method != "POST" {
+			Debugf("Request not allowed method '%s'\n", r.Method)
+			writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: fmt.Sprintf("HTTP method '%s' is not allowed.\n", r.Method)})
+			return
+		}
+		if _, ok := apiKeyName(cfg, r); !ok && requestUser(r) == nil {
+			Infof("Unauthorized batch request from %s\n", r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSON(w, http.StatusUnauthorized, ErrorResponse{Error: "Valid API key or sign in is required.\n"})
+			return
+		}
+
+		var posts []*TinyPost
+		if err := readJSON(cfg, w, r, &posts); err != nil {
+			writeBodyError(w, err, "Request body must be JSON array of URLs.\n")
+			return
+		}
+		if len(posts) == 0 || len(posts) > cfg.BatchMaxURLs {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("Number of URLs must be 1-%d.\n", cfg.BatchMaxURLs)})
+			return
+		}
+		passwords := 0
+		for _, post := range posts {
+			if post != nil && post.Password != "" {
+				passwords++
+			}
+		}
+		if passwords > BATCH_MAX_PASSWORDS {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("Up to %d URLs in a batch can have password.\n", BATCH_MAX_PASSWORDS)})
+			return
+		}
+		Debugf("%d URLs are posted from %s\n", len(posts), r.RemoteAddr)
+
+		results := make([]BatchResult, len(posts))
+		links := make([]*Link, len(posts))
+		var wg sync.WaitGroup
+		sem := make(chan struct{}, cfg.BatchConcurrency)
+		for i, post := range posts {
+			if post == nil {
+				results[i] = BatchResult{Status: http.StatusBadRequest, TinyPost: TinyPost{Error: "URL is null.\n"}}
+				continue
+			}
+			wg.Add(1)
+			go func(i int, post *TinyPost) {
+				defer wg.Done()
+				sem <- struct{}{}
+				defer func() { <-sem }()
+				link, status, message := newLinkFromPost(cfg, db, d, post)
+				links[i] = link
+				results[i] = BatchResult{Status: status, TinyPost: TinyPost{Origin: post.Origin, Error: message}}
+			}(i, post)
+		}
+		wg.Wait()
+
+		var valid []*Link
+		var indexes []int
+		user := requestUser(r)
+		for i, link := range links {
+			if link != nil {
+				if user != nil {
+					link.OwnerID = user.ID
+				}
+				valid = append(valid, link)
+				indexes = append(indexes, i)
+			}
+		}
+		if len(valid) > 0 {
+			added, err := db.AddLinks(valid, d.TinyLength, requestActor(cfg, r))
+			if err != nil {
+				Errorf("AddTinyURLError: %v\n", err)
+				writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "Internal server error.\n"})
+				return
+			}
+			for j, link := range added {
+				results[indexes[j]] = BatchResult{Status: http.StatusOK, TinyPost: linkPost(d, link)}
+			}
+		}
+		Infof("%d of %d URLs are shortened by batch request from %s\n", len(valid), len(posts), r.RemoteAddr)
+		writeJSON(w, http.StatusOK, results)
+	}
+}
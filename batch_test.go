@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func postBatch(t *testing.T, url string, body string, apiKey string) *http.Response {
+	req, err := http.NewRequest("POST", url+"/batch", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestBatch(t *testing.T) {
+	server, cfg, db := startTestServer(t)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer origin.Close()
+
+	body := `[
+		{"Origin":"` + origin.URL + `/a"},
+		{"Origin":"` + origin.URL + `/b","RedirectCode":303},
+		{"Origin":"` + origin.URL + `/missing"},
+		null,
+		{"Origin":"` + origin.URL + `/a"},
+		{"Origin":"` + origin.URL + `/c","MaxClicks":5}
+	]`
+	// a batch requires an API key or a signed in user.
+	resp := postBatch(t, server.URL, body, "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("real: %d  expected: 401\n", resp.StatusCode)
+	}
+
+	resp = postBatch(t, server.URL, body, testAPIKey)
+	var results []BatchResult
+	err := json.NewDecoder(resp.Body).Decode(&results)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []int{http.StatusOK, http.StatusBadRequest, http.StatusUnprocessableEntity, http.StatusBadRequest, http.StatusOK, http.StatusOK}
+	if resp.StatusCode != http.StatusOK || len(results) != len(expected) {
+		t.Fatalf("real: %d %+v  expected: 200 with %d results\n", resp.StatusCode, results, len(expected))
+	}
+	for i, status := range expected {
+		if results[i].Status != status || (status == http.StatusOK) != (results[i].Error == "") {
+			t.Fatalf("%d real: %+v  expected: %d\n", i, results[i], status)
+		}
+	}
+	// the same URL in a batch gets the same tiny.
+	if results[0].Tiny == "" || results[0].Tiny != results[4].Tiny || results[5].MaxClicks != 5 {
+		t.Fatalf("unexpected results: %+v\n", results)
+	}
+	logs, err := db.GetAuditLogs(AuditFilter{Action: AUDIT_CREATE, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 2 {
+		t.Fatalf("real: %d  expected: 2\n", len(logs))
+	}
+
+	passwords := strings.TrimSuffix(strings.Repeat(`{"Origin":"https://example.com/","Password":"secret"},`, BATCH_MAX_PASSWORDS+1), ",")
+	resp = postBatch(t, server.URL, "["+passwords+"]", testAPIKey)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("real: %d  expected: 400\n", resp.StatusCode)
+	}
+
+	cfg.BatchMaxURLs = 1
+	for _, body := range []string{`[]`, `[{"Origin":"https://example.com/1"},{"Origin":"https://example.com/2"}]`, `{"Origin":"https://example.com/"}`} {
+		resp = postBatch(t, server.URL, body, testAPIKey)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("%s real: %d  expected: 400\n", body, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// RedirectCache is a bounded LRU cache of (domain, tiny) -> link.
+// Links expire after ttl, so that changes not invalidated (e.g. by another process sharing the database) are seen eventually.
+// Misses are cached too (negative caching) but expire after negativeTTL,
+// because a tiny path not found now may be created later. Misses are kept in their own LRU list bounded by
+// negativeCapacity, so that requests of random paths never evict cached links.
+type RedirectCache struct {
+	mu               sync.Mutex
+	capacity         int
+	ttl              time.Duration
+	negativeCapacity int
+	negativeTTL      time.Duration
+	ll               *list.List
+	negativeLL       *list.List
+	items            map[string]*list.Element
+	// generation is incremented by every invalidation. Entries read from the database before an invalidation are not cached.
+	generation uint64
+	stats      CacheStats
+}
+
+type cacheEntry struct {
+	key string
+	// link is nil if tiny is cached as not found.
+	link      *Link
+	expiresAt time.Time
+}
+
+type CacheStats struct {
+	Size         int    `json:"Size"`
+	Capacity     int    `json:"Capacity"`
+	NegativeSize int    `json:"NegativeSize"`
+	Hits         uint64 `json:"Hits"`
+	NegativeHits uint64 `json:"NegativeHits"`
+	Misses       uint64 `json:"Misses"`
+	Evictions    uint64 `json:"Evictions"`
+}
+
+func NewRedirectCache(capacity int, ttl time.Duration, negativeCapacity int, negativeTTL time.Duration) *RedirectCache {
+	return &RedirectCache{
+		capacity:         capacity,
+		ttl:              ttl,
+		negativeCapacity: negativeCapacity,
+		negativeTTL:      negativeTTL,
+		ll:               list.New(),
+		negativeLL:       list.New(),
+		items:            map[string]*list.Element{},
+	}
+}
+
+// cacheKey is the key of tiny on domain. Domains never have "/".
+func cacheKey(domain string, tiny string) string {
+	return domain + "/" + tiny
+}
+
+// Get returns a copy of the cached link of tiny on domain. ok is false if tiny is not cached.
+// If ok is true and link is nil, tiny is cached as not found.
+func (c *RedirectCache) Get(domain string, tiny string) (link *Link, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.items[cacheKey(domain, tiny)]
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+	entry := e.Value.(*cacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		c.removeElement(e)
+		c.stats.Misses++
+		return nil, false
+	}
+	if entry.link == nil {
+		c.negativeLL.MoveToFront(e)
+		c.stats.NegativeHits++
+		return nil, true
+	}
+	c.ll.MoveToFront(e)
+	c.stats.Hits++
+	l := *entry.link
+	return &l, true
+}
+
+// Generation must be read before the link is read from the database, and passed to Put or PutMiss.
+func (c *RedirectCache) Generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+// Put caches a copy of link read at generation. It is not cached if any link is invalidated since then,
+// because the link may be older than the invalidation.
+func (c *RedirectCache) Put(link *Link, generation uint64) {
+	if c.ttl <= 0 {
+		return
+	}
+	l := *link
+	c.put(&cacheEntry{key: cacheKey(link.Domain, link.Tiny), link: &l, expiresAt: time.Now().Add(c.ttl)}, generation)
+}
+
+// PutMiss caches that tiny is not found on domain at generation for negativeTTL.
+func (c *RedirectCache) PutMiss(domain string, tiny string, generation uint64) {
+	if c.negativeTTL <= 0 || c.negativeCapacity <= 0 {
+		return
+	}
+	c.put(&cacheEntry{key: cacheKey(domain, tiny), expiresAt: time.Now().Add(c.negativeTTL)}, generation)
+}
+
+func (c *RedirectCache) put(entry *cacheEntry, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+	if e, ok := c.items[entry.key]; ok {
+		c.removeElement(e)
+	}
+	ll, capacity := c.ll, c.capacity
+	if entry.link == nil {
+		ll, capacity = c.negativeLL, c.negativeCapacity
+	}
+	c.items[entry.key] = ll.PushFront(entry)
+	for ll.Len() > capacity {
+		c.removeElement(ll.Back())
+		c.stats.Evictions++
+	}
+}
+
+// Invalidate removes tiny on domain from the cache. It must be called when the link is created, updated or deleted.
+func (c *RedirectCache) Invalidate(domain string, tiny string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	if e, ok := c.items[cacheKey(domain, tiny)]; ok {
+		c.removeElement(e)
+	}
+}
+
+func (c *RedirectCache) removeElement(e *list.Element) {
+	entry := e.Value.(*cacheEntry)
+	if entry.link == nil {
+		c.negativeLL.Remove(e)
+	} else {
+		c.ll.Remove(e)
+	}
+	delete(c.items, entry.key)
+}
+
+func (c *RedirectCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Size = c.ll.Len()
+	stats.Capacity = c.capacity
+	stats.NegativeSize = c.negativeLL.Len()
+	return stats
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRedirectCacheEviction(t *testing.T) {
+	c := NewRedirectCache(2, time.Minute, 2, time.Minute)
+	c.Put(&Link{Tiny: "a", Origin: "https://example.com/a"}, 0)
+	c.Put(&Link{Tiny: "b", Origin: "https://example.com/b"}, 0)
+	// "a" becomes the most recently used, so "b" is evicted.
+	if link, ok := c.Get("", "a"); !ok || link.Origin != "https://example.com/a" {
+		t.Fatalf("real: %+v, %v  expected: https://example.com/a, true\n", link, ok)
+	}
+	c.Put(&Link{Tiny: "c", Origin: "https://example.com/c"}, 0)
+	if _, ok := c.Get("", "b"); ok {
+		t.Fatal("b is expected to be evicted")
+	}
+	if _, ok := c.Get("", "c"); !ok {
+		t.Fatal("c is expected to be cached")
+	}
+
+	c.Invalidate("", "c")
+	if _, ok := c.Get("", "c"); ok {
+		t.Fatal("c is expected to be invalidated")
+	}
+
+	stats := c.Stats()
+	if stats.Hits != 2 || stats.Misses != 2 || stats.Evictions != 1 || stats.Size != 1 {
+		t.Fatalf("unexpected stats: %+v\n", stats)
+	}
+}
+
+func TestRedirectCacheNegativeTTL(t *testing.T) {
+	c := NewRedirectCache(10, time.Minute, 10, 50*time.Millisecond)
+	c.PutMiss("", "a", 0)
+	if link, ok := c.Get("", "a"); !ok || link != nil {
+		t.Fatalf("real: %+v, %v  expected: nil, true\n", link, ok)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := c.Get("", "a"); ok {
+		t.Fatal("negative entry is expected to expire")
+	}
+	if stats := c.Stats(); stats.NegativeHits != 1 || stats.Misses != 1 {
+		t.Fatalf("unexpected stats: %+v\n", stats)
+	}
+}
+
+func TestRedirectCacheGeneration(t *testing.T) {
+	c := NewRedirectCache(10, time.Minute, 10, time.Minute)
+	// the link is read before an update, and put after the update invalidated it.
+	generation := c.Generation()
+	c.Invalidate("", "a")
+	c.Put(&Link{Tiny: "a", Origin: "https://example.com/old"}, generation)
+	if _, ok := c.Get("", "a"); ok {
+		t.Fatal("link read before invalidation is expected not to be cached")
+	}
+	c.PutMiss("", "b", generation)
+	if _, ok := c.Get("", "b"); ok {
+		t.Fatal("miss read before invalidation is expected not to be cached")
+	}
+	c.Put(&Link{Tiny: "a", Origin: "https://example.com/new"}, c.Generation())
+	if link, ok := c.Get("", "a"); !ok || link.Origin != "https://example.com/new" {
+		t.Fatalf("real: %+v, %v  expected: https://example.com/new, true\n", link, ok)
+	}
+}
+
+func TestRedirectCacheTTL(t *testing.T) {
+	c := NewRedirectCache(10, 50*time.Millisecond, 10, time.Minute)
+	c.Put(&Link{Tiny: "a", Origin: "https://example.com/a"}, 0)
+	if _, ok := c.Get("", "a"); !ok {
+		t.Fatal("a is expected to be cached")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := c.Get("", "a"); ok {
+		t.Fatal("link is expected to expire")
+	}
+}
+
+func TestRedirectCacheNegativeSize(t *testing.T) {
+	c := NewRedirectCache(2, time.Minute, 2, time.Minute)
+	c.Put(&Link{Tiny: "a", Origin: "https://example.com/a"}, 0)
+	c.Put(&Link{Tiny: "b", Origin: "https://example.com/b"}, 0)
+	// misses of random paths evict only misses.
+	for _, tiny := range []string{"x", "y", "z"} {
+		c.PutMiss("", tiny, 0)
+	}
+	for _, tiny := range []string{"a", "b"} {
+		if _, ok := c.Get("", tiny); !ok {
+			t.Fatalf("%s is expected to be cached\n", tiny)
+		}
+	}
+	if _, ok := c.Get("", "x"); ok {
+		t.Fatal("x is expected to be evicted")
+	}
+	if stats := c.Stats(); stats.Size != 2 || stats.NegativeSize != 2 || stats.Evictions != 1 {
+		t.Fatalf("unexpected stats: %+v\n", stats)
+	}
+}
+
+func TestGetOriginURLCache(t *testing.T) {
+	db := connectTempDB(t)
+	if db.cache == nil {
+		t.Fatal("cache is expected to be enabled by default")
+	}
+
+	// miss is cached, and creating the link invalidates it.
+	tiny := "cachetest"
+	if _, err := db.GetOriginURL("", tiny); err == nil {
+		t.Fatal("not found error is expected")
+	}
+	input := "tiny,origin\n" + tiny + ",https://example.com/cache\n"
+	if _, err := db.ImportLinks(strings.NewReader(input), FORMAT_CSV, CONFLICT_FAIL, "test"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		origin, err := db.GetOriginURL("", tiny)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if origin != "https://example.com/cache" {
+			t.Fatalf("real: %s  expected: https://example.com/cache\n", origin)
+		}
+	}
+	if stats := db.cache.Stats(); stats.Hits != 1 || stats.Misses != 2 {
+		t.Fatalf("unexpected stats: %+v\n", stats)
+	}
+}
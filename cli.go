@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+)
+
+type command struct {
+	run     func(cfg *Config, db *DB, args []string) error
+	summary string
+	// noDB is true if the command must run without opening the database.
+	noDB bool
+}
+
+// commands are subcommands of tiny-url. "serve" is run when no command is given.
+var commands = map[string]command{
+	"serve":   {run: serveCommand, summary: "start tiny-url server"},
+	"audit":   {run: auditCommand, summary: "export audit logs as JSON Lines"},
+	"export":  {run: exportCommand, summary: "export links as JSON Lines or CSV"},
+	"import":  {run: importCommand, summary: "import links from JSON Lines or CSV"},
+	"backup":  {run: backupCommand, summary: "back up the database while the server is running"},
+	"restore": {run: restoreCommand, summary: "restore the database from a backup (stop the server first)", noDB: true},
+	"check":   {run: checkCommand, summary: "check origins of all links and list broken links"},
+	"user":    {run: userCommand, summary: "add, list, change and delete users (add|list|passwd|role|delete)"},
+}
+
+var commandOrder = []string{"serve", "audit", "export", "import", "backup", "restore", "check", "user"}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [-config file] [command] [options]\n\nCommands:\n", os.Args[0])
+	for _, name := range commandOrder {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", name, commands[name].summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nOptions:\n")
+	flag.PrintDefaults()
+}
+
+func runCommand(cfg *Config, args []string) error {
+	if len(args) == 0 {
+		args = []string{"serve"}
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		usage()
+		return errors.New(fmt.Sprintf("Command '%s' is unknown.", args[0]))
+	}
+	if cmd.noDB {
+		return cmd.run(cfg, nil, args[1:])
+	}
+
+	db, err := ConnectDB(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return cmd.run(cfg, db, args[1:])
+}
+
+func serveCommand(cfg *Config, db *DB, args []string) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	StartClickFlusher(ctx, cfg, db)
+	StartBackupScheduler(ctx, cfg, db)
+	StartWebhookDispatcher(ctx, cfg, db)
+	StartHealthChecker(ctx, cfg, db)
+	return StartTinyURLServer(cfg, db)
+}
+
+func auditCommand(cfg *Config, db *DB, args []string) error {
+	fs := flag.NewFlagSet("audit", flag.ContinueOnError)
+	actor := fs.String("actor", "", "filter by actor (e.g. \"key:admin\", \"user:alice\", \"ip:127.0.0.1\")")
+	action := fs.String("action", "", "filter by action (create,update,delete)")
+	domain := fs.String("domain", "", "filter by domain of links")
+	tiny := fs.String("tiny", "", "filter by tiny path")
+	since := fs.String("since", "", "only logs created at or after this RFC3339 time")
+	until := fs.String("until", "", "only logs created before this RFC3339 time")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	f := AuditFilter{Actor: *actor, Action: *action, Tiny: *tiny}
+	if *domain != "" {
+		var ok bool
+		if f.Domain, ok = cfg.linkDomain(*domain); !ok {
+			return errors.New(fmt.Sprintf("Domain '%s' is not found", *domain))
+		}
+	}
+	var err error
+	if f.Since, err = parseTimeParam(*since); err != nil {
+		return err
+	}
+	if f.Until, err = parseTimeParam(*until); err != nil {
+		return err
+	}
+
+	logs, err := db.GetAuditLogs(f)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	for _, l := range logs {
+		if err = enc.Encode(l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cliActor returns who runs the command, used for audit logs.
+func cliActor() string {
+	if u, err := user.Current(); err == nil {
+		return "cli:" + u.Username
+	}
+	return "cli"
+}
+
+func exportCommand(cfg *Config, db *DB, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := fs.String("format", FORMAT_JSONL, "output format (jsonl,csv)")
+	output := fs.String("o", "-", "output file name (\"-\" is stdout)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "-" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	return db.ExportLinks(w, *format)
+}
+
+func importCommand(cfg *Config, db *DB, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	format := fs.String("format", FORMAT_JSONL, "input format (jsonl,csv)")
+	policy := fs.String("conflict", CONFLICT_FAIL, "policy for links conflicting with existing ones (skip,overwrite,fail)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var r io.Reader = os.Stdin
+	if name := fs.Arg(0); name != "" && name != "-" {
+		file, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+	result, err := db.ImportLinks(r, *format, *policy, cliActor())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("added: %d, updated: %d, deleted: %d, skipped: %d\n", result.Added, result.Updated, result.Deleted, result.Skipped)
+	return nil
+}
+
+func backupCommand(cfg *Config, db *DB, args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	output := fs.String("o", "", "backup file name (default: timestamped file in BackupDir)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *output != "" {
+		if err := db.Backup(*output); err != nil {
+			return err
+		}
+		fmt.Println(*output)
+		return nil
+	}
+	fileName, err := db.BackupToDir(cfg.BackupDir, cfg.BackupRetention)
+	if err != nil {
+		return err
+	}
+	fmt.Println(fileName)
+	return nil
+}
+
+func restoreCommand(cfg *Config, db *DB, args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("Backup file name is required. Usage: restore <file>")
+	}
+	return RestoreDB(fs.Arg(0), cfg.DBFileName)
+}
+
+func checkCommand(cfg *Config, db *DB, args []string) error {
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	result, err := NewHealthChecker(cfg, db).CheckLinks(context.Background(), time.Time{})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "checked:%d broken:%d recovered:%d\n", result.Checked, result.Broken, result.Recovered)
+	links, err := db.GetBrokenLinks()
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	for _, link := range links {
+		if err := enc.Encode(link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// userCommand manages users. Passwords are read from the first line of stdin, so that they are not left in shell history.
+func userCommand(cfg *Config, db *DB, args []string) error {
+	fs := flag.NewFlagSet("user", flag.ContinueOnError)
+	role := fs.String("role", ROLE_USER, "role of the new user (user,admin)")
+	usage := errors.New("Usage: user add [-role admin] <name> | user list | user passwd <name> | user role <name> <role> | user delete <name>")
+	if len(args) == 0 {
+		return usage
+	}
+	sub := args[0]
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	switch {
+	case sub == "list" && fs.NArg() == 0:
+		users, err := db.GetUsers()
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(os.Stdout)
+		for _, u := range users {
+			if err = enc.Encode(u); err != nil {
+				return err
+			}
+		}
+		return nil
+	case sub == "add" && fs.NArg() == 1:
+		password, err := readPassword()
+		if err != nil {
+			return err
+		}
+		_, err = db.AddUser(fs.Arg(0), password, *role)
+		return err
+	case sub == "passwd" && fs.NArg() == 1:
+		password, err := readPassword()
+		if err != nil {
+			return err
+		}
+		return db.SetUserPassword(fs.Arg(0), password)
+	case sub == "role" && fs.NArg() == 2:
+		return db.SetUserRole(fs.Arg(0), fs.Arg(1))
+	case sub == "delete" && fs.NArg() == 1:
+		return db.DeleteUser(fs.Arg(0))
+	}
+	return usage
+}
+
+func readPassword() (string, error) {
+	fmt.Fprintf(os.Stderr, "Password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
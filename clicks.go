@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+)
+
+// ClickCounter counts clicks of links, hits of targets and clicks of variants in memory,
+// so that redirects don't wait for writing the database. Counts are written by FlushClicks.
+type ClickCounter struct {
+	mu       sync.Mutex
+	links    map[int64]int64
+	targets  map[int64]int64
+	variants map[int64]int64
+	// events are click events to be sent to webhooks.
+	events []clickEvent
+}
+
+type clickEvent struct {
+	link *Link
+	at   time.Time
+}
+
+func NewClickCounter() *ClickCounter {
+	c := &ClickCounter{}
+	c.reset()
+	return c
+}
+
+func (c *ClickCounter) reset() {
+	c.links = map[int64]int64{}
+	c.targets = map[int64]int64{}
+	c.variants = map[int64]int64{}
+	c.events = nil
+}
+
+// take returns the counts and events not flushed yet, and clears them.
+func (c *ClickCounter) take() (links map[int64]int64, targets map[int64]int64, variants map[int64]int64, events []clickEvent) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	links, targets, variants, events = c.links, c.targets, c.variants, c.events
+	c.reset()
+	return links, targets, variants, events
+}
+
+// restore adds back the counts and events which failed to be flushed.
+func (c *ClickCounter) restore(links map[int64]int64, targets map[int64]int64, variants map[int64]int64, events []clickEvent) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for id, n := range links {
+		c.links[id] += n
+	}
+	for id, n := range targets {
+		c.targets[id] += n
+	}
+	for id, n := range variants {
+		c.variants[id] += n
+	}
+	c.events = append(events, c.events...)
+}
+
+// CountClick counts a click of link. If the link has remaining clicks, one is consumed atomically in the database
+// and ok is false if no click remains, so concurrent clicks never exceed the limit.
+// Clicks of unlimited links are written by FlushClicks.
+func (db *DB) CountClick(link *Link) (ok bool, err error) {
+	if link.RemainingClicks == nil {
+		db.clicks.mu.Lock()
+		db.clicks.links[link.ID]++
+		db.clicks.mu.Unlock()
+		db.clicked(link)
+		return true, nil
+	}
+	result, err := db.Exec("UPDATE urls SET clicks = clicks + 1, remaining_clicks = remaining_clicks - 1 WHERE id = ? AND remaining_clicks > 0", link.ID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if n == 0 {
+		// the cached link may still have remaining clicks.
+		db.invalidate(link)
+		return false, nil
+	}
+	db.clicked(link)
+	return true, nil
+}
+
+// CountTargetHit counts a hit of target. It is written by FlushClicks.
+func (db *DB) CountTargetHit(target *LinkTarget) {
+	db.clicks.mu.Lock()
+	defer db.clicks.mu.Unlock()
+	db.clicks.targets[target.ID]++
+}
+
+// CountVariantClick counts a click of variant. It is written by FlushClicks.
+func (db *DB) CountVariantClick(variant *LinkVariant) {
+	db.clicks.mu.Lock()
+	defer db.clicks.mu.Unlock()
+	db.clicks.variants[variant.ID]++
+}
+
+// clicked queues click event of link if any webhook exists. It is enqueued to the outbox by FlushClicks.
+func (db *DB) clicked(link *Link) {
+	if len(db.webhooks) == 0 {
+		return
+	}
+	db.clicks.mu.Lock()
+	defer db.clicks.mu.Unlock()
+	db.clicks.events = append(db.clicks.events, clickEvent{link: link, at: time.Now().UTC()})
+}
+
+// empty reports whether nothing is counted since the last flush.
+func (c *ClickCounter) empty() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.links) == 0 && len(c.targets) == 0 && len(c.variants) == 0 && len(c.events) == 0
+}
+
+// FlushClicks writes counted clicks and enqueues click events in a single transaction.
+// If it fails, they are kept for the next flush.
+func (db *DB) FlushClicks() (err error) {
+	if db.clicks.empty() {
+		return nil
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	restore, err := db.flushClicksTx(tx)
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+	if err != nil {
+		restore()
+		return err
+	}
+	db.wakeWebhookDispatcher()
+	return nil
+}
+
+// flushClicksTx writes counted clicks and enqueues click events in tx. Counts are kept by ids of rows,
+// so they must be flushed in the transaction replacing rows of targets or variants before the rows are deleted.
+// restore must be called if tx is not committed, so that they are written by the next flush.
+func (db *DB) flushClicksTx(tx *sql.Tx) (restore func(), err error) {
+	links, targets, variants, events := db.clicks.take()
+	restore = func() { db.clicks.restore(links, targets, variants, events) }
+	for id, n := range links {
+		if _, err = tx.Exec("UPDATE urls SET clicks = clicks + ? WHERE id = ?", n, id); err != nil {
+			return restore, err
+		}
+	}
+	for id, n := range targets {
+		if _, err = tx.Exec("UPDATE link_targets SET hits = hits + ? WHERE id = ?", n, id); err != nil {
+			return restore, err
+		}
+	}
+	for id, n := range variants {
+		if _, err = tx.Exec("UPDATE link_variants SET clicks = clicks + ? WHERE id = ?", n, id); err != nil {
+			return restore, err
+		}
+	}
+	for _, event := range events {
+		if err = db.enqueueWebhooks(tx, EVENT_LINK_CLICKED, "", event.link.Tiny, event.link, nil, event.at); err != nil {
+			return restore, err
+		}
+	}
+	Debugf("Clicks are flushed. links:%d targets:%d variants:%d events:%d\n", len(links), len(targets), len(variants), len(events))
+	return restore, nil
+}
+
+// StartClickFlusher writes counted clicks every ClickFlushInterval until ctx is done. The rest is written by Close.
+func StartClickFlusher(ctx context.Context, cfg *Config, db *DB) {
+	go func() {
+		ticker := time.NewTicker(cfg.ClickFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := db.FlushClicks(); err != nil {
+					Errorf("ClickFlushError: %v\n", err)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestFlushClicks(t *testing.T) {
+	db := connectTempDB(t)
+	link, err := db.AddLink(&Link{Origin: "https://example.com/flush"}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if ok, err := db.CountClick(link); err != nil || !ok {
+			t.Fatalf("real: %v %v  expected: true <nil>\n", ok, err)
+		}
+	}
+	var clicks int64
+	if err = db.QueryRow("SELECT clicks FROM urls WHERE id = ?", link.ID).Scan(&clicks); err != nil {
+		t.Fatal(err)
+	}
+	if clicks != 0 {
+		t.Fatalf("clicks are expected not to be written before flush. real: %d\n", clicks)
+	}
+
+	if err = db.FlushClicks(); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.QueryRow("SELECT clicks FROM urls WHERE id = ?", link.ID).Scan(&clicks); err != nil {
+		t.Fatal(err)
+	}
+	if clicks != 3 {
+		t.Fatalf("real: %d  expected: 3\n", clicks)
+	}
+	// nothing is written twice.
+	if err = db.FlushClicks(); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.QueryRow("SELECT clicks FROM urls WHERE id = ?", link.ID).Scan(&clicks); err != nil {
+		t.Fatal(err)
+	}
+	if clicks != 3 {
+		t.Fatalf("real: %d  expected: 3\n", clicks)
+	}
+}
+
+func TestFlushClicksBeforeReplacingRows(t *testing.T) {
+	db := connectTempDB(t)
+	link, err := db.AddLink(&Link{Origin: "https://example.com/split"}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	split, err := db.SetVariants("", link.Tiny, "test", []*LinkVariant{{Origin: "https://example.com/a", Weight: 1}, {Origin: "https://example.com/b", Weight: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	targeted, err := db.SetTargets("", link.Tiny, "test", []*LinkTarget{{Kind: TARGET_LANGUAGE, Match: "de", Origin: "https://example.de/"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.CountVariantClick(split.Variants[0])
+	db.CountTargetHit(targeted.Targets[0])
+
+	// clicks not flushed yet are kept by variants and targets of the same origin.
+	if split, err = db.SetVariants("", link.Tiny, "test", []*LinkVariant{{Origin: "https://example.com/a", Weight: 2}, {Origin: "https://example.com/b", Weight: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if targeted, err = db.SetTargets("", link.Tiny, "test", []*LinkTarget{{Kind: TARGET_LANGUAGE, Match: "de", Origin: "https://example.de/"}}); err != nil {
+		t.Fatal(err)
+	}
+	if split.Variants[0].Clicks != 1 || targeted.Targets[0].Hits != 1 {
+		t.Fatalf("real: %d clicks %d hits  expected: 1 click 1 hit\n", split.Variants[0].Clicks, targeted.Targets[0].Hits)
+	}
+	if err = db.FlushClicks(); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := db.LoadLink("", link.Tiny)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Variants[0].Clicks != 1 || loaded.Targets[0].Hits != 1 {
+		t.Fatalf("real: %d clicks %d hits  expected: 1 click 1 hit\n", loaded.Variants[0].Clicks, loaded.Targets[0].Hits)
+	}
+}
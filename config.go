@@ -4,7 +4,10 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
@@ -16,6 +19,33 @@ const DEFAULT_LOG_OUTPUT_MODE string = "stderr"
 const DEFAULT_LOG_LEVEL string = "info"
 const DEFAULT_HTTP_PORT int = 80
 const DEFAULT_PROTOCOL string = "http"
+const DEFAULT_DB_JOURNAL_MODE string = "wal"
+const DEFAULT_DB_SYNCHRONOUS string = "normal"
+const DEFAULT_DB_BUSY_TIMEOUT time.Duration = 5 * time.Second
+const DEFAULT_DB_MAX_IDLE_CONNS int = 2
+const DEFAULT_REDIRECT_CODE int = 301
+const DEFAULT_PASSWORD_MAX_ATTEMPTS int = 5
+const DEFAULT_PASSWORD_LOCK_DURATION time.Duration = 15 * time.Minute
+const DEFAULT_CACHE_SIZE int = 10000
+const DEFAULT_CACHE_TTL time.Duration = 5 * time.Minute
+const DEFAULT_CACHE_NEGATIVE_SIZE int = 1000
+const DEFAULT_CACHE_NEGATIVE_TTL time.Duration = 30 * time.Second
+const DEFAULT_CLICK_FLUSH_INTERVAL time.Duration = 5 * time.Second
+const DEFAULT_BACKUP_DIR string = "/opt/tinyurl/backup"
+const DEFAULT_BACKUP_RETENTION int = 7
+const DEFAULT_WEBHOOK_MAX_ATTEMPTS int = 10
+const DEFAULT_WEBHOOK_RETRY_BACKOFF time.Duration = 10 * time.Second
+const DEFAULT_WEBHOOK_TIMEOUT time.Duration = 10 * time.Second
+const DEFAULT_WEBHOOK_POLL_INTERVAL time.Duration = 5 * time.Second
+const DEFAULT_HEALTH_CHECK_CONCURRENCY int = 4
+const DEFAULT_HEALTH_CHECK_HOST_DELAY time.Duration = time.Second
+const DEFAULT_HEALTH_CHECK_TIMEOUT time.Duration = 10 * time.Second
+const DEFAULT_HEALTH_CHECK_FAILURES int = 3
+const DEFAULT_BROKEN_LINK_ACTION string = "redirect"
+const DEFAULT_BATCH_MAX_URLS int = 50
+const DEFAULT_BATCH_CONCURRENCY int = 8
+const DEFAULT_MAX_BODY_SIZE int64 = 1024 * 1024
+const DEFAULT_SESSION_TTL time.Duration = 7 * 24 * time.Hour
 
 type Config struct {
 	DBFileName    string `yaml:"DBFileName"`
@@ -24,6 +54,75 @@ type Config struct {
 	LogLevel      string `yaml:"LogLevel"`
 	HTTPPort      int    `yaml:"HTTPPort"`
 	Protocol      string `yaml:"Protocol"`
+	// DefaultRedirectCode is used for links created without redirect code (301,302,307,308).
+	DefaultRedirectCode int `yaml:"DefaultRedirectCode"`
+	// password protected link and login of a user are locked for PasswordLockDuration after PasswordMaxAttempts wrong passwords.
+	PasswordMaxAttempts  int           `yaml:"PasswordMaxAttempts"`
+	PasswordLockDuration time.Duration `yaml:"PasswordLockDuration"`
+	// sqlite3 settings applied to every connection. DBMaxOpenConns 0 means unlimited.
+	DBJournalMode  string        `yaml:"DBJournalMode"`
+	DBSynchronous  string        `yaml:"DBSynchronous"`
+	DBBusyTimeout  time.Duration `yaml:"DBBusyTimeout"`
+	DBMaxOpenConns int           `yaml:"DBMaxOpenConns"`
+	DBMaxIdleConns int           `yaml:"DBMaxIdleConns"`
+	// redirect cache keeps CacheSize links in memory for CacheTTL. Negative CacheSize disables the cache.
+	// CacheNegativeSize tiny paths not found are cached for CacheNegativeTTL apart from links.
+	CacheSize         int           `yaml:"CacheSize"`
+	CacheTTL          time.Duration `yaml:"CacheTTL"`
+	CacheNegativeSize int           `yaml:"CacheNegativeSize"`
+	CacheNegativeTTL  time.Duration `yaml:"CacheNegativeTTL"`
+	// clicks are counted in memory and written to the database every ClickFlushInterval.
+	ClickFlushInterval time.Duration `yaml:"ClickFlushInterval"`
+	// APIKeys maps a key name to its secret. Requests with "Authorization: Bearer <secret>"
+	// can use admin API and are recorded as "key:<name>" in audit logs.
+	APIKeys map[string]string `yaml:"APIKeys"`
+	// backups are created in BackupDir every BackupInterval (e.g. "24h"). 0 disables scheduled backups.
+	// Only the newest BackupRetention backups are kept.
+	BackupDir       string        `yaml:"BackupDir"`
+	BackupInterval  time.Duration `yaml:"BackupInterval"`
+	BackupRetention int           `yaml:"BackupRetention"`
+	// UTMTemplates maps a template name to query parameters (e.g. utm_source) added to origins of links created with it.
+	// Templates saved by "/admin/utm-templates" take precedence over them.
+	UTMTemplates map[string]map[string]string `yaml:"UTMTemplates"`
+	// Webhooks receive events of links. Failed deliveries are retried WebhookMaxAttempts times
+	// with backoff starting from WebhookRetryBackoff and doubling every failure.
+	Webhooks            []*Webhook    `yaml:"Webhooks"`
+	WebhookMaxAttempts  int           `yaml:"WebhookMaxAttempts"`
+	WebhookRetryBackoff time.Duration `yaml:"WebhookRetryBackoff"`
+	WebhookTimeout      time.Duration `yaml:"WebhookTimeout"`
+	WebhookPollInterval time.Duration `yaml:"WebhookPollInterval"`
+	// origins are checked every HealthCheckInterval (0 disables) by up to HealthCheckConcurrency requests at a time.
+	// Requests to the same host are sent one by one with HealthCheckHostDelay.
+	// A link is broken after HealthCheckFailures failures in a row, and BrokenLinkAction (redirect,fallback,page) is taken.
+	HealthCheckInterval    time.Duration `yaml:"HealthCheckInterval"`
+	HealthCheckConcurrency int           `yaml:"HealthCheckConcurrency"`
+	HealthCheckHostDelay   time.Duration `yaml:"HealthCheckHostDelay"`
+	HealthCheckTimeout     time.Duration `yaml:"HealthCheckTimeout"`
+	HealthCheckFailures    int           `yaml:"HealthCheckFailures"`
+	BrokenLinkAction       string        `yaml:"BrokenLinkAction"`
+	// batch API accepts up to BatchMaxURLs URLs in a request, and validates BatchConcurrency of them at a time.
+	BatchMaxURLs     int `yaml:"BatchMaxURLs"`
+	BatchConcurrency int `yaml:"BatchConcurrency"`
+	// MaxBodySize is the maximum size of request bodies in bytes. Larger requests get 413. Import is not limited.
+	MaxBodySize int64 `yaml:"MaxBodySize"`
+	// Domains are hosts served by this instance, each having its own links. Requests to other hosts are rejected.
+	// Without Domains, all hosts are served and share links.
+	Domains []*Domain `yaml:"Domains"`
+	// DefaultDomain is the host of Domains which links created before Domains is set are moved to on start.
+	// It is also the domain of admin API and import without domain. The first domain is used without it.
+	DefaultDomain string `yaml:"DefaultDomain"`
+	// PublicBaseURL is the URL tiny paths are appended to (e.g. "https://example.com/s"). All paths are served under its path.
+	// Without it, tiny URLs are built from Protocol and the Host header. With Domains, its host is replaced by the domain.
+	PublicBaseURL string `yaml:"PublicBaseURL"`
+	// X-Forwarded-Proto and X-Forwarded-Host are used only from TrustedProxies (IP addresses or CIDRs).
+	TrustedProxies []string `yaml:"TrustedProxies"`
+	// trustedProxies are TrustedProxies parsed by NewConfig, so that they are not parsed for every request.
+	trustedProxies []*net.IPNet
+	// users stay logged in for SessionTTL. AllowSignup lets anyone create an account by "POST /signup".
+	SessionTTL  time.Duration `yaml:"SessionTTL"`
+	AllowSignup bool          `yaml:"AllowSignup"`
+	// OIDC lets users log in by the OpenID Connect provider (e.g. company SSO). It is disabled if nil.
+	OIDC *OIDCConfig `yaml:"OIDC"`
 }
 
 func NewConfig(fileName string) (*Config, error) {
@@ -60,6 +159,35 @@ func NewConfig(fileName string) (*Config, error) {
 	if cfg.DBFileName == "" {
 		cfg.DBFileName = DEFAULT_DB_FILE_NAME
 	}
+	if cfg.DBJournalMode == "" {
+		cfg.DBJournalMode = DEFAULT_DB_JOURNAL_MODE
+	} else {
+		cfg.DBJournalMode = strings.ToLower(cfg.DBJournalMode)
+		if _, is := DB_JOURNAL_MODE[cfg.DBJournalMode]; !is {
+			return nil, errors.New(fmt.Sprintf("DB journal mode '%s' is invalid (valid: delete,truncate,persist,memory,wal,off)\n", cfg.DBJournalMode))
+		}
+	}
+	if cfg.DBSynchronous == "" {
+		cfg.DBSynchronous = DEFAULT_DB_SYNCHRONOUS
+	} else {
+		cfg.DBSynchronous = strings.ToLower(cfg.DBSynchronous)
+		if _, is := DB_SYNCHRONOUS[cfg.DBSynchronous]; !is {
+			return nil, errors.New(fmt.Sprintf("DB synchronous '%s' is invalid (valid: off,normal,full,extra)\n", cfg.DBSynchronous))
+		}
+	}
+	if cfg.DBBusyTimeout == 0 {
+		cfg.DBBusyTimeout = DEFAULT_DB_BUSY_TIMEOUT
+	} else if cfg.DBBusyTimeout < 0 {
+		return nil, errors.New(fmt.Sprintf("DB busy timeout '%v' is invalid (valid: positive duration)\n", cfg.DBBusyTimeout))
+	}
+	if cfg.DBMaxOpenConns < 0 {
+		return nil, errors.New(fmt.Sprintf("DB max open conns '%d' is invalid (valid: 0 or positive number)\n", cfg.DBMaxOpenConns))
+	}
+	if cfg.DBMaxIdleConns == 0 {
+		cfg.DBMaxIdleConns = DEFAULT_DB_MAX_IDLE_CONNS
+	} else if cfg.DBMaxIdleConns < 0 {
+		return nil, errors.New(fmt.Sprintf("DB max idle conns '%d' is invalid (valid: positive number)\n", cfg.DBMaxIdleConns))
+	}
 	if cfg.LogFileName == "" {
 		cfg.LogFileName = DEFAULT_LOG_FILE_NAME
 	}
@@ -67,7 +195,7 @@ func NewConfig(fileName string) (*Config, error) {
 		cfg.LogOutputMode = DEFAULT_LOG_OUTPUT_MODE
 	} else {
 		if _, is := OUTPUT_MODE[cfg.LogOutputMode]; !is {
-			return nil, errors.New(fmt.Sprintf("Log output mode '%d' is invalid (valid: 0-2)\n", cfg.LogOutputMode))
+			return nil, errors.New(fmt.Sprintf("Log output mode '%s' is invalid (valid: stderr,file,both)\n", cfg.LogOutputMode))
 		}
 	}
 	if cfg.LogLevel == "" {
@@ -87,17 +215,243 @@ func NewConfig(fileName string) (*Config, error) {
 			return nil, errors.New(fmt.Sprintf("Protocol '%s' is invalid (valid: http,https)\n", cfg.Protocol))
 		}
 	}
+	if cfg.DefaultRedirectCode == 0 {
+		cfg.DefaultRedirectCode = DEFAULT_REDIRECT_CODE
+	} else if !IsValidRedirectCode(cfg.DefaultRedirectCode) {
+		return nil, errors.New(fmt.Sprintf("Default redirect code '%d' is invalid (valid: 301,302,307,308)\n", cfg.DefaultRedirectCode))
+	}
+	if cfg.PasswordMaxAttempts == 0 {
+		cfg.PasswordMaxAttempts = DEFAULT_PASSWORD_MAX_ATTEMPTS
+	} else if cfg.PasswordMaxAttempts < 0 {
+		return nil, errors.New(fmt.Sprintf("Password max attempts '%d' is invalid (valid: positive number)\n", cfg.PasswordMaxAttempts))
+	}
+	if cfg.PasswordLockDuration == 0 {
+		cfg.PasswordLockDuration = DEFAULT_PASSWORD_LOCK_DURATION
+	} else if cfg.PasswordLockDuration < 0 {
+		return nil, errors.New(fmt.Sprintf("Password lock duration '%v' is invalid (valid: positive duration)\n", cfg.PasswordLockDuration))
+	}
+	if cfg.CacheSize == 0 {
+		cfg.CacheSize = DEFAULT_CACHE_SIZE
+	}
+	if cfg.CacheTTL == 0 {
+		cfg.CacheTTL = DEFAULT_CACHE_TTL
+	} else if cfg.CacheTTL < 0 {
+		return nil, errors.New(fmt.Sprintf("Cache TTL '%v' is invalid (valid: positive duration)\n", cfg.CacheTTL))
+	}
+	if cfg.CacheNegativeSize == 0 {
+		cfg.CacheNegativeSize = DEFAULT_CACHE_NEGATIVE_SIZE
+	} else if cfg.CacheNegativeSize < 0 {
+		return nil, errors.New(fmt.Sprintf("Cache negative size '%d' is invalid (valid: positive number)\n", cfg.CacheNegativeSize))
+	}
+	if cfg.CacheNegativeTTL == 0 {
+		cfg.CacheNegativeTTL = DEFAULT_CACHE_NEGATIVE_TTL
+	} else if cfg.CacheNegativeTTL < 0 {
+		return nil, errors.New(fmt.Sprintf("Cache negative TTL '%v' is invalid (valid: positive duration)\n", cfg.CacheNegativeTTL))
+	}
+	if cfg.ClickFlushInterval == 0 {
+		cfg.ClickFlushInterval = DEFAULT_CLICK_FLUSH_INTERVAL
+	} else if cfg.ClickFlushInterval < 0 {
+		return nil, errors.New(fmt.Sprintf("Click flush interval '%v' is invalid (valid: positive duration)\n", cfg.ClickFlushInterval))
+	}
+	if cfg.BackupDir == "" {
+		cfg.BackupDir = DEFAULT_BACKUP_DIR
+	}
+	if cfg.BackupInterval < 0 {
+		return nil, errors.New(fmt.Sprintf("Backup interval '%v' is invalid (valid: 0 or positive duration)\n", cfg.BackupInterval))
+	}
+	if cfg.BackupRetention == 0 {
+		cfg.BackupRetention = DEFAULT_BACKUP_RETENTION
+	} else if cfg.BackupRetention < 0 {
+		return nil, errors.New(fmt.Sprintf("Backup retention '%d' is invalid (valid: positive number)\n", cfg.BackupRetention))
+	}
+	for name, key := range cfg.APIKeys {
+		if key == "" {
+			return nil, errors.New(fmt.Sprintf("API key '%s' is empty\n", name))
+		}
+	}
+	webhookNames := map[string]bool{}
+	for i, hook := range cfg.Webhooks {
+		if hook == nil || !validTiny.MatchString(hook.Name) || webhookNames[hook.Name] {
+			return nil, errors.New(fmt.Sprintf("Name of webhook %d is invalid or duplicated (valid: alphanumeric, '-' and '_')\n", i))
+		}
+		webhookNames[hook.Name] = true
+		if _, err := normalizeOrigin(hook.URL); err != nil {
+			return nil, errors.New(fmt.Sprintf("URL of webhook '%s' is invalid: %v\n", hook.Name, err))
+		}
+		if hook.Secret == "" {
+			return nil, errors.New(fmt.Sprintf("Secret of webhook '%s' is empty\n", hook.Name))
+		}
+		for _, event := range hook.Events {
+			if !WEBHOOK_EVENTS[event] {
+				return nil, errors.New(fmt.Sprintf("Event '%s' of webhook '%s' is invalid (valid: link.created,link.updated,link.deleted,link.clicked)\n", event, hook.Name))
+			}
+		}
+	}
+	if cfg.WebhookMaxAttempts == 0 {
+		cfg.WebhookMaxAttempts = DEFAULT_WEBHOOK_MAX_ATTEMPTS
+	} else if cfg.WebhookMaxAttempts < 0 {
+		return nil, errors.New(fmt.Sprintf("Webhook max attempts '%d' is invalid (valid: positive number)\n", cfg.WebhookMaxAttempts))
+	}
+	if cfg.WebhookRetryBackoff == 0 {
+		cfg.WebhookRetryBackoff = DEFAULT_WEBHOOK_RETRY_BACKOFF
+	} else if cfg.WebhookRetryBackoff < 0 {
+		return nil, errors.New(fmt.Sprintf("Webhook retry backoff '%v' is invalid (valid: positive duration)\n", cfg.WebhookRetryBackoff))
+	}
+	if cfg.WebhookTimeout == 0 {
+		cfg.WebhookTimeout = DEFAULT_WEBHOOK_TIMEOUT
+	} else if cfg.WebhookTimeout < 0 {
+		return nil, errors.New(fmt.Sprintf("Webhook timeout '%v' is invalid (valid: positive duration)\n", cfg.WebhookTimeout))
+	}
+	if cfg.WebhookPollInterval == 0 {
+		cfg.WebhookPollInterval = DEFAULT_WEBHOOK_POLL_INTERVAL
+	} else if cfg.WebhookPollInterval < 0 {
+		return nil, errors.New(fmt.Sprintf("Webhook poll interval '%v' is invalid (valid: positive duration)\n", cfg.WebhookPollInterval))
+	}
+	if cfg.HealthCheckInterval < 0 {
+		return nil, errors.New(fmt.Sprintf("Health check interval '%v' is invalid (valid: 0 or positive duration)\n", cfg.HealthCheckInterval))
+	}
+	if cfg.HealthCheckConcurrency == 0 {
+		cfg.HealthCheckConcurrency = DEFAULT_HEALTH_CHECK_CONCURRENCY
+	} else if cfg.HealthCheckConcurrency < 0 {
+		return nil, errors.New(fmt.Sprintf("Health check concurrency '%d' is invalid (valid: positive number)\n", cfg.HealthCheckConcurrency))
+	}
+	if cfg.HealthCheckHostDelay == 0 {
+		cfg.HealthCheckHostDelay = DEFAULT_HEALTH_CHECK_HOST_DELAY
+	} else if cfg.HealthCheckHostDelay < 0 {
+		return nil, errors.New(fmt.Sprintf("Health check host delay '%v' is invalid (valid: positive duration)\n", cfg.HealthCheckHostDelay))
+	}
+	if cfg.HealthCheckTimeout == 0 {
+		cfg.HealthCheckTimeout = DEFAULT_HEALTH_CHECK_TIMEOUT
+	} else if cfg.HealthCheckTimeout < 0 {
+		return nil, errors.New(fmt.Sprintf("Health check timeout '%v' is invalid (valid: positive duration)\n", cfg.HealthCheckTimeout))
+	}
+	if cfg.HealthCheckFailures == 0 {
+		cfg.HealthCheckFailures = DEFAULT_HEALTH_CHECK_FAILURES
+	} else if cfg.HealthCheckFailures < 0 {
+		return nil, errors.New(fmt.Sprintf("Health check failures '%d' is invalid (valid: positive number)\n", cfg.HealthCheckFailures))
+	}
+	if cfg.BrokenLinkAction == "" {
+		cfg.BrokenLinkAction = DEFAULT_BROKEN_LINK_ACTION
+	} else if !BROKEN_LINK_ACTIONS[cfg.BrokenLinkAction] {
+		return nil, errors.New(fmt.Sprintf("Broken link action '%s' is invalid (valid: redirect,fallback,page)\n", cfg.BrokenLinkAction))
+	}
+	if cfg.BatchMaxURLs == 0 {
+		cfg.BatchMaxURLs = DEFAULT_BATCH_MAX_URLS
+	} else if cfg.BatchMaxURLs < 0 {
+		return nil, errors.New(fmt.Sprintf("Batch max URLs '%d' is invalid (valid: positive number)\n", cfg.BatchMaxURLs))
+	}
+	if cfg.BatchConcurrency == 0 {
+		cfg.BatchConcurrency = DEFAULT_BATCH_CONCURRENCY
+	} else if cfg.BatchConcurrency < 0 {
+		return nil, errors.New(fmt.Sprintf("Batch concurrency '%d' is invalid (valid: positive number)\n", cfg.BatchConcurrency))
+	}
+	if cfg.MaxBodySize == 0 {
+		cfg.MaxBodySize = DEFAULT_MAX_BODY_SIZE
+	} else if cfg.MaxBodySize < 0 {
+		return nil, errors.New(fmt.Sprintf("Max body size '%d' is invalid (valid: positive number)\n", cfg.MaxBodySize))
+	}
+	if cfg.SessionTTL == 0 {
+		cfg.SessionTTL = DEFAULT_SESSION_TTL
+	} else if cfg.SessionTTL < 0 {
+		return nil, errors.New(fmt.Sprintf("Session TTL '%v' is invalid (valid: positive duration)\n", cfg.SessionTTL))
+	}
+	if cfg.OIDC != nil {
+		if invalid := cfg.OIDC.normalize(); invalid != nil {
+			return nil, errors.New(fmt.Sprintf("OIDC config is invalid: %v\n", invalid))
+		}
+	}
+	if cfg.PublicBaseURL != "" {
+		publicBaseURL, invalid := normalizePublicBaseURL(cfg.PublicBaseURL)
+		if invalid != nil {
+			return nil, errors.New(fmt.Sprintf("Public base URL '%s' is invalid: %v\n", cfg.PublicBaseURL, invalid))
+		}
+		cfg.PublicBaseURL = publicBaseURL
+	}
+	proxies, perr := parseTrustedProxies(cfg.TrustedProxies)
+	if perr != nil {
+		return nil, perr
+	}
+	cfg.trustedProxies = proxies
+	hosts := map[string]bool{}
+	for i, d := range cfg.Domains {
+		if d == nil {
+			return nil, errors.New(fmt.Sprintf("Domain %d is empty\n", i))
+		}
+		d.Host = strings.ToLower(d.Host)
+		if !validDomain.MatchString(d.Host) {
+			return nil, errors.New(fmt.Sprintf("Domain host '%s' is invalid (valid: host name without port)\n", d.Host))
+		}
+		if hosts[d.Host] {
+			return nil, errors.New(fmt.Sprintf("Domain host '%s' is duplicated\n", d.Host))
+		}
+		hosts[d.Host] = true
+		if d.Protocol != "" && !(d.Protocol == "http" || d.Protocol == "https") {
+			return nil, errors.New(fmt.Sprintf("Protocol '%s' of domain '%s' is invalid (valid: http,https)\n", d.Protocol, d.Host))
+		}
+		if d.TinyLength != 0 && (d.TinyLength < MIN_TINY_LENGTH || d.TinyLength > MAX_TINY_LENGTH) {
+			return nil, errors.New(fmt.Sprintf("Tiny length '%d' of domain '%s' is invalid (valid: %d-%d)\n", d.TinyLength, d.Host, MIN_TINY_LENGTH, MAX_TINY_LENGTH))
+		}
+		if d.DefaultRedirectCode != 0 && !IsValidRedirectCode(d.DefaultRedirectCode) {
+			return nil, errors.New(fmt.Sprintf("Default redirect code '%d' of domain '%s' is invalid (valid: 301,302,307,308)\n", d.DefaultRedirectCode, d.Host))
+		}
+		if d.FallbackURL != "" {
+			fallbackURL, invalid := normalizeOrigin(d.FallbackURL)
+			if invalid != nil {
+				return nil, errors.New(fmt.Sprintf("Fallback URL of domain '%s' is invalid: %v\n", d.Host, invalid))
+			}
+			d.FallbackURL = fallbackURL
+		}
+	}
+	if cfg.DefaultDomain != "" {
+		cfg.DefaultDomain = strings.ToLower(cfg.DefaultDomain)
+		if !hosts[cfg.DefaultDomain] {
+			return nil, errors.New(fmt.Sprintf("Default domain '%s' is not in Domains\n", cfg.DefaultDomain))
+		}
+	}
+	for name, params := range cfg.UTMTemplates {
+		if err := validateUTMTemplate(name, params); err != nil {
+			return nil, err
+		}
+	}
 
 	return &cfg, err
 }
 
 func createDefaultConfig() *Config {
 	return &Config{
-		DBFileName:    DEFAULT_DB_FILE_NAME,
-		LogFileName:   DEFAULT_LOG_FILE_NAME,
-		LogOutputMode: DEFAULT_LOG_OUTPUT_MODE,
-		LogLevel:      DEFAULT_LOG_LEVEL,
-		HTTPPort:      DEFAULT_HTTP_PORT,
-		Protocol:      DEFAULT_PROTOCOL,
+		DBFileName:           DEFAULT_DB_FILE_NAME,
+		DBJournalMode:        DEFAULT_DB_JOURNAL_MODE,
+		DBSynchronous:        DEFAULT_DB_SYNCHRONOUS,
+		DBBusyTimeout:        DEFAULT_DB_BUSY_TIMEOUT,
+		DBMaxIdleConns:       DEFAULT_DB_MAX_IDLE_CONNS,
+		LogFileName:          DEFAULT_LOG_FILE_NAME,
+		LogOutputMode:        DEFAULT_LOG_OUTPUT_MODE,
+		LogLevel:             DEFAULT_LOG_LEVEL,
+		HTTPPort:             DEFAULT_HTTP_PORT,
+		Protocol:             DEFAULT_PROTOCOL,
+		DefaultRedirectCode:  DEFAULT_REDIRECT_CODE,
+		PasswordMaxAttempts:  DEFAULT_PASSWORD_MAX_ATTEMPTS,
+		PasswordLockDuration: DEFAULT_PASSWORD_LOCK_DURATION,
+		CacheSize:            DEFAULT_CACHE_SIZE,
+		CacheTTL:             DEFAULT_CACHE_TTL,
+		CacheNegativeSize:    DEFAULT_CACHE_NEGATIVE_SIZE,
+		CacheNegativeTTL:     DEFAULT_CACHE_NEGATIVE_TTL,
+		ClickFlushInterval:   DEFAULT_CLICK_FLUSH_INTERVAL,
+		BackupDir:            DEFAULT_BACKUP_DIR,
+		BackupRetention:      DEFAULT_BACKUP_RETENTION,
+		WebhookMaxAttempts:   DEFAULT_WEBHOOK_MAX_ATTEMPTS,
+		WebhookRetryBackoff:  DEFAULT_WEBHOOK_RETRY_BACKOFF,
+		WebhookTimeout:       DEFAULT_WEBHOOK_TIMEOUT,
+		WebhookPollInterval:  DEFAULT_WEBHOOK_POLL_INTERVAL,
+
+		HealthCheckConcurrency: DEFAULT_HEALTH_CHECK_CONCURRENCY,
+		HealthCheckHostDelay:   DEFAULT_HEALTH_CHECK_HOST_DELAY,
+		HealthCheckTimeout:     DEFAULT_HEALTH_CHECK_TIMEOUT,
+		HealthCheckFailures:    DEFAULT_HEALTH_CHECK_FAILURES,
+		BrokenLinkAction:       DEFAULT_BROKEN_LINK_ACTION,
+		BatchMaxURLs:           DEFAULT_BATCH_MAX_URLS,
+		BatchConcurrency:       DEFAULT_BATCH_CONCURRENCY,
+		MaxBodySize:            DEFAULT_MAX_BODY_SIZE,
+		SessionTTL:             DEFAULT_SESSION_TTL,
 	}
 }
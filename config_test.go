@@ -16,8 +16,8 @@ func createConfigFileForTest(t *testing.T, cfg *Config) (string, error) {
 	if cfg.LogFileName != "" {
 		strCfg += fmt.Sprintf("LogFileName: %s\n", cfg.LogFileName)
 	}
-	if cfg.LogOutputMode != 0 {
-		strCfg += fmt.Sprintf("LogOutputMode: %d\n", cfg.LogOutputMode)
+	if cfg.LogOutputMode != "" {
+		strCfg += fmt.Sprintf("LogOutputMode: %s\n", cfg.LogOutputMode)
 	}
 	if cfg.LogLevel != "" {
 		strCfg += fmt.Sprintf("LogLevel: %s\n", cfg.LogLevel)
@@ -51,7 +51,7 @@ func TestNoConfigFile(t *testing.T) {
 func TestSetPartOfConfig(t *testing.T) {
 	// custom config file is created.
 	dbFileName := "/opt/tinyurl/customdb.db"
-	logOutputMode := 2
+	logOutputMode := "both"
 	cfg := &Config{
 		DBFileName:    dbFileName,
 		LogOutputMode: logOutputMode,
@@ -76,3 +76,18 @@ func TestSetPartOfConfig(t *testing.T) {
 
 	checkParam(t, createdCfg, expectedCfg)
 }
+
+func TestInvalidYAMLConfig(t *testing.T) {
+	fileName, err := MakeRandomStr(20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileName = fileName + ".yaml"
+	defer os.Remove(fileName)
+	if err = ioutil.WriteFile(fileName, []byte("DBFileName: [unclosed\n"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewConfig(fileName); err == nil {
+		t.Fatal("config file which is not yaml is expected to be an error")
+	}
+}
@@ -3,12 +3,27 @@ package main
 import (
 	"database/sql"
 	"errors"
-	_ "github.com/mattn/go-sqlite3"
+	"fmt"
+	"github.com/mattn/go-sqlite3"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type DB struct {
 	*sql.DB
+	// cache is nil if redirect cache is disabled.
+	cache *RedirectCache
+	// webhooks subscribe events of links, which are delivered by the dispatcher woken by webhookWake.
+	webhooks    []*Webhook
+	webhookWake chan struct{}
+	// clicks are counted in memory and written by FlushClicks.
+	clicks *ClickCounter
+	utm    utmTemplates
+	// defaultDomain is Link.Domain of imported links without domain.
+	defaultDomain string
 }
 
 const SQL_CREATE_URLS = `
@@ -18,7 +33,281 @@ const SQL_CREATE_URLS = `
 	);
 `
 
-func ConnectDB(dbFileName string) (*DB, error) {
+const SQL_ADD_URLS_CREATED_AT = `
+	alter table urls add column created_at datetime;
+`
+
+// SQL_REBUILD_URLS_WITH_ID drops "origin unique" of urls, so that an origin can have links with different settings
+// (e.g. redirect codes). Links of the same origin and settings are still shared by reusableTiny.
+const SQL_REBUILD_URLS_WITH_ID = `
+	create table urls_new (
+		id integer primary key autoincrement,
+		tiny text not null unique,
+		origin text not null,
+		created_at datetime,
+		redirect_code integer not null default 0
+	);
+	insert into urls_new(tiny, origin, created_at) select tiny, origin, created_at from urls order by rowid;
+	drop table urls;
+	alter table urls_new rename to urls;
+	create index urls_origin on urls(origin);
+`
+
+const SQL_ADD_URLS_CLICKS = `
+	alter table urls add column clicks integer not null default 0;
+`
+
+const SQL_ADD_URLS_PASSWORD_HASH = `
+	alter table urls add column password_hash text not null default '';
+`
+
+const SQL_ADD_URLS_REMAINING_CLICKS = `
+	alter table urls add column remaining_clicks integer;
+`
+
+const SQL_ADD_URLS_FORWARD = `
+	alter table urls add column forward_query integer not null default 0;
+	alter table urls add column forward_path integer not null default 0;
+`
+
+const SQL_ADD_URLS_UTM_TEMPLATE = `
+	alter table urls add column utm_template text not null default '';
+`
+
+const SQL_ADD_URLS_HEALTH = `
+	alter table urls add column fallback_url text not null default '';
+	alter table urls add column last_status integer not null default 0;
+	alter table urls add column last_checked_at datetime;
+	alter table urls add column check_failures integer not null default 0;
+	alter table urls add column broken integer not null default 0;
+`
+
+// SQL_REBUILD_URLS_WITH_DOMAIN makes tiny unique per domain. Existing links keep their id and have empty domain.
+const SQL_REBUILD_URLS_WITH_DOMAIN = `
+	create table urls_new (
+		id integer primary key autoincrement,
+		domain text not null default '',
+		tiny text not null,
+		origin text not null,
+		created_at datetime,
+		redirect_code integer not null default 0,
+		clicks integer not null default 0,
+		password_hash text not null default '',
+		remaining_clicks integer,
+		forward_query integer not null default 0,
+		forward_path integer not null default 0,
+		utm_template text not null default '',
+		fallback_url text not null default '',
+		last_status integer not null default 0,
+		last_checked_at datetime,
+		check_failures integer not null default 0,
+		broken integer not null default 0,
+		title text not null default '',
+		description text not null default '',
+		image text not null default '',
+		site_name text not null default '',
+		unique(domain, tiny)
+	);
+	insert into urls_new(id, tiny, origin, created_at, redirect_code, clicks, password_hash, remaining_clicks, forward_query, forward_path,
+		utm_template, fallback_url, last_status, last_checked_at, check_failures, broken, title, description, image, site_name)
+	select id, tiny, origin, created_at, redirect_code, clicks, password_hash, remaining_clicks, forward_query, forward_path,
+		utm_template, fallback_url, last_status, last_checked_at, check_failures, broken, title, description, image, site_name from urls order by id;
+	drop table urls;
+	alter table urls_new rename to urls;
+	create index urls_origin on urls(origin);
+`
+
+type Link struct {
+	ID int64 `json:"-"`
+	// Domain is the host the link is served on. It is empty for the first of Config.Domains.
+	Domain    string    `json:"Domain,omitempty"`
+	Tiny      string    `json:"Tiny"`
+	Origin    string    `json:"Origin"`
+	CreatedAt time.Time `json:"CreatedAt"`
+	// RedirectCode is HTTP status of the redirect. 0 means Config.DefaultRedirectCode.
+	RedirectCode int `json:"RedirectCode"`
+	// PasswordHash is bcrypt hash of the password required to follow the link. Empty means no password.
+	// It is never returned by API or recorded in audit logs, but is exported so that links can be imported.
+	PasswordHash string `json:"-"`
+	// RemainingClicks is the number of redirects left. nil means unlimited.
+	// Links without remaining clicks are gone.
+	RemainingClicks *int64 `json:"RemainingClicks,omitempty"`
+	// ForwardQuery merges the query string of the request into the origin.
+	ForwardQuery bool `json:"ForwardQuery,omitempty"`
+	// ForwardPath appends the path after the tiny ("/{tiny}/sub/path") to the origin.
+	ForwardPath bool `json:"ForwardPath,omitempty"`
+	// UTMTemplate is the name of UTM template in config applied to the origin on redirect.
+	UTMTemplate string `json:"UTMTemplate,omitempty"`
+	// FallbackURL is used instead of the origin while the origin is broken, if BrokenLinkAction is "fallback".
+	FallbackURL string `json:"FallbackURL,omitempty"`
+	// OwnerID is ID of the user who created the link. 0 means the link was created without login.
+	OwnerID int64 `json:"OwnerID,omitempty"`
+	// Metadata is the title, description and Open Graph tags of the origin fetched on creation and when the origin is changed.
+	Metadata *LinkMetadata `json:"Metadata,omitempty"`
+	// Targets are targeting rules evaluated in order on redirect.
+	Targets []*LinkTarget `json:"Targets,omitempty"`
+	// Variants split visitors not matching targets among weighted origins.
+	Variants []*LinkVariant `json:"Variants,omitempty"`
+	// Schedule changes the origin over time.
+	Schedule []*ScheduleEntry `json:"Schedule,omitempty"`
+	// Clicks is the number of redirects. It is updated only by CountClick, and clicks not flushed yet are not included.
+	Clicks int64 `json:"Clicks"`
+	// results of the health check of the origin. They are updated only by the health checker.
+	// LastStatus is 0 if the origin didn't respond.
+	LastStatus    int        `json:"LastStatus,omitempty"`
+	LastCheckedAt *time.Time `json:"LastCheckedAt,omitempty"`
+	Broken        bool       `json:"Broken,omitempty"`
+}
+
+// linkColumns are columns of urls table read by scanLink and written by insertLinkTx and updateLinkTx.
+// The order must be the same as Link.values().
+var linkColumns = []string{"domain", "tiny", "origin", "created_at", "redirect_code", "password_hash", "remaining_clicks", "forward_query", "forward_path", "utm_template", "fallback_url",
+	"title", "description", "image", "site_name", "owner_id"}
+
+// selectLinkColumns are columns read by scanLink. Counters are read but never written by insertLinkTx or updateLinkTx.
+var selectLinkColumns = "id, " + strings.Join(linkColumns, ", ") + ", clicks, last_status, last_checked_at, broken"
+
+func (link *Link) values() []interface{} {
+	metadata := link.Metadata
+	if metadata == nil {
+		metadata = &LinkMetadata{}
+	}
+	return []interface{}{link.Domain, link.Tiny, link.Origin, link.CreatedAt, link.RedirectCode, link.PasswordHash, link.RemainingClicks, link.ForwardQuery, link.ForwardPath, link.UTMTemplate, link.FallbackURL,
+		metadata.Title, metadata.Description, metadata.Image, metadata.SiteName, ownerValue(link.OwnerID)}
+}
+
+// ownerValue is owner_id of ownerID. Links created without login have NULL.
+func ownerValue(ownerID int64) interface{} {
+	if ownerID == 0 {
+		return nil
+	}
+	return ownerID
+}
+
+// rowScanner is implemented by *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanLink(row rowScanner) (*Link, error) {
+	var link Link
+	var createdAt sql.NullTime
+	var remainingClicks sql.NullInt64
+	var lastCheckedAt sql.NullTime
+	var metadata LinkMetadata
+	var ownerID sql.NullInt64
+	if err := row.Scan(&link.ID, &link.Domain, &link.Tiny, &link.Origin, &createdAt, &link.RedirectCode, &link.PasswordHash, &remainingClicks, &link.ForwardQuery, &link.ForwardPath, &link.UTMTemplate, &link.FallbackURL,
+		&metadata.Title, &metadata.Description, &metadata.Image, &metadata.SiteName, &ownerID, &link.Clicks, &link.LastStatus, &lastCheckedAt, &link.Broken); err != nil {
+		return nil, err
+	}
+	link.CreatedAt = createdAt.Time
+	link.OwnerID = ownerID.Int64
+	if remainingClicks.Valid {
+		link.RemainingClicks = &remainingClicks.Int64
+	}
+	if lastCheckedAt.Valid {
+		link.LastCheckedAt = &lastCheckedAt.Time
+	}
+	if !metadata.isEmpty() {
+		link.Metadata = &metadata
+	}
+	return &link, nil
+}
+
+// getLinkTx returns the link matched with cond in tx, or nil if it is not found.
+func getLinkTx(tx *sql.Tx, cond string, args ...interface{}) (*Link, error) {
+	link, err := scanLink(tx.QueryRow("SELECT "+selectLinkColumns+" FROM urls WHERE "+cond, args...))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return link, err
+}
+
+// insertLinkTx inserts link and sets its ID.
+func insertLinkTx(tx *sql.Tx, link *Link) error {
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(linkColumns)), ", ")
+	result, err := tx.Exec("INSERT INTO urls("+strings.Join(linkColumns, ", ")+") VALUES("+placeholders+")", link.values()...)
+	if err != nil {
+		return err
+	}
+	link.ID, err = result.LastInsertId()
+	return err
+}
+
+// updateLinkTx overwrites all columns of the link having link.ID.
+func updateLinkTx(tx *sql.Tx, link *Link) error {
+	set := strings.Join(linkColumns, " = ?, ") + " = ?"
+	_, err := tx.Exec("UPDATE urls SET "+set+" WHERE id = ?", append(link.values(), link.ID)...)
+	return err
+}
+
+// migrations are applied in order to bring an existing database up to date.
+// The number of applied migrations is kept in "PRAGMA user_version".
+var migrations = []string{
+	SQL_CREATE_AUDIT_LOGS,
+	SQL_ADD_URLS_CREATED_AT,
+	SQL_REBUILD_URLS_WITH_ID,
+	SQL_ADD_URLS_CLICKS,
+	SQL_ADD_URLS_PASSWORD_HASH,
+	SQL_ADD_URLS_REMAINING_CLICKS,
+	SQL_ADD_URLS_FORWARD,
+	SQL_ADD_URLS_UTM_TEMPLATE,
+	SQL_CREATE_LINK_TARGETS,
+	SQL_CREATE_LINK_VARIANTS,
+	SQL_CREATE_LINK_SCHEDULE,
+	SQL_CREATE_WEBHOOK_OUTBOX,
+	SQL_ADD_URLS_HEALTH,
+	SQL_ADD_URLS_METADATA,
+	SQL_REBUILD_URLS_WITH_DOMAIN,
+	SQL_CREATE_USERS,
+	SQL_ADD_USERS_OIDC_SUBJECT,
+	SQL_CREATE_UTM_TEMPLATES,
+	SQL_ADD_AUDIT_LOGS_DOMAIN,
+}
+
+var DB_JOURNAL_MODE = map[string]string{
+	"delete":   "DELETE",
+	"truncate": "TRUNCATE",
+	"persist":  "PERSIST",
+	"memory":   "MEMORY",
+	"wal":      "WAL",
+	"off":      "OFF",
+}
+
+var DB_SYNCHRONOUS = map[string]string{
+	"off":    "OFF",
+	"normal": "NORMAL",
+	"full":   "FULL",
+	"extra":  "EXTRA",
+}
+
+// dataSourceName returns sqlite3 DSN applying cfg to every connection of the pool.
+// Transactions begin with "BEGIN IMMEDIATE" so that writers wait for the busy timeout instead of failing with "database is locked".
+func dataSourceName(cfg *Config) string {
+	params := url.Values{}
+	params.Set("_journal_mode", DB_JOURNAL_MODE[cfg.DBJournalMode])
+	params.Set("_synchronous", DB_SYNCHRONOUS[cfg.DBSynchronous])
+	params.Set("_busy_timeout", strconv.FormatInt(cfg.DBBusyTimeout.Milliseconds(), 10))
+	params.Set("_txlock", "immediate")
+	return sqliteURI(cfg.DBFileName, params)
+}
+
+// sqliteURI returns URI of fileName with params. Each segment of the path is escaped,
+// so that "?", "#" and "%" in file names are not taken as the query, the fragment or escapes.
+func sqliteURI(fileName string, params url.Values) string {
+	segments := strings.Split(fileName, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	uri := "file:" + strings.Join(segments, "/")
+	if len(params) > 0 {
+		uri += "?" + params.Encode()
+	}
+	return uri
+}
+
+func ConnectDB(cfg *Config) (*DB, error) {
+	dbFileName := cfg.DBFileName
 	// If specified database file is not found, new database file is created.
 	if _, err := os.Stat(dbFileName); err != nil {
 		Warnf("Specified database file \"%s\" was not found. So new database (.db file) will be created.\n", dbFileName)
@@ -28,14 +317,112 @@ func ConnectDB(dbFileName string) (*DB, error) {
 		}
 	}
 
-	_db, err := sql.Open("sqlite3", dbFileName)
+	_db, err := sql.Open("sqlite3", dataSourceName(cfg))
+	if err != nil {
+		return nil, err
+	}
+	_db.SetMaxOpenConns(cfg.DBMaxOpenConns)
+	_db.SetMaxIdleConns(cfg.DBMaxIdleConns)
 	var db DB
 	db.DB = _db
-	return &db, err
+	if cfg.CacheSize > 0 {
+		db.cache = NewRedirectCache(cfg.CacheSize, cfg.CacheTTL, cfg.CacheNegativeSize, cfg.CacheNegativeTTL)
+	}
+	db.webhooks = cfg.Webhooks
+	db.webhookWake = make(chan struct{}, 1)
+	db.clicks = NewClickCounter()
+	db.defaultDomain = cfg.defaultDomain()
+	if err = db.migrate(); err != nil {
+		Errorf("DatabaseError: Migrating database \"%s\" was failed. Error: %v\n", dbFileName, err)
+		db.Close()
+		return nil, err
+	}
+	if err = db.moveLegacyLinks(cfg); err != nil {
+		Errorf("DatabaseError: %v\n", err)
+		db.Close()
+		return nil, err
+	}
+	if err = db.loadUTMTemplates(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &db, nil
+}
+
+// Close writes counted clicks and closes the database.
+func (db *DB) Close() error {
+	if db.clicks != nil {
+		if err := db.FlushClicks(); err != nil {
+			Errorf("ClickFlushError: %v\n", err)
+		}
+	}
+	return db.DB.Close()
+}
+
+// moveLegacyLinks moves links created before Domains is set, which have empty domain, to DefaultDomain.
+// Without DefaultDomain, they would be served by no domain, so it must be set explicitly.
+func (db *DB) moveLegacyLinks(cfg *Config) error {
+	if len(cfg.Domains) == 0 {
+		return nil
+	}
+	var n int
+	if err := db.QueryRow("SELECT count(*) FROM urls WHERE domain = ''").Scan(&n); err != nil {
+		return err
+	}
+	if n == 0 {
+		return nil
+	}
+	if cfg.DefaultDomain == "" {
+		return errors.New(fmt.Sprintf("%d links are created before Domains is set. DefaultDomain must be set to the domain they belong to", n))
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec("UPDATE urls SET domain = ? WHERE domain = ''", cfg.DefaultDomain); err != nil {
+		tx.Rollback()
+		return errors.New(fmt.Sprintf("Moving links to '%s' is failed (tiny may be used on both): %v", cfg.DefaultDomain, err))
+	}
+	if _, err = tx.Exec("UPDATE audit_logs SET domain = ? WHERE domain = ''", cfg.DefaultDomain); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	Infof("%d links created before Domains is set are moved to '%s'.\n", n, cfg.DefaultDomain)
+	return nil
+}
+
+func (db *DB) migrate() error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	for i := version; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err = tx.Exec(migrations[i]); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+		Infof("Database migration %d is applied.\n", i+1)
+	}
+	return nil
 }
 
 func createDatabase(fileName string) error {
-	db, err := sql.Open("sqlite3", fileName)
+	db, err := sql.Open("sqlite3", sqliteURI(fileName, nil))
 	if err != nil {
 		return err
 	}
@@ -45,28 +432,102 @@ func createDatabase(fileName string) error {
 	return err
 }
 
-func (db *DB) GetOriginURL(tiny string) (string, error) {
-	rows, err := db.Query("SELECT origin From urls where tiny = $1", tiny)
+var errLinkNotFound = errors.New("link is not found")
+
+// GetLink returns the link of tiny on domain. Links are served from the redirect cache if it is enabled,
+// so counters of the returned link may be old. Use LoadLink to get the latest counters.
+func (db *DB) GetLink(domain string, tiny string) (*Link, error) {
+	if db.cache != nil {
+		if link, ok := db.cache.Get(domain, tiny); ok {
+			if link == nil {
+				return nil, errors.New("DatabaseError: Specified tiny path \"" + tiny + "\" was not found.")
+			}
+			return link, nil
+		}
+	}
+	return db.LoadLink(domain, tiny)
+}
+
+// LoadLink reads the link of tiny on domain from the database and caches it.
+func (db *DB) LoadLink(domain string, tiny string) (*Link, error) {
+	var generation uint64
+	if db.cache != nil {
+		generation = db.cache.Generation()
+	}
+	rows, err := db.Query("SELECT "+selectLinkColumns+" FROM urls WHERE domain = $1 AND tiny = $2", domain, tiny)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer rows.Close()
 
 	if !rows.Next() {
-		return "", errors.New("DatabaseError: Specified tiny path \"" + tiny + "\" was not found.")
+		if db.cache != nil {
+			db.cache.PutMiss(domain, tiny, generation)
+		}
+		return nil, errors.New("DatabaseError: Specified tiny path \"" + tiny + "\" was not found.")
 	}
 
-	var origin string
-	if err = rows.Scan(&origin); err != nil {
+	link, err := scanLink(rows)
+	if err != nil {
 		Warnf("Select urls table query result couldn't be read. Error: \"%v\"\n", err)
+		return nil, err
+	}
+	rows.Close()
+	if link.Targets, err = getTargets(db, link.ID); err != nil {
+		return nil, err
+	}
+	if link.Variants, err = getVariants(db, link.ID); err != nil {
+		return nil, err
+	}
+	if link.Schedule, err = getSchedule(db, link.ID); err != nil {
+		return nil, err
+	}
+
+	if db.cache != nil {
+		db.cache.Put(link, generation)
+	}
+	return link, nil
+}
+
+func (db *DB) GetOriginURL(domain string, tiny string) (string, error) {
+	link, err := db.GetLink(domain, tiny)
+	if err != nil {
 		return "", err
 	}
+	return link.Origin, nil
+}
 
-	return origin, nil
+// committed must be called after links are created, updated or deleted.
+// Cached links are removed and webhook events of the changes are delivered.
+func (db *DB) committed(links ...*Link) {
+	db.invalidate(links...)
+	db.wakeWebhookDispatcher()
 }
 
-func (db *DB) GetTinyURL(origin string) (string, error) {
-	rows, err := db.Query("SELECT tiny FROM urls WHERE origin = $1", origin)
+// invalidate removes cached links.
+func (db *DB) invalidate(links ...*Link) {
+	if db.cache == nil {
+		return
+	}
+	for _, link := range links {
+		db.cache.Invalidate(link.Domain, link.Tiny)
+	}
+}
+
+// GetTinyURL returns the tiny path of a link which can be reused for link, or "" if there is no such link.
+// A link is reused only if it has the same origin and settings. Password protected or limited links,
+// and links having targets, variants or schedule (which may send visitors elsewhere) are never reused.
+func (db *DB) GetTinyURL(link *Link) (string, error) {
+	return reusableTiny(db, link)
+}
+
+func reusableTiny(q queryer, link *Link) (string, error) {
+	if link.PasswordHash != "" || link.RemainingClicks != nil || len(link.Targets) > 0 || len(link.Variants) > 0 || len(link.Schedule) > 0 {
+		return "", nil
+	}
+	rows, err := q.Query("SELECT tiny FROM urls WHERE domain = $1 AND origin = $2 AND redirect_code = $3 AND password_hash = '' AND remaining_clicks IS NULL AND forward_query = $4 AND forward_path = $5 AND utm_template = $6 AND fallback_url = $7 AND owner_id IS $8"+
+		" AND NOT EXISTS (SELECT 1 FROM link_targets WHERE link_id = urls.id) AND NOT EXISTS (SELECT 1 FROM link_variants WHERE link_id = urls.id) AND NOT EXISTS (SELECT 1 FROM link_schedule WHERE link_id = urls.id)",
+		link.Domain, link.Origin, link.RedirectCode, link.ForwardQuery, link.ForwardPath, link.UTMTemplate, link.FallbackURL, ownerValue(link.OwnerID))
 	if err != nil {
 		Warnf("Select query of urls table is failed.")
 		return "", err
@@ -85,19 +546,43 @@ func (db *DB) GetTinyURL(origin string) (string, error) {
 	return "", nil
 }
 
-func (db *DB) AddTinyURL(origin string) (string, error) {
-	tiny, err := db.GetTinyURL(origin)
+// AddTinyURL returns the tiny path of origin with default settings, creating a new one if it is not registered yet.
+// actor is recorded in the audit log as who created the link.
+func (db *DB) AddTinyURL(origin string, actor string) (string, error) {
+	link, err := db.AddLink(&Link{Origin: origin}, actor)
 	if err != nil {
-		Warnf("GetTinyURL() is failed.")
 		return "", err
 	}
+	return link.Tiny, nil
+}
+
+// AddLink registers link with a new random tiny path of DEFAULT_TINY_LENGTH on link.Domain and returns it.
+// If a link having the same origin and settings already exists, the existing one is returned.
+func (db *DB) AddLink(link *Link, actor string) (*Link, error) {
+	tiny, err := db.GetTinyURL(link)
+	if err != nil {
+		Warnf("GetTinyURL() is failed.")
+		return nil, err
+	}
 	if tiny != "" {
-		return tiny, nil
+		return db.GetLink(link.Domain, tiny)
 	}
+	links, err := db.AddLinks([]*Link{link}, DEFAULT_TINY_LENGTH, actor)
+	if err != nil {
+		return nil, err
+	}
+	return links[0], nil
+}
+
+// TINY_ATTEMPTS is how many random tiny paths are tried for a link before giving up.
+const TINY_ATTEMPTS int = 10
 
+// AddLinks registers links with new random tiny paths of tinyLength in a single transaction like AddLink,
+// and returns them in the same order. Nothing is registered if any of them fails.
+func (db *DB) AddLinks(links []*Link, tinyLength int, actor string) ([]*Link, error) {
 	tx, err := db.Begin()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer func() {
 		if p := recover(); p != nil {
@@ -111,35 +596,159 @@ func (db *DB) AddTinyURL(origin string) (string, error) {
 		}
 	}()
 
-	tiny, err = MakeRandomStr(10)
+	added := make([]*Link, len(links))
+	var created []*Link
+	for i, link := range links {
+		var isNew bool
+		if added[i], isNew, err = db.addLinkTx(tx, link, tinyLength, actor); err != nil {
+			return nil, err
+		}
+		if isNew {
+			created = append(created, added[i])
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		Warnf("Faild to add new record to urls in commit result. Error: %v \n", err)
+		return nil, err
+	}
+	for _, link := range created {
+		// tiny may be cached as not found.
+		db.committed(link)
+		Infof("New URL is added. origin:'%s' tiny:'%s'\n", link.Origin, link.Tiny)
+	}
+	return added, nil
+}
+
+// addLinkTx adds link in tx. isNew is false if an existing link is reused.
+func (db *DB) addLinkTx(tx *sql.Tx, link *Link, tinyLength int, actor string) (added *Link, isNew bool, err error) {
+	tiny, err := reusableTiny(tx, link)
 	if err != nil {
-		Warnf("Making random string by MakeRandomStr(). This is unexpected error. Error: \"%v\"\n", err)
-		return "", err
+		Warnf("GetTinyURL() is failed.")
+		return nil, false, err
+	}
+	if tiny != "" {
+		added, err = getLinkTx(tx, "domain = ? AND tiny = ?", link.Domain, tiny)
+		return added, false, err
 	}
 
-	insert, err := tx.Prepare("INSERT INTO urls VALUES(?, ?)")
+	newLink := *link
+	newLink.CreatedAt = time.Now().UTC()
+	// random tiny may be already used on the domain, especially if tinyLength is short.
+	for attempt := 1; ; attempt++ {
+		newLink.Tiny, err = MakeRandomStr(uint32(tinyLength))
+		if err != nil {
+			Warnf("Making random string by MakeRandomStr(). This is unexpected error. Error: \"%v\"\n", err)
+			return nil, false, err
+		}
+		if err = insertLinkTx(tx, &newLink); err == nil {
+			break
+		}
+		if sqliteErr, ok := err.(sqlite3.Error); !ok || sqliteErr.ExtendedCode != sqlite3.ErrConstraintUnique || attempt >= TINY_ATTEMPTS {
+			Warnf("Faild to add new record to urls in execute query. Error: %v \n", err)
+			return nil, false, err
+		}
+		Debugf("Tiny '%s' is already used. Retrying.\n", newLink.Tiny)
+	}
+	if err = db.writeChange(tx, actor, AUDIT_CREATE, newLink.Tiny, nil, &newLink); err != nil {
+		Warnf("Faild to add audit log of new record. Error: %v \n", err)
+		return nil, false, err
+	}
+	return &newLink, true, nil
+}
+
+// UpdateLink applies update to the link of tiny on domain and saves it in a transaction with its audit log.
+func (db *DB) UpdateLink(domain string, tiny string, actor string, update func(link *Link) error) (*Link, error) {
+	tx, err := db.Begin()
 	if err != nil {
-		Warnf("Insert query of urls table is failed.")
-		tiny, _ = db.GetTinyURL(origin)
-		if tiny != "" {
-			return tiny, nil
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
 		}
-		return "", err
+	}()
+
+	before, err := getLinkTx(tx, "domain = ? AND tiny = ?", domain, tiny)
+	if err != nil {
+		return nil, err
+	}
+	if before == nil {
+		err = errLinkNotFound
+		return nil, err
+	}
+	after := *before
+	if err = update(&after); err != nil {
+		return nil, err
+	}
+	after.ID = before.ID
+	after.Domain = before.Domain
+	after.Tiny = before.Tiny
+	if err = updateLinkTx(tx, &after); err != nil {
+		return nil, err
+	}
+	if after.Origin != before.Origin {
+		if err = resetHealthTx(tx, &after); err != nil {
+			return nil, err
+		}
+	}
+	if err = db.writeChange(tx, actor, AUDIT_UPDATE, tiny, before, &after); err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	db.committed(&after)
+
+	Infof("URL is updated. tiny:'%s' by %s\n", tiny, actor)
+	return &after, nil
+}
+
+// DeleteLink deletes the link of tiny on domain in a transaction with its audit log.
+func (db *DB) DeleteLink(domain string, tiny string, actor string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
 	}
 	defer func() {
-		insert.Close()
-		Debugf("Insert statement is closed.")
+		if err != nil {
+			tx.Rollback()
+		}
 	}()
 
-	if _, err = insert.Exec(tiny, origin); err != nil {
-		Warnf("Faild to add new record to urls in execute query. Error: %v \n", err)
-		return "", err
+	before, err := getLinkTx(tx, "domain = ? AND tiny = ?", domain, tiny)
+	if err != nil {
+		return err
+	}
+	if before == nil {
+		err = errLinkNotFound
+		return err
+	}
+	if err = deleteLinkTx(tx, before); err != nil {
+		return err
+	}
+	if err = db.writeChange(tx, actor, AUDIT_DELETE, tiny, before, nil); err != nil {
+		return err
 	}
 	if err = tx.Commit(); err != nil {
-		Warnf("Faild to add new record to urls in commit result. Error: %v \n", err)
-		return "", err
+		return err
 	}
+	db.committed(before)
+
+	Infof("URL is deleted. tiny:'%s' by %s\n", tiny, actor)
+	return nil
+}
 
-	Infof("New URL is added. origin:'%s' tiny:'%s'\n", origin, tiny)
-	return tiny, nil
+// deleteLinkTx deletes link with its targets, variants and schedule in tx.
+func deleteLinkTx(tx *sql.Tx, link *Link) error {
+	for _, query := range []string{
+		"DELETE FROM urls WHERE id = ?",
+		"DELETE FROM link_targets WHERE link_id = ?",
+		"DELETE FROM link_variants WHERE link_id = ?",
+		"DELETE FROM link_schedule WHERE link_id = ?",
+	} {
+		if _, err := tx.Exec(query, link.ID); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -2,7 +2,9 @@ package main
 
 import (
 	"database/sql"
+	"fmt"
 	"os"
+	"sync"
 	"testing"
 )
 
@@ -16,6 +18,28 @@ func createTempDBName(t *testing.T) (string, error) {
 	return dbFileName, nil
 }
 
+func testDBConfig(dbFileName string) *Config {
+	cfg := createDefaultConfig()
+	cfg.DBFileName = dbFileName
+	return cfg
+}
+
+func connectTempDB(t *testing.T) *DB {
+	dbFileName, err := createTempDBName(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := ConnectDB(testDBConfig(dbFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		os.Remove(dbFileName)
+	})
+	return db
+}
+
 func TestCreateDatabase(t *testing.T) {
 	dbFileName, err := createTempDBName(t)
 	if err != nil {
@@ -52,7 +76,7 @@ func TestGetAndAddUrlsRecord(t *testing.T) {
 		t.Fatal(err)
 		return
 	}
-	db, err := ConnectDB(dbFileName)
+	db, err := ConnectDB(testDBConfig(dbFileName))
 	if err != nil {
 		t.Fatal(err)
 		return
@@ -61,7 +85,7 @@ func TestGetAndAddUrlsRecord(t *testing.T) {
 
 	// add new origin/tiny url
 	origin := "https://example.com/hoge/var"
-	tiny, err := db.AddTinyURL(origin)
+	tiny, err := db.AddTinyURL(origin, "test")
 	t.Logf("new tiny is \"%s\"\n", tiny)
 	if err != nil {
 		t.Fatal(err)
@@ -69,7 +93,7 @@ func TestGetAndAddUrlsRecord(t *testing.T) {
 	}
 
 	// get above created tiny url
-	result, err := db.GetOriginURL(tiny)
+	result, err := db.GetOriginURL("", tiny)
 	t.Logf("result is \"%s\"\n", result)
 	if err != nil {
 		t.Fatal(err)
@@ -81,7 +105,7 @@ func TestGetAndAddUrlsRecord(t *testing.T) {
 	}
 
 	// add same origin/tiny url. Same tiny url is expected.
-	sametiny, err := db.AddTinyURL(origin)
+	sametiny, err := db.AddTinyURL(origin, "test")
 	t.Logf("same tiny is \"%s\"\n", sametiny)
 	if err != nil {
 		t.Fatal(err)
@@ -92,3 +116,140 @@ func TestGetAndAddUrlsRecord(t *testing.T) {
 		return
 	}
 }
+
+func TestAddLinksRetryUsedTiny(t *testing.T) {
+	db := connectTempDB(t)
+
+	// 20 tinies of 1 letter collide almost surely. They are expected to be retried.
+	links := []*Link{}
+	for i := 0; i < 20; i++ {
+		links = append(links, &Link{Origin: fmt.Sprintf("https://example.com/%d", i)})
+	}
+	added, err := db.AddLinks(links, 1, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tinies := map[string]bool{}
+	for _, link := range added {
+		tinies[link.Tiny] = true
+	}
+	if len(tinies) != len(links) {
+		t.Fatalf("real: %d  expected: %d different tinies\n", len(tinies), len(links))
+	}
+}
+
+func TestConcurrentAddTinyURL(t *testing.T) {
+	db := connectTempDB(t)
+
+	// every goroutine adds different origins at the same time. "database is locked" must not happen.
+	const workers = 20
+	const perWorker = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*perWorker)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < perWorker; j++ {
+				if _, err := db.AddTinyURL(fmt.Sprintf("https://example.com/%d/%d", i, j), "test"); err != nil {
+					errs <- err
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	var n int
+	if err := db.QueryRow("SELECT count(*) FROM urls").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != workers*perWorker {
+		t.Fatalf("real: %d  expected: %d\n", n, workers*perWorker)
+	}
+
+	var mode string
+	if err := db.QueryRow("PRAGMA journal_mode").Scan(&mode); err != nil {
+		t.Fatal(err)
+	}
+	if mode != "wal" {
+		t.Fatalf("real: %s  expected: wal\n", mode)
+	}
+}
+
+func TestConcurrentCountClick(t *testing.T) {
+	db := connectTempDB(t)
+	maxClicks := int64(5)
+	link, err := db.AddLink(&Link{Origin: "https://example.com/limited", RemainingClicks: &maxClicks}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reused, err := db.AddLink(&Link{Origin: "https://example.com/limited", RemainingClicks: &maxClicks}, "test"); err != nil || reused.Tiny == link.Tiny {
+		t.Fatalf("limited link is expected not to be reused. err: %v\n", err)
+	}
+
+	// clicks more than the limit at the same time. only maxClicks of them may succeed.
+	const clicks = 30
+	var wg sync.WaitGroup
+	results := make(chan bool, clicks)
+	for i := 0; i < clicks; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := db.CountClick(link)
+			if err != nil {
+				t.Error(err)
+			}
+			results <- ok
+		}()
+	}
+	wg.Wait()
+	close(results)
+	var succeeded int64
+	for ok := range results {
+		if ok {
+			succeeded++
+		}
+	}
+	if succeeded != maxClicks {
+		t.Fatalf("real: %d  expected: %d\n", succeeded, maxClicks)
+	}
+
+	loaded, err := db.LoadLink("", link.Tiny)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Clicks != maxClicks || loaded.RemainingClicks == nil || *loaded.RemainingClicks != 0 {
+		t.Fatalf("unexpected link: %+v\n", loaded)
+	}
+}
+
+func TestSpecialFileName(t *testing.T) {
+	dir, err := os.MkdirTemp("", "tiny url")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// "?", "#" and "%" must be a part of the file name, not the query, the fragment or escapes of DSN.
+	dbFileName := dir + "/tiny?mode=ro#100%.db"
+	db, err := ConnectDB(testDBConfig(dbFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err = db.AddTinyURL("https://example.com/", "test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(dbFileName); err != nil {
+		t.Fatalf("real: %v  expected: %s exists\n", err, dbFileName)
+	}
+	if err = VerifyBackup(dbFileName); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) > 3 {
+		t.Fatalf("real: %d files  expected: database and its WAL files only\n", len(entries))
+	}
+}
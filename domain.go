@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net"
+	"regexp"
+	"strings"
+)
+
+const DEFAULT_TINY_LENGTH int = 10
+const MIN_TINY_LENGTH int = 4
+const MAX_TINY_LENGTH int = 64
+
+var validDomain = regexp.MustCompile(`^[a-z0-9]([a-z0-9.-]*[a-z0-9])?$`)
+
+// Domain is a host serving its own links. The same tiny path can be used on each domain.
+// Zero fields are taken from the top level of the config.
+type Domain struct {
+	// Host is the host name of requests without port (e.g. "go.example.com").
+	Host string `yaml:"Host"`
+	// Protocol of tiny URLs on the domain (http,https).
+	Protocol string `yaml:"Protocol"`
+	// TinyLength is the length of tiny paths created on the domain.
+	TinyLength int `yaml:"TinyLength"`
+	// DefaultRedirectCode is used for links on the domain created without redirect code.
+	DefaultRedirectCode int `yaml:"DefaultRedirectCode"`
+	// FallbackURL is used for broken links on the domain having no fallback URL, if BrokenLinkAction is "fallback".
+	FallbackURL string `yaml:"FallbackURL"`
+
+	// key is Link.Domain of links on the domain.
+	key string
+	// baseURL is the URL tiny paths are appended to, set for the request.
+	baseURL string
+}
+
+// domainOf returns the domain serving host with zero fields filled. ok is false if host is not served.
+// Without Domains, all hosts are served and share links having empty Link.Domain.
+func (cfg *Config) domainOf(host string) (d *Domain, ok bool) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+
+	domain := Domain{}
+	if len(cfg.Domains) > 0 {
+		for _, configured := range cfg.Domains {
+			if configured.Host != host {
+				continue
+			}
+			domain = *configured
+			domain.key = configured.Host
+			ok = true
+			break
+		}
+		if !ok {
+			return nil, false
+		}
+	}
+	if domain.Protocol == "" {
+		domain.Protocol = cfg.publicProtocol()
+	}
+	if domain.TinyLength == 0 {
+		domain.TinyLength = DEFAULT_TINY_LENGTH
+	}
+	if domain.DefaultRedirectCode == 0 {
+		domain.DefaultRedirectCode = cfg.DefaultRedirectCode
+	}
+	return &domain, true
+}
+
+// linkDomain returns Link.Domain of links on host given to admin API and commands. Empty host is the default domain.
+func (cfg *Config) linkDomain(host string) (key string, ok bool) {
+	if host == "" {
+		return cfg.defaultDomain(), true
+	}
+	d, ok := cfg.domainOf(host)
+	if !ok {
+		return "", false
+	}
+	return d.key, true
+}
+
+// defaultDomain returns Link.Domain of links given without domain, which is DefaultDomain or the first domain without it.
+func (cfg *Config) defaultDomain() string {
+	if len(cfg.Domains) == 0 {
+		return ""
+	}
+	if cfg.DefaultDomain != "" {
+		return cfg.DefaultDomain
+	}
+	return cfg.Domains[0].Host
+}
@@ -4,5 +4,8 @@ go 1.16
 
 require (
 	github.com/mattn/go-sqlite3 v1.14.7
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
+	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519
+	golang.org/x/net v0.0.0-20210405180319-a5a99cb37ef4
 	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// BROKEN_LINK_REDIRECT keeps redirecting to broken origins. Broken links are only flagged.
+	BROKEN_LINK_REDIRECT string = "redirect"
+	// BROKEN_LINK_FALLBACK redirects to the fallback URL of the link, or shows "link broken" page without it.
+	BROKEN_LINK_FALLBACK string = "fallback"
+	// BROKEN_LINK_PAGE shows "link broken" page.
+	BROKEN_LINK_PAGE string = "page"
+)
+
+var BROKEN_LINK_ACTIONS = map[string]bool{
+	BROKEN_LINK_REDIRECT: true,
+	BROKEN_LINK_FALLBACK: true,
+	BROKEN_LINK_PAGE:     true,
+}
+
+// HealthChecker checks origins of links. Requests to the same host are sent one by one with delay,
+// and up to concurrency requests are sent at the same time.
+type HealthChecker struct {
+	db          *DB
+	client      *http.Client
+	concurrency int
+	hostDelay   time.Duration
+	failures    int
+}
+
+type HealthCheckResult struct {
+	Checked   int
+	Broken    int
+	Recovered int
+}
+
+type healthTarget struct {
+	id       int64
+	domain   string
+	tiny     string
+	failures int
+	broken   bool
+	// origin and checkedAt are of the link when it is read. The result is not saved if they are changed while checking.
+	origin    string
+	checkedAt sql.NullString
+	// destinations are origins the link serves. The link works only if all of them work.
+	destinations []string
+}
+
+type healthProbe struct {
+	status int
+	ok     bool
+}
+
+func NewHealthChecker(cfg *Config, db *DB) *HealthChecker {
+	return &HealthChecker{
+		db:          db,
+		client:      &http.Client{Timeout: cfg.HealthCheckTimeout},
+		concurrency: cfg.HealthCheckConcurrency,
+		hostDelay:   cfg.HealthCheckHostDelay,
+		failures:    cfg.HealthCheckFailures,
+	}
+}
+
+// destinations returns origins link may redirect to from now: origins of targeting rules and variants,
+// and origins by the schedule unless variants take all visitors. Each origin is returned once.
+func (link *Link) destinations(now time.Time) []string {
+	origins := []string{}
+	seen := map[string]bool{}
+	add := func(origin string) {
+		if origin != "" && !seen[origin] {
+			seen[origin] = true
+			origins = append(origins, origin)
+		}
+	}
+	for _, target := range link.Targets {
+		add(target.Origin)
+	}
+	for _, variant := range link.Variants {
+		add(variant.Origin)
+	}
+	if len(link.Variants) == 0 {
+		if len(link.Schedule) == 0 {
+			add(link.Origin)
+		}
+		for i, entry := range link.Schedule {
+			// entries followed by a started entry are never served again.
+			if i+1 < len(link.Schedule) && !now.Before(link.Schedule[i+1].StartAt) {
+				continue
+			}
+			add(entry.Origin)
+		}
+	}
+	return origins
+}
+
+// CheckLinks checks links not checked since checkedBefore. Zero checkedBefore checks all links.
+// Every destination of the links is requested once even if links share it.
+func (c *HealthChecker) CheckLinks(ctx context.Context, checkedBefore time.Time) (*HealthCheckResult, error) {
+	// last_checked_at is read as text as it is saved, to find it by the same value in record.
+	query := "SELECT id, domain, tiny, origin, CAST(last_checked_at AS TEXT), check_failures, broken FROM urls"
+	var args []interface{}
+	if !checkedBefore.IsZero() {
+		query += " WHERE last_checked_at IS NULL OR last_checked_at < ?"
+		args = append(args, checkedBefore.UTC())
+	}
+	targets, err := getAllTargets(c.db)
+	if err != nil {
+		return nil, err
+	}
+	variants, err := getAllVariants(c.db)
+	if err != nil {
+		return nil, err
+	}
+	schedules, err := getAllSchedules(c.db)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := c.db.Query(query+" ORDER BY id", args...)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	links := []*healthTarget{}
+	byHost := map[string][]string{}
+	seen := map[string]bool{}
+	for rows.Next() {
+		t := &healthTarget{}
+		link := &Link{}
+		if err = rows.Scan(&t.id, &t.domain, &t.tiny, &link.Origin, &t.checkedAt, &t.failures, &t.broken); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		t.origin = link.Origin
+		link.Targets, link.Variants, link.Schedule = targets[t.id], variants[t.id], schedules[t.id]
+		t.destinations = link.destinations(now)
+		links = append(links, t)
+		for _, origin := range t.destinations {
+			if seen[origin] {
+				continue
+			}
+			seen[origin] = true
+			host := ""
+			if u, err := url.Parse(origin); err == nil {
+				host = strings.ToLower(u.Host)
+			}
+			byHost[host] = append(byHost[host], origin)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	probes := map[string]healthProbe{}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, c.concurrency)
+	for _, origins := range byHost {
+		wg.Add(1)
+		go func(origins []string) {
+			defer wg.Done()
+			for i, origin := range origins {
+				if i > 0 {
+					select {
+					case <-ctx.Done():
+						return
+					case <-time.After(c.hostDelay):
+					}
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case sem <- struct{}{}:
+				}
+				status, ok := c.check(ctx, origin)
+				<-sem
+
+				mu.Lock()
+				probes[origin] = healthProbe{status: status, ok: ok}
+				mu.Unlock()
+			}
+		}(origins)
+	}
+	wg.Wait()
+
+	result := &HealthCheckResult{}
+	for _, t := range links {
+		if ctx.Err() != nil {
+			break
+		}
+		// status is of the first destination failed, or of the first destination if all work.
+		var probe healthProbe
+		var origin string
+		checked := true
+		for i, destination := range t.destinations {
+			p, ok := probes[destination]
+			if !ok {
+				checked = false
+				break
+			}
+			if i == 0 || (probe.ok && !p.ok) {
+				probe, origin = p, destination
+			}
+		}
+		if !checked || len(t.destinations) == 0 {
+			continue
+		}
+		broken, recorded, err := c.record(t, origin, probe.status, probe.ok, now)
+		if err != nil {
+			Errorf("Recording health of '%s' is failed. Error: %v\n", t.tiny, err)
+			continue
+		}
+		if !recorded {
+			Debugf("Health of '%s' is not recorded because it is changed while checking.\n", t.tiny)
+			continue
+		}
+		result.Checked++
+		if broken && !t.broken {
+			result.Broken++
+		} else if !broken && t.broken {
+			result.Recovered++
+		}
+	}
+	return result, ctx.Err()
+}
+
+// check requests origin and reports whether it works. status is 0 if the origin doesn't respond.
+// Redirects are followed, and GET is used for servers not supporting HEAD.
+func (c *HealthChecker) check(ctx context.Context, origin string) (status int, ok bool) {
+	for _, method := range []string{"HEAD", "GET"} {
+		req, err := http.NewRequest(method, origin, nil)
+		if err != nil {
+			return 0, false
+		}
+		req = req.WithContext(ctx)
+		req.Header.Set("User-Agent", "tiny-url-health-checker")
+		resp, err := c.client.Do(req)
+		if err != nil {
+			Debugf("Health check of '%s' is failed. Error: %v\n", origin, err)
+			return 0, false
+		}
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+		resp.Body.Close()
+		status = resp.StatusCode
+		if status != http.StatusMethodNotAllowed && status != http.StatusNotImplemented {
+			break
+		}
+	}
+	return status, status >= 200 && status < 400
+}
+
+// record saves the result of the check of origin. The link becomes broken after c.failures failures in a row,
+// and recovers by a success. The result is not recorded if the link is changed or checked by others since it is
+// read, because the result may be of old destinations.
+func (c *HealthChecker) record(t *healthTarget, origin string, status int, ok bool, now time.Time) (broken bool, recorded bool, err error) {
+	failures := 0
+	if !ok {
+		failures = t.failures + 1
+	}
+	broken = failures >= c.failures
+	tx, err := c.db.Begin()
+	if err != nil {
+		return false, false, err
+	}
+	defer func() {
+		if err != nil || !recorded {
+			tx.Rollback()
+		}
+	}()
+	res, err := tx.Exec("UPDATE urls SET last_status = ?, last_checked_at = ?, check_failures = ?, broken = ? WHERE id = ? AND origin = ? AND last_checked_at IS ?",
+		status, time.Now().UTC(), failures, broken, t.id, t.origin, t.checkedAt)
+	if err != nil {
+		return false, false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, false, err
+	}
+	// targets, variants and schedule don't change last_checked_at of links never checked.
+	link := &Link{ID: t.id, Origin: t.origin}
+	if err = getLinkChildren(tx, link); err != nil {
+		return false, false, err
+	}
+	if strings.Join(link.destinations(now), "\n") != strings.Join(t.destinations, "\n") {
+		return false, false, nil
+	}
+	if err = tx.Commit(); err != nil {
+		return false, false, err
+	}
+	recorded = true
+	if broken != t.broken {
+		if broken {
+			Warnf("Origin of '%s' is broken. origin:'%s' status:%d\n", t.tiny, origin, status)
+		} else {
+			Infof("Origin of '%s' is recovered. origin:'%s' status:%d\n", t.tiny, origin, status)
+		}
+		c.db.invalidate(&Link{Domain: t.domain, Tiny: t.tiny})
+	}
+	return broken, true, nil
+}
+
+// resetHealthTx forgets the health of link whose destinations are changed, so that it is not broken by the old ones.
+// It is checked again by the next check.
+func resetHealthTx(tx *sql.Tx, link *Link) error {
+	if _, err := tx.Exec("UPDATE urls SET last_status = 0, last_checked_at = NULL, check_failures = 0, broken = 0 WHERE id = ?", link.ID); err != nil {
+		return err
+	}
+	link.LastStatus, link.LastCheckedAt, link.Broken = 0, nil, false
+	return nil
+}
+
+// GetBrokenLinks returns links whose origins are broken.
+func (db *DB) GetBrokenLinks() ([]*Link, error) {
+	rows, err := db.Query("SELECT " + selectLinkColumns + " FROM urls WHERE broken = 1 ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := []*Link{}
+	for rows.Next() {
+		link, err := scanLink(rows)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+	return links, rows.Err()
+}
+
+// StartHealthChecker checks origins of links every HealthCheckInterval until ctx is done.
+func StartHealthChecker(ctx context.Context, cfg *Config, db *DB) {
+	if cfg.HealthCheckInterval <= 0 {
+		return
+	}
+	Infof("Origins of links are checked every %v.\n", cfg.HealthCheckInterval)
+	c := NewHealthChecker(cfg, db)
+	go func() {
+		ticker := time.NewTicker(cfg.HealthCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				result, err := c.CheckLinks(ctx, time.Now().Add(-cfg.HealthCheckInterval))
+				if err != nil {
+					if ctx.Err() == nil {
+						Errorf("HealthCheckError: %v\n", err)
+					}
+					continue
+				}
+				Infof("Origins of %d links are checked. broken:%d recovered:%d\n", result.Checked, result.Broken, result.Recovered)
+			}
+		}
+	}()
+}
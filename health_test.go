@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHealthChecker(t *testing.T) {
+	var mu sync.Mutex
+	alive := true
+	var last time.Time
+	minInterval := time.Hour
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Method == "HEAD" {
+			if !last.IsZero() && time.Since(last) < minInterval {
+				minInterval = time.Since(last)
+			}
+			last = time.Now()
+			// GET is used instead.
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !alive || r.URL.Path == "/gone" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer origin.Close()
+
+	db := connectTempDB(t)
+	cfg := testDBConfig("")
+	cfg.HealthCheckFailures = 2
+	cfg.HealthCheckHostDelay = 20 * time.Millisecond
+	c := NewHealthChecker(cfg, db)
+	ok, err := db.AddLink(&Link{Origin: origin.URL + "/ok"}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gone, err := db.AddLink(&Link{Origin: origin.URL + "/gone"}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a link is broken after failures in a row.
+	for i, expected := range []int{0, 1, 0} {
+		mu.Lock()
+		last = time.Time{}
+		mu.Unlock()
+		result, err := c.CheckLinks(context.Background(), time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Checked != 2 || result.Broken != expected {
+			t.Fatalf("%d real: %+v  expected: 2 checked %d broken\n", i, result, expected)
+		}
+	}
+	links, err := db.GetBrokenLinks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 1 || links[0].Tiny != gone.Tiny || links[0].LastStatus != http.StatusNotFound || links[0].LastCheckedAt == nil {
+		t.Fatalf("unexpected broken links: %+v\n", links)
+	}
+	// requests to the same host are delayed.
+	if minInterval < cfg.HealthCheckHostDelay/2 {
+		t.Fatalf("real: %v  expected: about %v or more\n", minInterval, cfg.HealthCheckHostDelay)
+	}
+
+	// links checked recently are skipped.
+	result, err := c.CheckLinks(context.Background(), time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Checked != 0 {
+		t.Fatalf("real: %d  expected: 0\n", result.Checked)
+	}
+
+	mu.Lock()
+	alive = false
+	mu.Unlock()
+	if _, err := c.CheckLinks(context.Background(), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	link, err := db.LoadLink("", ok.Tiny)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link.Broken {
+		t.Fatal("a link is expected not to be broken by a failure")
+	}
+}
+
+func TestHealthCheckDestinations(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/gone" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer origin.Close()
+
+	db := connectTempDB(t)
+	cfg := testDBConfig("")
+	cfg.HealthCheckFailures = 1
+	cfg.HealthCheckHostDelay = 0
+	c := NewHealthChecker(cfg, db)
+	link, err := db.AddLink(&Link{Origin: origin.URL + "/ok"}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the link is broken by a variant even though its origin works.
+	if _, err = db.SetVariants("", link.Tiny, "test", []*LinkVariant{{Origin: origin.URL + "/ok", Weight: 1}, {Origin: origin.URL + "/gone", Weight: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	result, err := c.CheckLinks(context.Background(), time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Checked != 1 || result.Broken != 1 {
+		t.Fatalf("real: %+v  expected: 1 checked 1 broken\n", result)
+	}
+
+	// changing destinations forgets the health.
+	updated, err := db.SetVariants("", link.Tiny, "test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Broken || updated.LastCheckedAt != nil {
+		t.Fatalf("health is expected to be reset. real: %+v\n", updated)
+	}
+	if _, err = db.SetSchedule("", link.Tiny, "test", []*ScheduleEntry{{StartAt: time.Now().Add(-time.Hour), Origin: origin.URL + "/gone"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.CheckLinks(context.Background(), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if broken, err := db.GetBrokenLinks(); err != nil || len(broken) != 1 {
+		t.Fatalf("the scheduled origin is expected to be checked. real: %+v %v\n", broken, err)
+	}
+	if _, err = db.SetSchedule("", link.Tiny, "test", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.UpdateLink("", link.Tiny, "test", func(l *Link) error { l.Origin = origin.URL + "/gone"; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.CheckLinks(context.Background(), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	updated, err = db.UpdateLink("", link.Tiny, "test", func(l *Link) error { l.Origin = origin.URL + "/ok"; return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	var failures int
+	if err = db.QueryRow("SELECT check_failures FROM urls WHERE id = ?", link.ID).Scan(&failures); err != nil {
+		t.Fatal(err)
+	}
+	if updated.Broken || updated.LastStatus != 0 || failures != 0 {
+		t.Fatalf("health is expected to be reset by the new origin. real: %+v failures:%d\n", updated, failures)
+	}
+}
+
+func TestHealthCheckChangedWhileChecking(t *testing.T) {
+	db := connectTempDB(t)
+	var changed, varied *Link
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/gone":
+			// the origin is changed while it is requested.
+			if _, err := db.UpdateLink("", changed.Tiny, "test", func(l *Link) error { l.Origin = "http://" + r.Host + "/ok"; return nil }); err != nil {
+				t.Error(err)
+			}
+			w.WriteHeader(http.StatusNotFound)
+		case "/old":
+			// the link never checked has variants while its origin is requested.
+			if _, err := db.SetVariants("", varied.Tiny, "test", []*LinkVariant{{Origin: "http://" + r.Host + "/ok", Weight: 1}}); err != nil {
+				t.Error(err)
+			}
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer origin.Close()
+
+	cfg := testDBConfig("")
+	cfg.HealthCheckFailures = 1
+	cfg.HealthCheckHostDelay = 0
+	c := NewHealthChecker(cfg, db)
+	var err error
+	if changed, err = db.AddLink(&Link{Origin: origin.URL + "/gone"}, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if varied, err = db.AddLink(&Link{Origin: origin.URL + "/old"}, "test"); err != nil {
+		t.Fatal(err)
+	}
+	result, err := c.CheckLinks(context.Background(), time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Checked != 0 || result.Broken != 0 {
+		t.Fatalf("real: %+v  expected: nothing recorded\n", result)
+	}
+	for _, tiny := range []string{changed.Tiny, varied.Tiny} {
+		link, err := db.LoadLink("", tiny)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if link.Broken || link.LastCheckedAt != nil {
+			t.Fatalf("the result of the old origin is expected not to be recorded. real: %+v\n", link)
+		}
+	}
+
+	// the next check records the new destinations.
+	result, err = c.CheckLinks(context.Background(), time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Checked != 2 || result.Broken != 0 {
+		t.Fatalf("real: %+v  expected: 2 checked 0 broken\n", result)
+	}
+}
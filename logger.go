@@ -68,7 +68,7 @@ func SetupLogger(logFileName string, outputMode string, logLevel string) (*Logge
 	}
 
 	if _, is := OUTPUT_MODE[outputMode]; !is {
-		fmt.Fprintf(os.Stderr, "log output mode \"%d\" is invalid. Valid value is [0-2].\n", outputMode)
+		fmt.Fprintf(os.Stderr, "log output mode \"%s\" is invalid. Valid value is [stderr,file,both].\n", outputMode)
 		return nil, errors.New("Specified log output mode is invaild.")
 	}
 	lgr.OutputMode = OUTPUT_MODE[outputMode]
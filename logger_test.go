@@ -37,7 +37,7 @@ func TestLoggerWrite(t *testing.T) {
 		t.Fatal(err)
 	}
 	fileName = "/tmp/" + fileName + ".log"
-	if logger, err = SetupLogger(fileName, 0, "debug"); err != nil {
+	if logger, err = SetupLogger(fileName, "stderr", "debug"); err != nil {
 		t.Fatal(err)
 	}
 	defer os.Remove(fileName)
@@ -64,7 +64,7 @@ func TestLogFormatCheck(t *testing.T) {
 		t.Fatal(err)
 	}
 	fileName = "/tmp/" + fileName + ".log"
-	if logger, err = SetupLogger(fileName, 0, "debug"); err != nil {
+	if logger, err = SetupLogger(fileName, "stderr", "debug"); err != nil {
 		t.Fatal(err)
 	}
 	defer os.Remove(fileName)
@@ -1,22 +1,35 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
 )
 
 func main() {
-	cfg, err := NewConfig("")
+	configFile := flag.String("config", "", fmt.Sprintf("config file name (default \"%s\")", DEFAULT_CONFIG_FILE_NAME))
+	flag.Usage = usage
+	flag.Parse()
+
+	var err error
 	defer func() {
-		if logger != nil {
-			Errorf("MainError: %v\n", err)
+		if err == nil {
 			return
 		}
-		if err != nil {
+		if logger != nil {
+			Errorf("MainError: %v\n", err)
+		} else {
 			fmt.Fprintf(os.Stderr, "MainError: %v\n", err)
 		}
+		os.Exit(1)
 	}()
-	logger, err = SetupLogger(cfg.LogFileName, cfg.LogOutputMode, cfg.LogLevel)
-	db, err := ConnectDB(cfg.DBFileName)
-	err = StartTinyURLServer(cfg, db)
+
+	cfg, err := NewConfig(*configFile)
+	if err != nil {
+		return
+	}
+	if logger, err = SetupLogger(cfg.LogFileName, cfg.LogOutputMode, cfg.LogLevel); err != nil {
+		return
+	}
+	err = runCommand(cfg, flag.Args())
 }
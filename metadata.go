@@ -0,0 +1,163 @@
+package main
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+)
+
+const SQL_ADD_URLS_METADATA = `
+	alter table urls add column title text not null default '';
+	alter table urls add column description text not null default '';
+	alter table urls add column image text not null default '';
+	alter table urls add column site_name text not null default '';
+`
+
+// METADATA_MAX_BYTES is the maximum size of the origin's HTML read for metadata.
+const METADATA_MAX_BYTES int64 = 512 * 1024
+
+// METADATA_TIMEOUT is the maximum time to read the origin's HTML for metadata.
+const METADATA_TIMEOUT time.Duration = 3 * time.Second
+
+const METADATA_MAX_TEXT_LENGTH int = 300
+const METADATA_MAX_IMAGE_LENGTH int = 2048
+
+// LinkMetadata is the title, description and Open Graph tags of the origin.
+type LinkMetadata struct {
+	Title       string `json:"Title,omitempty"`
+	Description string `json:"Description,omitempty"`
+	// Image is absolute URL of "og:image".
+	Image    string `json:"Image,omitempty"`
+	SiteName string `json:"SiteName,omitempty"`
+}
+
+func (m *LinkMetadata) isEmpty() bool {
+	return m == nil || *m == LinkMetadata{}
+}
+
+// FetchMetadata requests origin and reads its metadata. nil is returned if the origin doesn't respond successfully.
+func FetchMetadata(origin string) *LinkMetadata {
+	c := http.Client{Timeout: time.Second * 10}
+	resp, err := c.Get(origin)
+	if err != nil {
+		Debugf("Fetching metadata of '%s' is failed. Error: %v\n", origin, err)
+		return nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		resp.Body.Close()
+		return nil
+	}
+	return ReadMetadata(resp)
+}
+
+// ReadMetadata reads metadata from the response of the origin and closes the body.
+// nil is returned if the response is not HTML or has no metadata.
+func ReadMetadata(resp *http.Response) *LinkMetadata {
+	defer resp.Body.Close()
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return nil
+	}
+	// a slow origin must not block creating the link.
+	timer := time.AfterFunc(METADATA_TIMEOUT, func() { resp.Body.Close() })
+	defer timer.Stop()
+
+	var base *url.URL
+	if resp.Request != nil {
+		base = resp.Request.URL
+	}
+	m := ParseMetadata(io.LimitReader(resp.Body, METADATA_MAX_BYTES), base)
+	if m.isEmpty() {
+		return nil
+	}
+	return m
+}
+
+// ParseMetadata parses the head of HTML. Open Graph tags take precedence over <title> and description.
+// Relative "og:image" is resolved against base.
+func ParseMetadata(r io.Reader, base *url.URL) *LinkMetadata {
+	var title, description string
+	og := map[string]string{}
+	z := html.NewTokenizer(r)
+parse:
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			break parse
+		case html.EndTagToken:
+			if name, _ := z.TagName(); string(name) == "head" {
+				break parse
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			switch string(name) {
+			case "body":
+				break parse
+			case "title":
+				if tt == html.StartTagToken && title == "" {
+					for z.Next() == html.TextToken {
+						title += string(z.Text())
+					}
+				}
+			case "meta":
+				attrs := map[string]string{}
+				for hasAttr {
+					var key, val []byte
+					key, val, hasAttr = z.TagAttr()
+					attrs[string(key)] = string(val)
+				}
+				if property := strings.ToLower(attrs["property"]); strings.HasPrefix(property, "og:") {
+					if _, ok := og[property]; !ok {
+						og[property] = attrs["content"]
+					}
+				} else if strings.ToLower(attrs["name"]) == "description" && description == "" {
+					description = attrs["content"]
+				}
+			}
+		}
+	}
+
+	m := &LinkMetadata{Title: og["og:title"], Description: og["og:description"], Image: og["og:image"], SiteName: og["og:site_name"]}
+	if strings.TrimSpace(m.Title) == "" {
+		m.Title = title
+	}
+	if strings.TrimSpace(m.Description) == "" {
+		m.Description = description
+	}
+	if m.Image != "" && base != nil {
+		if u, err := base.Parse(strings.TrimSpace(m.Image)); err == nil {
+			m.Image = u.String()
+		}
+	}
+	normalizeMetadata(m)
+	return m
+}
+
+// normalizeMetadata collapses white spaces and truncates long texts. Image is removed unless it is http(s) URL.
+func normalizeMetadata(m *LinkMetadata) {
+	if m == nil {
+		return
+	}
+	m.Title = metadataText(m.Title)
+	m.Description = metadataText(m.Description)
+	m.SiteName = metadataText(m.SiteName)
+	m.Image = strings.TrimSpace(m.Image)
+	if u, err := url.Parse(m.Image); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || len(m.Image) > METADATA_MAX_IMAGE_LENGTH {
+		m.Image = ""
+	}
+}
+
+func metadataText(s string) string {
+	s = strings.Join(strings.Fields(strings.ToValidUTF8(s, "")), " ")
+	if utf8.RuneCountInString(s) <= METADATA_MAX_TEXT_LENGTH {
+		return s
+	}
+	return string([]rune(s)[:METADATA_MAX_TEXT_LENGTH-1]) + "…"
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParseMetadata(t *testing.T) {
+	base, _ := url.Parse("https://example.com/articles/1")
+	tests := []struct {
+		html     string
+		expected LinkMetadata
+	}{
+		{`<html><head><title> Hello
+			World </title><meta name="description" content="desc"></head><body></body></html>`,
+			LinkMetadata{Title: "Hello World", Description: "desc"}},
+		{`<head><title>Hello</title><meta property="og:title" content="OG Hello"><meta name="Description" content="desc">
+			<meta property="og:description" content="og desc"><meta property="og:image" content="/img.png"><meta property="og:site_name" content="Example">`,
+			LinkMetadata{Title: "OG Hello", Description: "og desc", Image: "https://example.com/img.png", SiteName: "Example"}},
+		{`<title>A &amp; B</title><meta property="og:image" content="javascript:alert(1)">`,
+			LinkMetadata{Title: "A & B"}},
+		// tags in body are ignored.
+		{`<head></head><body><title>Body</title><meta property="og:title" content="Body"></body>`,
+			LinkMetadata{}},
+		{`plain text`, LinkMetadata{}},
+	}
+	for _, test := range tests {
+		real := ParseMetadata(strings.NewReader(test.html), base)
+		if *real != test.expected {
+			t.Fatalf("real: %+v  expected: %+v\n", *real, test.expected)
+		}
+	}
+
+	long := ParseMetadata(strings.NewReader("<title>"+strings.Repeat("あ", 1000)+"</title>"), base)
+	if n := len([]rune(long.Title)); n != METADATA_MAX_TEXT_LENGTH {
+		t.Fatalf("real: %d  expected: %d\n", n, METADATA_MAX_TEXT_LENGTH)
+	}
+}
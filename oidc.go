@@ -0,0 +1,555 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const SQL_ADD_USERS_OIDC_SUBJECT = `
+	alter table users add column oidc_subject text;
+	create unique index users_oidc_subject on users(oidc_subject);
+`
+
+const DEFAULT_OIDC_USERNAME_CLAIM string = "email"
+
+var DEFAULT_OIDC_SCOPES = []string{"openid", "email", "profile"}
+
+const OIDC_COOKIE string = "tinyurl_oidc"
+
+// OIDC_LOGIN_TIMEOUT is how long the identity provider may take to redirect back after login starts.
+const OIDC_LOGIN_TIMEOUT time.Duration = 10 * time.Minute
+
+// OIDC_CLOCK_SKEW is the allowed difference of clocks between the identity provider and this server.
+const OIDC_CLOCK_SKEW time.Duration = time.Minute
+
+// OIDC_JWKS_REFRESH_INTERVAL limits refetching keys for unknown key IDs, so that forged tokens can't flood the provider.
+const OIDC_JWKS_REFRESH_INTERVAL time.Duration = time.Minute
+
+const OIDC_MAX_RESPONSE_SIZE int64 = 1024 * 1024
+
+// OIDCConfig is the OpenID Connect identity provider users log in with by the authorization code flow.
+type OIDCConfig struct {
+	// Issuer is the issuer URL of the provider. The provider is discovered at Issuer + "/.well-known/openid-configuration".
+	Issuer       string `yaml:"Issuer"`
+	ClientID     string `yaml:"ClientID"`
+	ClientSecret string `yaml:"ClientSecret"`
+	// RedirectURL is the callback registered in the provider. Default is the base URL + "/oidc/callback".
+	RedirectURL string   `yaml:"RedirectURL"`
+	Scopes      []string `yaml:"Scopes"`
+	// UsernameClaim is the claim of ID token used as the username on first login.
+	UsernameClaim string `yaml:"UsernameClaim"`
+	// RoleClaim is the claim of ID token (string or array) mapped to roles by Roles (e.g. "groups").
+	// Users having a value in Roles["admin"] are admins. If Roles["user"] is given, other users need a value in it to log in.
+	RoleClaim string              `yaml:"RoleClaim"`
+	Roles     map[string][]string `yaml:"Roles"`
+}
+
+// normalize validates c and fills defaults.
+func (c *OIDCConfig) normalize() error {
+	c.Issuer = strings.TrimSuffix(c.Issuer, "/")
+	if u, err := url.Parse(c.Issuer); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return errors.New(fmt.Sprintf("OIDC issuer '%s' is invalid (valid: http(s) URL)", c.Issuer))
+	}
+	if c.ClientID == "" {
+		return errors.New("OIDC client ID is required")
+	}
+	if c.RedirectURL != "" {
+		if u, err := url.Parse(c.RedirectURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return errors.New(fmt.Sprintf("OIDC redirect URL '%s' is invalid (valid: http(s) URL)", c.RedirectURL))
+		}
+	}
+	if len(c.Scopes) == 0 {
+		c.Scopes = DEFAULT_OIDC_SCOPES
+	}
+	hasOpenID := false
+	for _, scope := range c.Scopes {
+		hasOpenID = hasOpenID || scope == "openid"
+	}
+	if !hasOpenID {
+		return errors.New("OIDC scopes must have 'openid'")
+	}
+	if c.UsernameClaim == "" {
+		c.UsernameClaim = DEFAULT_OIDC_USERNAME_CLAIM
+	}
+	for role := range c.Roles {
+		if !USER_ROLES[role] {
+			return errors.New(fmt.Sprintf("OIDC role '%s' is invalid (valid: user,admin)", role))
+		}
+	}
+	if len(c.Roles) > 0 && c.RoleClaim == "" {
+		return errors.New("OIDC role claim is required for roles")
+	}
+	return nil
+}
+
+// role maps claims to the role of the user. ok is false if the user is not allowed to log in.
+func (c *OIDCConfig) role(claims map[string]interface{}) (role string, ok bool) {
+	values := map[string]bool{}
+	switch v := claims[c.RoleClaim].(type) {
+	case string:
+		values[v] = true
+	case []interface{}:
+		for _, value := range v {
+			if s, isString := value.(string); isString {
+				values[s] = true
+			}
+		}
+	}
+	for _, value := range c.Roles[ROLE_ADMIN] {
+		if values[value] {
+			return ROLE_ADMIN, true
+		}
+	}
+	if len(c.Roles[ROLE_USER]) == 0 {
+		return ROLE_USER, true
+	}
+	for _, value := range c.Roles[ROLE_USER] {
+		if values[value] {
+			return ROLE_USER, true
+		}
+	}
+	return "", false
+}
+
+// oidcProvider is the metadata of the provider found by discovery.
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// OIDCClient logs in users with the provider. The provider is discovered on the first login, and its keys are cached.
+type OIDCClient struct {
+	cfg    *OIDCConfig
+	client *http.Client
+
+	mu            sync.Mutex
+	provider      *oidcProvider
+	keys          map[string]*rsa.PublicKey
+	keysFetchedAt time.Time
+}
+
+func NewOIDCClient(cfg *OIDCConfig) *OIDCClient {
+	return &OIDCClient{cfg: cfg, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// getJSON requests url and decodes JSON of the response into v.
+func (c *OIDCClient) getJSON(url string, v interface{}) error {
+	resp, err := c.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(fmt.Sprintf("'%s' responded status %d", url, resp.StatusCode))
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, OIDC_MAX_RESPONSE_SIZE)).Decode(v)
+}
+
+func (c *OIDCClient) discover() (*oidcProvider, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.provider != nil {
+		return c.provider, nil
+	}
+	var provider oidcProvider
+	if err := c.getJSON(c.cfg.Issuer+"/.well-known/openid-configuration", &provider); err != nil {
+		return nil, err
+	}
+	if provider.Issuer != c.cfg.Issuer {
+		return nil, errors.New(fmt.Sprintf("issuer '%s' of discovery is not '%s'", provider.Issuer, c.cfg.Issuer))
+	}
+	if provider.AuthorizationEndpoint == "" || provider.TokenEndpoint == "" || provider.JWKSURI == "" {
+		return nil, errors.New("discovery doesn't have authorization_endpoint, token_endpoint or jwks_uri")
+	}
+	c.provider = &provider
+	return c.provider, nil
+}
+
+// pkceChallenge is S256 code challenge of verifier.
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthCodeURL returns the URL of the provider users log in at.
+func (c *OIDCClient) AuthCodeURL(redirectURL string, state string, nonce string, verifier string) (string, error) {
+	provider, err := c.discover()
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(provider.AuthorizationEndpoint)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", c.cfg.ClientID)
+	q.Set("redirect_uri", redirectURL)
+	q.Set("scope", strings.Join(c.cfg.Scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", pkceChallenge(verifier))
+	q.Set("code_challenge_method", "S256")
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// Exchange exchanges code for ID token at the token endpoint.
+func (c *OIDCClient) Exchange(code string, redirectURL string, verifier string) (string, error) {
+	provider, err := c.discover()
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectURL)
+	form.Set("code_verifier", verifier)
+	form.Set("client_id", c.cfg.ClientID)
+	req, err := http.NewRequest("POST", provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", MEDIA_TYPE_FORM)
+	req.Header.Set("Accept", MEDIA_TYPE_JSON)
+	if c.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(c.cfg.ClientID), url.QueryEscape(c.cfg.ClientSecret))
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var token struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err = json.NewDecoder(io.LimitReader(resp.Body, OIDC_MAX_RESPONSE_SIZE)).Decode(&token); err != nil {
+		return "", errors.New(fmt.Sprintf("token response (status %d) is invalid: %v", resp.StatusCode, err))
+	}
+	if resp.StatusCode != http.StatusOK || token.Error != "" {
+		return "", errors.New(fmt.Sprintf("token request is failed (status %d): %s %s", resp.StatusCode, token.Error, token.ErrorDescription))
+	}
+	if token.IDToken == "" {
+		return "", errors.New("token response doesn't have id_token")
+	}
+	return token.IDToken, nil
+}
+
+// key returns the public key of kid. Keys are refetched for unknown kid, so that rotated keys are found.
+func (c *OIDCClient) key(kid string) (*rsa.PublicKey, error) {
+	provider, err := c.discover()
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if key, ok := c.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(c.keysFetchedAt) < OIDC_JWKS_REFRESH_INTERVAL {
+		return nil, errors.New(fmt.Sprintf("key '%s' is not found", kid))
+	}
+	c.keysFetchedAt = time.Now()
+
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			Alg string `json:"alg"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := c.getJSON(provider.JWKSURI, &jwks); err != nil {
+		return nil, err
+	}
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") || (k.Alg != "" && k.Alg != "RS256") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(k.N, "="))
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(k.E, "="))
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	c.keys = keys
+	if key, ok := c.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, errors.New(fmt.Sprintf("key '%s' is not found", kid))
+}
+
+// VerifyIDToken verifies RS256 signature and claims of ID token, and returns its claims.
+func (c *OIDCClient) VerifyIDToken(idToken string, nonce string) (map[string]interface{}, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("ID token is not JWS")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	if header.Alg != "RS256" {
+		return nil, errors.New(fmt.Sprintf("algorithm '%s' of ID token is not RS256", header.Alg))
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	key, err := c.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, errors.New("signature of ID token is invalid")
+	}
+
+	var claims map[string]interface{}
+	if err = decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if iss, _ := claims["iss"].(string); iss != c.cfg.Issuer {
+		return nil, errors.New(fmt.Sprintf("issuer '%s' of ID token is not '%s'", iss, c.cfg.Issuer))
+	}
+	audiences := []string{}
+	switch aud := claims["aud"].(type) {
+	case string:
+		audiences = append(audiences, aud)
+	case []interface{}:
+		for _, a := range aud {
+			if s, ok := a.(string); ok {
+				audiences = append(audiences, s)
+			}
+		}
+	}
+	hasAudience := false
+	for _, aud := range audiences {
+		hasAudience = hasAudience || aud == c.cfg.ClientID
+	}
+	if !hasAudience {
+		return nil, errors.New("audience of ID token is not the client")
+	}
+	if azp, ok := claims["azp"].(string); (ok || len(audiences) > 1) && azp != c.cfg.ClientID {
+		return nil, errors.New("authorized party of ID token is not the client")
+	}
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(OIDC_CLOCK_SKEW)) {
+		return nil, errors.New("ID token is expired")
+	}
+	if iat, ok := claims["iat"].(float64); ok && time.Unix(int64(iat), 0).After(now.Add(OIDC_CLOCK_SKEW)) {
+		return nil, errors.New("ID token is issued in the future")
+	}
+	if n, _ := claims["nonce"].(string); subtle.ConstantTimeCompare([]byte(n), []byte(nonce)) != 1 {
+		return nil, errors.New("nonce of ID token is wrong")
+	}
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return nil, errors.New("ID token doesn't have subject")
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// LoginOIDCUser returns the user of subject, adding it as username on first login. The role is updated by every login.
+// OIDC users have no password, so they can't log in by password.
+func (db *DB) LoginOIDCUser(subject string, username string, role string) (*User, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	user, err := scanUser(tx.QueryRow("SELECT id, username, password_hash, role, created_at FROM users WHERE oidc_subject = ?", subject))
+	if err == nil {
+		if user.Role != role {
+			if _, err = tx.Exec("UPDATE users SET role = ? WHERE id = ?", role, user.ID); err != nil {
+				return nil, err
+			}
+			Infof("Role of user '%s' is changed to %s by OIDC.\n", user.Username, role)
+			user.Role = role
+		}
+		return user, tx.Commit()
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	if username, err = normalizeUsername(username); err != nil {
+		return nil, err
+	}
+	var exists bool
+	if err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE username = ?)", username).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, errUserExists
+	}
+	user = &User{Username: username, Role: role, CreatedAt: time.Now().UTC()}
+	result, err := tx.Exec("INSERT INTO users(username, password_hash, role, created_at, oidc_subject) VALUES(?, '', ?, ?, ?)",
+		user.Username, user.Role, user.CreatedAt, subject)
+	if err != nil {
+		return nil, err
+	}
+	if user.ID, err = result.LastInsertId(); err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	Infof("User '%s' (%s) is added by OIDC.\n", user.Username, user.Role)
+	return user, nil
+}
+
+// oidcRedirectURL returns the callback URL the provider redirects to.
+func oidcRedirectURL(cfg *Config, d *Domain) string {
+	if cfg.OIDC.RedirectURL != "" {
+		return cfg.OIDC.RedirectURL
+	}
+	return d.baseURL + "/oidc/callback"
+}
+
+// oidcLoginHandleMiddle redirects to the provider. state, nonce and PKCE verifier are kept in the cookie until the callback.
+func oidcLoginHandleMiddle(cfg *Config, client *OIDCClient) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		d, ok := requestDomain(cfg, w, r)
+		if !ok {
+			return
+		}
+		if r.Method != "GET" {
+			Debugf("Request not allowed method '%s'\n", r.Method)
+			writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: fmt.Sprintf("HTTP method '%s' is not allowed.\n", r.Method)})
+			return
+		}
+		var values [3]string
+		for i := range values {
+			var err error
+			if values[i], err = MakeRandomStr(SESSION_TOKEN_LENGTH * 2); err != nil {
+				writeAccountError(cfg, w, true, http.StatusInternalServerError, "Internal server error.\n")
+				return
+			}
+		}
+		state, nonce, verifier := values[0], values[1], values[2]
+		authURL, err := client.AuthCodeURL(oidcRedirectURL(cfg, d), state, nonce, verifier)
+		if err != nil {
+			Errorf("OIDC discovery of '%s' is failed. Error: %v\n", cfg.OIDC.Issuer, err)
+			writeAccountError(cfg, w, true, http.StatusBadGateway, "Identity provider is not available.\n")
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     OIDC_COOKIE,
+			Value:    strings.Join(values[:], "."),
+			Path:     cfg.basePath() + "/oidc/",
+			MaxAge:   int(OIDC_LOGIN_TIMEOUT.Seconds()),
+			Secure:   strings.HasPrefix(d.baseURL, "https://"),
+			HttpOnly: true,
+			// the cookie must be sent with the redirect from the provider.
+			SameSite: http.SameSiteLaxMode,
+		})
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Location", authURL)
+		w.WriteHeader(http.StatusFound)
+	}
+}
+
+// oidcCallbackHandleMiddle exchanges the code for ID token, and logs in the user of the token.
+func oidcCallbackHandleMiddle(cfg *Config, db *DB, client *OIDCClient) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		d, ok := requestDomain(cfg, w, r)
+		if !ok {
+			return
+		}
+		if r.Method != "GET" {
+			Debugf("Request not allowed method '%s'\n", r.Method)
+			writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: fmt.Sprintf("HTTP method '%s' is not allowed.\n", r.Method)})
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: OIDC_COOKIE, Value: "", Path: cfg.basePath() + "/oidc/", MaxAge: -1, HttpOnly: true})
+
+		q := r.URL.Query()
+		if e := q.Get("error"); e != "" {
+			Infof("OIDC login is failed by the provider. error:'%s' description:'%s'\n", e, q.Get("error_description"))
+			writeAccountError(cfg, w, true, http.StatusUnauthorized, "Login is canceled or rejected by the identity provider.\n")
+			return
+		}
+		cookie, err := r.Cookie(OIDC_COOKIE)
+		var values []string
+		if err == nil {
+			values = strings.Split(cookie.Value, ".")
+		}
+		if len(values) != 3 || subtle.ConstantTimeCompare([]byte(q.Get("state")), []byte(values[0])) != 1 {
+			Infof("OIDC callback with invalid state from %s\n", r.RemoteAddr)
+			writeAccountError(cfg, w, true, http.StatusBadRequest, "Login is expired or invalid. Please try again.\n")
+			return
+		}
+		nonce, verifier := values[1], values[2]
+
+		idToken, err := client.Exchange(q.Get("code"), oidcRedirectURL(cfg, d), verifier)
+		if err != nil {
+			Warnf("OIDC code exchange is failed. Error: %v\n", err)
+			writeAccountError(cfg, w, true, http.StatusBadGateway, "Login by the identity provider is failed.\n")
+			return
+		}
+		claims, err := client.VerifyIDToken(idToken, nonce)
+		if err != nil {
+			Warnf("OIDC ID token is invalid. Error: %v\n", err)
+			writeAccountError(cfg, w, true, http.StatusUnauthorized, "Login by the identity provider is failed.\n")
+			return
+		}
+		sub, _ := claims["sub"].(string)
+		role, ok := cfg.OIDC.role(claims)
+		if !ok {
+			Infof("OIDC user '%s' is not allowed to log in.\n", sub)
+			writeAccountError(cfg, w, true, http.StatusForbidden, "You are not allowed to use this service.\n")
+			return
+		}
+		username, _ := claims[cfg.OIDC.UsernameClaim].(string)
+		user, err := db.LoginOIDCUser(cfg.OIDC.Issuer+"#"+sub, username, role)
+		if err == errUserExists {
+			writeAccountError(cfg, w, true, http.StatusConflict, fmt.Sprintf("Username '%s' is already used by another account.\n", username))
+			return
+		}
+		if err != nil {
+			Warnf("Login of OIDC user '%s' is failed. Error: %v\n", sub, err)
+			writeAccountError(cfg, w, true, http.StatusForbidden, fmt.Sprintf("Username '%s' can't be used.\n", username))
+			return
+		}
+		startSession(cfg, d, db, w, user, true)
+	}
+}
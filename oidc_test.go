@@ -0,0 +1,448 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testOIDCClientID = "tiny-url"
+const testOIDCClientSecret = "client-secret"
+
+// mockIdP is an OpenID Connect provider issuing ID tokens of claims to anyone visiting the authorization endpoint.
+type mockIdP struct {
+	t      *testing.T
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	kid    string
+
+	mu     sync.Mutex
+	claims map[string]interface{}
+	codes  map[string]url.Values
+}
+
+func startMockIdP(t *testing.T) *mockIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &mockIdP{t: t, key: key, kid: "key-1", codes: map[string]url.Values{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.server.URL,
+			"authorization_endpoint": idp.server.URL + "/authorize",
+			"token_endpoint":         idp.server.URL + "/token",
+			"jwks_uri":               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/authorize", idp.authorize)
+	mux.HandleFunc("/token", idp.token)
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": idp.kid,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(idp.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(idp.key.E)).Bytes()),
+		}}})
+	})
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+func (idp *mockIdP) config() *OIDCConfig {
+	cfg := &OIDCConfig{
+		Issuer:       idp.server.URL,
+		ClientID:     testOIDCClientID,
+		ClientSecret: testOIDCClientSecret,
+		RoleClaim:    "groups",
+		Roles:        map[string][]string{ROLE_ADMIN: {"admins"}, ROLE_USER: {"staff"}},
+	}
+	if err := cfg.normalize(); err != nil {
+		idp.t.Fatal(err)
+	}
+	return cfg
+}
+
+// login sets claims of the user logging in next.
+func (idp *mockIdP) login(claims map[string]interface{}) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.claims = claims
+}
+
+func (idp *mockIdP) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("response_type") != "code" || q.Get("client_id") != testOIDCClientID || q.Get("code_challenge_method") != "S256" ||
+		q.Get("code_challenge") == "" || !strings.Contains(q.Get("scope"), "openid") {
+		http.Error(w, "invalid authorization request", http.StatusBadRequest)
+		return
+	}
+	code, _ := MakeRandomStr(16)
+	idp.mu.Lock()
+	idp.codes[code] = q
+	idp.mu.Unlock()
+	redirect, _ := url.Parse(q.Get("redirect_uri"))
+	redirect.RawQuery = url.Values{"code": {code}, "state": {q.Get("state")}}.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (idp *mockIdP) token(w http.ResponseWriter, r *http.Request) {
+	clientID, secret, ok := r.BasicAuth()
+	if !ok || clientID != testOIDCClientID || secret != testOIDCClientSecret {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+		return
+	}
+	idp.mu.Lock()
+	auth, ok := idp.codes[r.PostFormValue("code")]
+	delete(idp.codes, r.PostFormValue("code"))
+	claims := map[string]interface{}{}
+	for k, v := range idp.claims {
+		claims[k] = v
+	}
+	idp.mu.Unlock()
+	if !ok || r.PostFormValue("grant_type") != "authorization_code" || r.PostFormValue("redirect_uri") != auth.Get("redirect_uri") ||
+		pkceChallenge(r.PostFormValue("code_verifier")) != auth.Get("code_challenge") {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+	claims["nonce"] = auth.Get("nonce")
+	json.NewEncoder(w).Encode(map[string]string{
+		"access_token": "access-token",
+		"token_type":   "Bearer",
+		"id_token":     idp.sign(map[string]interface{}{"alg": "RS256", "kid": idp.kid}, idp.idClaims(claims)),
+	})
+}
+
+// idClaims adds standard claims of a valid ID token to claims.
+func (idp *mockIdP) idClaims(claims map[string]interface{}) map[string]interface{} {
+	now := time.Now().Unix()
+	standard := map[string]interface{}{"iss": idp.server.URL, "aud": testOIDCClientID, "iat": now, "exp": now + 300}
+	for k, v := range claims {
+		standard[k] = v
+	}
+	return standard
+}
+
+// sign returns JWS of header and claims signed by the key of the provider.
+func (idp *mockIdP) sign(header map[string]interface{}, claims map[string]interface{}) string {
+	return signJWT(idp.t, idp.key, header, claims)
+}
+
+func signJWT(t *testing.T, key *rsa.PrivateKey, header map[string]interface{}, claims map[string]interface{}) string {
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	input := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	digest := sha256.Sum256([]byte(input))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestOIDCLogin(t *testing.T) {
+	idp := startMockIdP(t)
+	db := connectTempDB(t)
+	cfg := testDBConfig("")
+	cfg.OIDC = idp.config()
+	server := httptest.NewServer(CreateTinyURLServer(cfg, db))
+	defer server.Close()
+
+	// login follows redirects to the provider and back, and returns the status of the last response.
+	login := func(claims map[string]interface{}) (*http.Client, int) {
+		idp.login(claims)
+		jar, err := cookiejar.New(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := &http.Client{Jar: jar}
+		resp, err := client.Get(server.URL + "/oidc/login")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return client, resp.StatusCode
+	}
+	account := func(client *http.Client) Account {
+		resp, err := client.Get(server.URL + "/account")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var account Account
+		json.NewDecoder(resp.Body).Decode(&account)
+		return account
+	}
+
+	client, status := login(map[string]interface{}{"sub": "u-1", "email": "Alice@example.com", "groups": []string{"staff", "admins"}})
+	if a := account(client); status != http.StatusOK || a.Username != "alice@example.com" || a.Role != ROLE_ADMIN {
+		t.Fatalf("real: %d %+v  expected: %d alice@example.com admin\n", status, a, http.StatusOK)
+	}
+	resp, err := client.Get(server.URL + "/my/links")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("real: %d  expected: %d\n", resp.StatusCode, http.StatusOK)
+	}
+
+	// the role follows claims on every login, and the user is found by the subject even if the email is changed.
+	client, _ = login(map[string]interface{}{"sub": "u-1", "email": "alice2@example.com", "groups": "staff"})
+	if a := account(client); a.Username != "alice@example.com" || a.Role != ROLE_USER {
+		t.Fatalf("real: %+v  expected: alice@example.com user\n", a)
+	}
+	if users, _ := db.GetUsers(); len(users) != 1 {
+		t.Fatalf("real: %d  expected: 1\n", len(users))
+	}
+	if _, err := db.Authenticate("alice@example.com", ""); err != errInvalidCredentials {
+		t.Fatalf("real: %v  expected: %v\n", err, errInvalidCredentials)
+	}
+
+	if _, status = login(map[string]interface{}{"sub": "u-2", "email": "bob@example.com", "groups": []string{"guests"}}); status != http.StatusForbidden {
+		t.Fatalf("real: %d  expected: %d\n", status, http.StatusForbidden)
+	}
+	if _, err := db.AddUser("carol", "carol-password", ROLE_USER); err != nil {
+		t.Fatal(err)
+	}
+	if _, status = login(map[string]interface{}{"sub": "u-3", "email": "carol", "groups": "staff"}); status != http.StatusConflict {
+		t.Fatalf("real: %d  expected: %d\n", status, http.StatusConflict)
+	}
+}
+
+func TestOIDCCallback(t *testing.T) {
+	idp := startMockIdP(t)
+	db := connectTempDB(t)
+	cfg := testDBConfig("")
+	cfg.OIDC = idp.config()
+	server := httptest.NewServer(CreateTinyURLServer(cfg, db))
+	defer server.Close()
+	idp.login(map[string]interface{}{"sub": "u-1", "email": "alice@example.com", "groups": "admins"})
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Jar: jar, CheckRedirect: noRedirectClient.CheckRedirect}
+	resp, err := client.Get(server.URL + "/oidc/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	authURL, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || resp.StatusCode != http.StatusFound || !strings.HasPrefix(authURL.String(), idp.server.URL+"/authorize") {
+		t.Fatalf("real: %d %s  expected: %d %s/authorize\n", resp.StatusCode, authURL, http.StatusFound, idp.server.URL)
+	}
+	if redirect := authURL.Query().Get("redirect_uri"); redirect != server.URL+"/oidc/callback" {
+		t.Fatalf("real: %s  expected: %s/oidc/callback\n", redirect, server.URL)
+	}
+	resp, err = client.Get(authURL.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	callback, _ := url.Parse(resp.Header.Get("Location"))
+
+	// callbacks without the cookie of the login are rejected, so that codes of others can't be injected.
+	for _, c := range []*http.Client{noRedirectClient, {Jar: jar, CheckRedirect: noRedirectClient.CheckRedirect}} {
+		q := callback.Query()
+		q.Set("state", "wrong-state")
+		resp, err = c.Get(server.URL + "/oidc/callback?" + q.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("real: %d  expected: %d\n", resp.StatusCode, http.StatusBadRequest)
+		}
+	}
+	// the wrong state above cleared the cookie.
+	resp, err = client.Get(callback.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("real: %d  expected: %d\n", resp.StatusCode, http.StatusBadRequest)
+	}
+
+	resp, err = client.Get(server.URL + "/oidc/callback?error=access_denied")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("real: %d  expected: %d\n", resp.StatusCode, http.StatusUnauthorized)
+	}
+}
+
+func TestOIDCExchange(t *testing.T) {
+	idp := startMockIdP(t)
+	cfg := idp.config()
+	idp.login(map[string]interface{}{"sub": "u-1"})
+	client := NewOIDCClient(cfg)
+	redirectURL := "http://localhost/oidc/callback"
+
+	authorize := func(verifier string) string {
+		authURL, err := client.AuthCodeURL(redirectURL, "state", "nonce", verifier)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := noRedirectClient.Get(authURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		location, _ := url.Parse(resp.Header.Get("Location"))
+		return location.Query().Get("code")
+	}
+
+	idToken, err := client.Exchange(authorize("verifier"), redirectURL, "verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims, err := client.VerifyIDToken(idToken, "nonce"); err != nil || claims["sub"] != "u-1" {
+		t.Fatalf("real: %v %v  expected: u-1\n", claims, err)
+	}
+	if _, err := client.Exchange(authorize("verifier"), redirectURL, "another verifier"); err == nil {
+		t.Fatal("Code is exchanged by wrong PKCE verifier.")
+	}
+	secret := cfg.ClientSecret
+	cfg.ClientSecret = "wrong"
+	if _, err := client.Exchange(authorize("verifier"), redirectURL, "verifier"); err == nil {
+		t.Fatal("Code is exchanged by wrong client secret.")
+	}
+	cfg.ClientSecret = secret
+
+	// the issuer of discovery must be the one of the config.
+	wrongIssuer := *cfg
+	wrongIssuer.Issuer = idp.server.URL + "/other"
+	if _, err := NewOIDCClient(&wrongIssuer).AuthCodeURL(redirectURL, "state", "nonce", "verifier"); err == nil {
+		t.Fatal("Provider of wrong issuer is discovered.")
+	}
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	idp := startMockIdP(t)
+	client := NewOIDCClient(idp.config())
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := map[string]interface{}{"alg": "RS256", "kid": idp.kid}
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		c := idp.idClaims(map[string]interface{}{"sub": "u-1", "nonce": "nonce"})
+		for k, v := range changes {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+	hs256 := func() string {
+		h, _ := json.Marshal(map[string]interface{}{"alg": "HS256", "kid": idp.kid})
+		c, _ := json.Marshal(claims(nil))
+		input := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+		mac := hmac.New(sha256.New, []byte(testOIDCClientSecret))
+		mac.Write([]byte(input))
+		return input + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	}
+	none := func() string {
+		h, _ := json.Marshal(map[string]interface{}{"alg": "none"})
+		c, _ := json.Marshal(claims(nil))
+		return base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c) + "."
+	}
+	now := time.Now().Unix()
+
+	tests := []struct {
+		name    string
+		idToken string
+		valid   bool
+	}{
+		{"valid", idp.sign(header, claims(nil)), true},
+		{"audiences with azp", idp.sign(header, claims(map[string]interface{}{"aud": []string{"other", testOIDCClientID}, "azp": testOIDCClientID})), true},
+		{"expired in skew", idp.sign(header, claims(map[string]interface{}{"exp": now - 30})), true},
+		{"other key", signJWT(t, otherKey, header, claims(nil)), false},
+		{"unknown kid", idp.sign(map[string]interface{}{"alg": "RS256", "kid": "key-2"}, claims(nil)), false},
+		{"HS256", hs256(), false},
+		{"none", none(), false},
+		{"wrong issuer", idp.sign(header, claims(map[string]interface{}{"iss": "https://evil.example.com"})), false},
+		{"wrong audience", idp.sign(header, claims(map[string]interface{}{"aud": "other"})), false},
+		{"audiences without azp", idp.sign(header, claims(map[string]interface{}{"aud": []string{"other", testOIDCClientID}})), false},
+		{"wrong azp", idp.sign(header, claims(map[string]interface{}{"azp": "other"})), false},
+		{"expired", idp.sign(header, claims(map[string]interface{}{"exp": now - 120})), false},
+		{"no exp", idp.sign(header, claims(map[string]interface{}{"exp": nil})), false},
+		{"issued in future", idp.sign(header, claims(map[string]interface{}{"iat": now + 120})), false},
+		{"wrong nonce", idp.sign(header, claims(map[string]interface{}{"nonce": "other"})), false},
+		{"no subject", idp.sign(header, claims(map[string]interface{}{"sub": nil})), false},
+		{"tampered", strings.Replace(idp.sign(header, claims(nil)), ".", ".e30", 1), false},
+		{"not JWS", "not-a-token", false},
+	}
+	for _, test := range tests {
+		_, err := client.VerifyIDToken(test.idToken, "nonce")
+		if (err == nil) != test.valid {
+			t.Fatalf("%s real: %v  expected valid: %v\n", test.name, err, test.valid)
+		}
+	}
+}
+
+func TestOIDCRole(t *testing.T) {
+	cfg := &OIDCConfig{Issuer: "https://sso.example.com", ClientID: "tiny-url", RoleClaim: "groups",
+		Roles: map[string][]string{ROLE_ADMIN: {"admins"}, ROLE_USER: {"staff"}}}
+	if err := cfg.normalize(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		groups interface{}
+		role   string
+		ok     bool
+	}{
+		{[]interface{}{"staff", "admins"}, ROLE_ADMIN, true},
+		{"staff", ROLE_USER, true},
+		{[]interface{}{"guests"}, "", false},
+		{nil, "", false},
+	}
+	for _, test := range tests {
+		if role, ok := cfg.role(map[string]interface{}{"groups": test.groups}); role != test.role || ok != test.ok {
+			t.Fatalf("%v real: %s %v  expected: %s %v\n", test.groups, role, ok, test.role, test.ok)
+		}
+	}
+	delete(cfg.Roles, ROLE_USER)
+	if role, ok := cfg.role(map[string]interface{}{}); role != ROLE_USER || !ok {
+		t.Fatalf("real: %s %v  expected: user true\n", role, ok)
+	}
+
+	invalids := []*OIDCConfig{
+		{Issuer: "sso.example.com", ClientID: "tiny-url"},
+		{Issuer: "https://sso.example.com"},
+		{Issuer: "https://sso.example.com", ClientID: "tiny-url", Scopes: []string{"email"}},
+		{Issuer: "https://sso.example.com", ClientID: "tiny-url", RoleClaim: "groups", Roles: map[string][]string{"owner": {"x"}}},
+		{Issuer: "https://sso.example.com", ClientID: "tiny-url", Roles: map[string][]string{ROLE_ADMIN: {"x"}}},
+	}
+	for _, invalid := range invalids {
+		if err := invalid.normalize(); err == nil {
+			t.Fatalf("%+v is valid.\n", invalid)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const MAX_PASSWORD_LENGTH int = 72 // bcrypt ignores bytes after 72.
+
+func HashPassword(password string) (string, error) {
+	if password == "" || len(password) > MAX_PASSWORD_LENGTH {
+		return "", errors.New("Password must be 1-72 bytes.")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func CheckPassword(hash string, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// isPasswordHash reports whether hash looks like a bcrypt hash, used to validate imported links.
+func isPasswordHash(hash string) bool {
+	_, err := bcrypt.Cost([]byte(hash))
+	return err == nil && strings.HasPrefix(hash, "$2")
+}
+
+// AttemptLimiter throttles failed attempts per key. After max failures within window,
+// the key is locked until window has passed since the first failure.
+// An attempt is counted as a failure when it is allowed, so that concurrent attempts can't exceed max.
+type AttemptLimiter struct {
+	mu       sync.Mutex
+	max      int
+	window   time.Duration
+	attempts map[string]*attemptRecord
+}
+
+type attemptRecord struct {
+	failures int
+	since    time.Time
+}
+
+func NewAttemptLimiter(max int, window time.Duration) *AttemptLimiter {
+	return &AttemptLimiter{max: max, window: window, attempts: map[string]*attemptRecord{}}
+}
+
+// Allow reserves an attempt of key and reports whether it is allowed. The attempt is a failure unless Reset or Release is called.
+// If not allowed, retryAfter is the time until the lock is released.
+func (l *AttemptLimiter) Allow(key string) (ok bool, retryAfter time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	a, exist := l.attempts[key]
+	if !exist || time.Since(a.since) >= l.window {
+		a = &attemptRecord{since: time.Now()}
+		l.attempts[key] = a
+		l.cleanup()
+	}
+	if a.failures >= l.max {
+		return false, l.window - time.Since(a.since)
+	}
+	a.failures++
+	return true, 0
+}
+
+// Release cancels an attempt of key which is neither failed nor succeeded (e.g. by an internal error).
+func (l *AttemptLimiter) Release(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if a, exist := l.attempts[key]; exist && a.failures > 0 {
+		a.failures--
+	}
+}
+
+// Reset forgets failures of key after a successful attempt.
+func (l *AttemptLimiter) Reset(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.attempts, key)
+}
+
+// cleanup removes expired records so that the map doesn't grow forever.
+func (l *AttemptLimiter) cleanup() {
+	for key, a := range l.attempts {
+		if time.Since(a.since) >= l.window {
+			delete(l.attempts, key)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHashPassword(t *testing.T) {
+	hash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isPasswordHash(hash) {
+		t.Fatalf("%s is expected to be bcrypt hash\n", hash)
+	}
+	if !CheckPassword(hash, "secret") || CheckPassword(hash, "wrong") {
+		t.Fatal("only the correct password is expected to match")
+	}
+	if _, err = HashPassword(""); err == nil {
+		t.Fatal("empty password is expected to be invalid")
+	}
+}
+
+func TestAttemptLimiter(t *testing.T) {
+	l := NewAttemptLimiter(2, 50*time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Allow("a"); !ok {
+			t.Fatalf("attempt %d is expected to be allowed\n", i+1)
+		}
+	}
+	if ok, retryAfter := l.Allow("a"); ok || retryAfter <= 0 {
+		t.Fatalf("real: %v, %v  expected: locked\n", ok, retryAfter)
+	}
+	// other keys are not affected.
+	if ok, _ := l.Allow("b"); !ok {
+		t.Fatal("b is expected to be allowed")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if ok, _ := l.Allow("a"); !ok {
+		t.Fatal("lock is expected to be released after the window")
+	}
+}
+
+func TestConcurrentAttempts(t *testing.T) {
+	l := NewAttemptLimiter(3, time.Minute)
+	// attempts at the same time are reserved before their passwords are checked.
+	const attempts = 20
+	var wg sync.WaitGroup
+	var allowed int32
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ok, _ := l.Allow("a"); ok {
+				atomic.AddInt32(&allowed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if allowed != 3 {
+		t.Fatalf("real: %d  expected: 3\n", allowed)
+	}
+
+	l.Release("a")
+	if ok, _ := l.Allow("a"); !ok {
+		t.Fatal("released attempt is expected to be allowed again")
+	}
+	l.Reset("a")
+	if ok, _ := l.Allow("a"); !ok {
+		t.Fatal("attempt is expected to be allowed after reset")
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var validBasePath = regexp.MustCompile(`^(/[A-Za-z0-9._~-]+)*$`)
+var validForwardedHost = regexp.MustCompile(`^[A-Za-z0-9.-]+(:[0-9]+)?$|^\[[0-9A-Fa-f:.]+\](:[0-9]+)?$`)
+
+// normalizePublicBaseURL validates PublicBaseURL and removes the trailing "/" of its path.
+func normalizePublicBaseURL(s string) (string, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", errors.New(fmt.Sprintf("scheme '%s' is not http or https", u.Scheme))
+	}
+	if u.Host == "" || u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return "", errors.New("URL must have only scheme, host and path")
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	if !validBasePath.MatchString(u.Path) {
+		return "", errors.New(fmt.Sprintf("path '%s' is invalid (valid: alphanumeric, '.', '_', '~' and '-' separated by '/')", u.Path))
+	}
+	u.RawPath = ""
+	return u.String(), nil
+}
+
+// parseTrustedProxy parses an IP address or CIDR of TrustedProxies.
+func parseTrustedProxy(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, ipNet, err := net.ParseCIDR(s)
+		return ipNet, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, errors.New(fmt.Sprintf("'%s' is not IP address or CIDR", s))
+	}
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// parseTrustedProxies parses IP addresses and CIDRs of TrustedProxies.
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	var ipNets []*net.IPNet
+	for _, proxy := range proxies {
+		ipNet, invalid := parseTrustedProxy(proxy)
+		if invalid != nil {
+			return nil, errors.New(fmt.Sprintf("Trusted proxy '%s' is invalid (valid: IP address or CIDR)\n", proxy))
+		}
+		ipNets = append(ipNets, ipNet)
+	}
+	return ipNets, nil
+}
+
+// fromTrustedProxy reports whether r is sent by one of TrustedProxies.
+func (cfg *Config) fromTrustedProxy(r *http.Request) bool {
+	if len(cfg.trustedProxies) == 0 {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range cfg.trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedHeader returns the last value of X-Forwarded-* header of r, which is the one the trusted proxy appended.
+// Values before it are sent by the client and can be forged. Headers are ignored unless r is sent by a trusted proxy.
+func forwardedHeader(cfg *Config, r *http.Request, name string) string {
+	if !cfg.fromTrustedProxy(r) {
+		return ""
+	}
+	values := r.Header.Values(name)
+	if len(values) == 0 {
+		return ""
+	}
+	value := values[len(values)-1]
+	if i := strings.LastIndex(value, ","); i >= 0 {
+		value = value[i+1:]
+	}
+	return strings.TrimSpace(value)
+}
+
+// clientIP returns the IP address of the client sent r. X-Forwarded-For is used only from trusted proxies.
+func clientIP(cfg *Config, r *http.Request) string {
+	if ip := net.ParseIP(forwardedHeader(cfg, r, "X-Forwarded-For")); ip != nil {
+		return ip.String()
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// requestHost returns the host the client sent r to. X-Forwarded-Host is used only from trusted proxies.
+func requestHost(cfg *Config, r *http.Request) string {
+	if host := forwardedHeader(cfg, r, "X-Forwarded-Host"); validForwardedHost.MatchString(host) {
+		return host
+	}
+	return r.Host
+}
+
+// baseURL returns the URL tiny paths on d are appended to. Without PublicBaseURL, it is built from the request,
+// and X-Forwarded-Proto is used only from trusted proxies.
+func (cfg *Config) baseURL(d *Domain, host string, r *http.Request) string {
+	if cfg.PublicBaseURL != "" {
+		if len(cfg.Domains) == 0 {
+			return cfg.PublicBaseURL
+		}
+		return d.Protocol + "://" + d.Host + cfg.basePath()
+	}
+	protocol := strings.ToLower(forwardedHeader(cfg, r, "X-Forwarded-Proto"))
+	if protocol != "http" && protocol != "https" {
+		protocol = d.Protocol
+	}
+	return protocol + "://" + host
+}
+
+// basePath returns the path of PublicBaseURL all paths are served under. It is empty for the root.
+func (cfg *Config) basePath() string {
+	if cfg.PublicBaseURL == "" {
+		return ""
+	}
+	u, err := url.Parse(cfg.PublicBaseURL)
+	if err != nil {
+		return ""
+	}
+	return u.Path
+}
+
+// publicProtocol is the protocol of tiny URLs on domains without their own protocol.
+func (cfg *Config) publicProtocol() string {
+	if cfg.PublicBaseURL != "" {
+		if u, err := url.Parse(cfg.PublicBaseURL); err == nil {
+			return u.Scheme
+		}
+	}
+	return cfg.Protocol
+}
+
+// withBasePath serves h under prefix with prefix removed from request paths. Requests out of prefix get 404.
+func withBasePath(prefix string, h http.Handler) http.Handler {
+	if prefix == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := strings.TrimPrefix(r.URL.Path, prefix)
+		if len(p) == len(r.URL.Path) || (p != "" && p[0] != '/') {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(fmt.Sprintf("'%s' is not found.\n", r.RequestURI)))
+			return
+		}
+		if p == "" {
+			p = "/"
+		}
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = p
+		// prefix has no characters escaped, so it is the same in the escaped path.
+		if r.URL.RawPath != "" {
+			r2.URL.RawPath = strings.TrimPrefix(r.URL.RawPath, prefix)
+		}
+		h.ServeHTTP(w, r2)
+	})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestNormalizePublicBaseURL(t *testing.T) {
+	tests := []struct {
+		url      string
+		expected string
+		valid    bool
+	}{
+		{"https://example.com", "https://example.com", true},
+		{"https://example.com/", "https://example.com", true},
+		{"http://example.com:8080/s/", "http://example.com:8080/s", true},
+		{"https://example.com/a/b", "https://example.com/a/b", true},
+		{"ftp://example.com", "", false},
+		{"example.com/s", "", false},
+		{"https://example.com/s?q=1", "", false},
+		{"https://user@example.com", "", false},
+		{"https://example.com/a%20b", "", false},
+		{"https://example.com//s", "", false},
+	}
+	for _, test := range tests {
+		real, err := normalizePublicBaseURL(test.url)
+		if (err == nil) != test.valid || real != test.expected {
+			t.Fatalf("%s real: %s %v  expected: %s %v\n", test.url, real, err, test.expected, test.valid)
+		}
+	}
+}
+
+func TestRequestHost(t *testing.T) {
+	trustedProxies, err := parseTrustedProxies([]string{"10.0.0.1", "192.168.0.0/16", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{trustedProxies: trustedProxies}
+	tests := []struct {
+		remoteAddr string
+		forwarded  string
+		expected   string
+	}{
+		{"10.0.0.1:1234", "public.example", "public.example"},
+		// the value appended by the trusted proxy is used, not the one the client forged.
+		{"192.168.3.4:1234", "evil.example, public.example:8443", "public.example:8443"},
+		{"[::1]:1234", "public.example", "public.example"},
+		{"10.0.0.2:1234", "public.example", "internal:8080"},
+		{"10.0.0.1:1234", "", "internal:8080"},
+		{"10.0.0.1:1234", "evil.example/path", "internal:8080"},
+	}
+	for _, test := range tests {
+		r, err := http.NewRequest("GET", "http://internal:8080/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.RemoteAddr = test.remoteAddr
+		if test.forwarded != "" {
+			r.Header.Set("X-Forwarded-Host", test.forwarded)
+		}
+		if real := requestHost(cfg, r); real != test.expected {
+			t.Fatalf("%s %s real: %s  expected: %s\n", test.remoteAddr, test.forwarded, real, test.expected)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trustedProxies, err := parseTrustedProxies([]string{"10.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{trustedProxies: trustedProxies}
+	tests := []struct {
+		remoteAddr string
+		forwarded  string
+		expected   string
+	}{
+		{"10.0.0.1:1234", "203.0.113.1", "203.0.113.1"},
+		// the address appended by the trusted proxy is used, not the one the client forged.
+		{"10.0.0.1:1234", "198.51.100.1, 203.0.113.1", "203.0.113.1"},
+		{"10.0.0.2:1234", "203.0.113.1", "10.0.0.2"},
+		{"10.0.0.1:1234", "", "10.0.0.1"},
+		{"10.0.0.1:1234", "unknown", "10.0.0.1"},
+		{"[2001:db8::1]:1234", "", "2001:db8::1"},
+	}
+	for _, test := range tests {
+		r, err := http.NewRequest("POST", "http://internal:8080/login", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.RemoteAddr = test.remoteAddr
+		if test.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		if real := clientIP(cfg, r); real != test.expected {
+			t.Fatalf("%s %s real: %s  expected: %s\n", test.remoteAddr, test.forwarded, real, test.expected)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/skip2/go-qrcode"
+)
+
+const DEFAULT_QR_SIZE int = 256
+const MAX_QR_SIZE int = 2048
+const DEFAULT_QR_MARGIN int = 4
+const MAX_QR_MARGIN int = 32
+const DEFAULT_QR_LEVEL string = "M"
+
+var QR_LEVEL = map[string]qrcode.RecoveryLevel{
+	"L": qrcode.Low,
+	"M": qrcode.Medium,
+	"Q": qrcode.High,
+	"H": qrcode.Highest,
+}
+
+type QROptions struct {
+	// Size is width and height of the image in pixels.
+	Size int
+	// Margin is the quiet zone around the code in modules.
+	Margin int
+	Level  qrcode.RecoveryLevel
+}
+
+// ParseQROptions reads "size", "margin" and "level" query parameters.
+func ParseQROptions(q url.Values) (*QROptions, error) {
+	opt := &QROptions{Size: DEFAULT_QR_SIZE, Margin: DEFAULT_QR_MARGIN, Level: QR_LEVEL[DEFAULT_QR_LEVEL]}
+	var err error
+	if s := q.Get("size"); s != "" {
+		if opt.Size, err = strconv.Atoi(s); err != nil || opt.Size < 1 || opt.Size > MAX_QR_SIZE {
+			return nil, errors.New(fmt.Sprintf("'size' must be 1-%d.", MAX_QR_SIZE))
+		}
+	}
+	if s := q.Get("margin"); s != "" {
+		if opt.Margin, err = strconv.Atoi(s); err != nil || opt.Margin < 0 || opt.Margin > MAX_QR_MARGIN {
+			return nil, errors.New(fmt.Sprintf("'margin' must be 0-%d.", MAX_QR_MARGIN))
+		}
+	}
+	if s := q.Get("level"); s != "" {
+		level, ok := QR_LEVEL[strings.ToUpper(s)]
+		if !ok {
+			return nil, errors.New("'level' must be L, M, Q or H.")
+		}
+		opt.Level = level
+	}
+	return opt, nil
+}
+
+// qrBitmap returns modules of QR code of content surrounded by opt.Margin. bitmap[y][x] is true if the module is dark.
+func qrBitmap(content string, opt *QROptions) ([][]bool, error) {
+	q, err := qrcode.New(content, opt.Level)
+	if err != nil {
+		return nil, err
+	}
+	q.DisableBorder = true
+	code := q.Bitmap()
+
+	n := len(code) + opt.Margin*2
+	bitmap := make([][]bool, n)
+	for y := range bitmap {
+		bitmap[y] = make([]bool, n)
+		if y < opt.Margin || y >= opt.Margin+len(code) {
+			continue
+		}
+		copy(bitmap[y][opt.Margin:], code[y-opt.Margin])
+	}
+	return bitmap, nil
+}
+
+// WriteQRPNG writes QR code of content as opt.Size x opt.Size PNG.
+// If the size is smaller than the number of modules, each module is 1 pixel.
+func WriteQRPNG(w io.Writer, content string, opt *QROptions) error {
+	bitmap, err := qrBitmap(content, opt)
+	if err != nil {
+		return err
+	}
+	n := len(bitmap)
+	scale := opt.Size / n
+	size := opt.Size
+	if scale < 1 {
+		scale = 1
+		size = n
+	}
+	// the remainder is added to the quiet zone.
+	offset := (size - n*scale) / 2
+
+	img := image.NewPaletted(image.Rect(0, 0, size, size), color.Palette{color.White, color.Black})
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if !dark {
+				continue
+			}
+			for dy := 0; dy < scale; dy++ {
+				for dx := 0; dx < scale; dx++ {
+					img.SetColorIndex(offset+x*scale+dx, offset+y*scale+dy, 1)
+				}
+			}
+		}
+	}
+	return png.Encode(w, img)
+}
+
+// WriteQRSVG writes QR code of content as SVG whose width and height are opt.Size.
+func WriteQRSVG(w io.Writer, content string, opt *QROptions) error {
+	bitmap, err := qrBitmap(content, opt)
+	if err != nil {
+		return err
+	}
+	n := len(bitmap)
+
+	// horizontal runs of dark modules are drawn as a rectangle.
+	var path strings.Builder
+	for y, row := range bitmap {
+		for x := 0; x < n; x++ {
+			if !row[x] {
+				continue
+			}
+			start := x
+			for x < n && row[x] {
+				x++
+			}
+			fmt.Fprintf(&path, "M%d %dh%dv1h-%dz", start, y, x-start, x-start)
+		}
+	}
+
+	_, err = fmt.Fprintf(w, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`+
+		`<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="%s"/></svg>`,
+		opt.Size, opt.Size, n, n, n, n, path.String())
+	return err
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"image/png"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestWriteQRPNG(t *testing.T) {
+	opt, err := ParseQROptions(url.Values{"size": {"200"}, "margin": {"2"}, "level": {"h"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err = WriteQRPNG(&buf, "http://localhost/AbCdE12345", opt); err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 200 || b.Dy() != 200 {
+		t.Fatalf("real: %v  expected: 200x200\n", b)
+	}
+	// the corner is in the quiet zone, and the finder pattern starts after the margin.
+	if r, _, _, _ := img.At(0, 0).RGBA(); r == 0 {
+		t.Fatal("quiet zone is expected to be white")
+	}
+}
+
+func TestWriteQRSVG(t *testing.T) {
+	opt, err := ParseQROptions(url.Values{"margin": {"0"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err = WriteQRSVG(&buf, "http://localhost/AbCdE12345", opt); err != nil {
+		t.Fatal(err)
+	}
+	svg := buf.String()
+	// version 2 QR code has 25x25 modules, and top-left module is dark without margin.
+	if !strings.HasPrefix(svg, "<svg") || !strings.Contains(svg, `viewBox="0 0 25 25"`) || !strings.Contains(svg, `d="M0 0h7v1h-7z`) {
+		t.Fatalf("unexpected svg: %s\n", svg)
+	}
+}
+
+func TestParseQROptions(t *testing.T) {
+	for _, q := range []url.Values{
+		{"size": {"0"}},
+		{"size": {"abc"}},
+		{"margin": {"-1"}},
+		{"level": {"X"}},
+	} {
+		if _, err := ParseQROptions(q); err == nil {
+			t.Fatalf("%v is expected to be invalid\n", q)
+		}
+	}
+}
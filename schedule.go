@@ -0,0 +1,174 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const SQL_CREATE_LINK_SCHEDULE = `
+	create table link_schedule (
+		id integer primary key autoincrement,
+		link_id integer not null,
+		start_at datetime not null,
+		origin text not null
+	);
+	create index link_schedule_link_id on link_schedule(link_id, start_at);
+`
+
+const MAX_SCHEDULE_ENTRIES int = 64
+
+// ScheduleEntry makes the link redirect to Origin from StartAt until the next entry starts.
+type ScheduleEntry struct {
+	StartAt time.Time `json:"StartAt"`
+	Origin  string    `json:"Origin"`
+}
+
+// NormalizeSchedule validates entries and sorts them by start time.
+func NormalizeSchedule(schedule []*ScheduleEntry) error {
+	if len(schedule) > MAX_SCHEDULE_ENTRIES {
+		return errors.New(fmt.Sprintf("a link can have up to %d schedule entries", MAX_SCHEDULE_ENTRIES))
+	}
+	for i, entry := range schedule {
+		if entry == nil {
+			return errors.New(fmt.Sprintf("schedule entry %d is null", i))
+		}
+		if entry.StartAt.IsZero() {
+			return errors.New(fmt.Sprintf("schedule entry %d has no start time", i))
+		}
+		entry.StartAt = entry.StartAt.UTC()
+		origin, err := normalizeOrigin(entry.Origin)
+		if err != nil {
+			return err
+		}
+		entry.Origin = origin
+	}
+	sort.SliceStable(schedule, func(i, j int) bool { return schedule[i].StartAt.Before(schedule[j].StartAt) })
+	for i := 1; i < len(schedule); i++ {
+		if schedule[i].StartAt.Equal(schedule[i-1].StartAt) {
+			return errors.New(fmt.Sprintf("start time '%s' of schedule is duplicated", schedule[i].StartAt.Format(time.RFC3339)))
+		}
+	}
+	return nil
+}
+
+// scheduledOrigin returns the origin of link at now. Links without schedule always use their origin.
+// active is false before the first entry starts, and then startAt is the time the link becomes active.
+func (link *Link) scheduledOrigin(now time.Time) (origin string, active bool, startAt time.Time) {
+	if len(link.Schedule) == 0 {
+		return link.Origin, true, time.Time{}
+	}
+	if now.Before(link.Schedule[0].StartAt) {
+		return "", false, link.Schedule[0].StartAt
+	}
+	origin = link.Schedule[0].Origin
+	for _, entry := range link.Schedule[1:] {
+		if now.Before(entry.StartAt) {
+			break
+		}
+		origin = entry.Origin
+	}
+	return origin, true, time.Time{}
+}
+
+func getSchedule(q queryer, linkID int64) ([]*ScheduleEntry, error) {
+	rows, err := q.Query("SELECT start_at, origin FROM link_schedule WHERE link_id = ? ORDER BY start_at", linkID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var schedule []*ScheduleEntry
+	for rows.Next() {
+		entry := &ScheduleEntry{}
+		if err := rows.Scan(&entry.StartAt, &entry.Origin); err != nil {
+			return nil, err
+		}
+		schedule = append(schedule, entry)
+	}
+	return schedule, rows.Err()
+}
+
+// getAllSchedules returns schedules of all links by link ID.
+func getAllSchedules(q queryer) (map[int64][]*ScheduleEntry, error) {
+	rows, err := q.Query("SELECT link_id, start_at, origin FROM link_schedule ORDER BY link_id, start_at")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	schedules := map[int64][]*ScheduleEntry{}
+	for rows.Next() {
+		var linkID int64
+		entry := &ScheduleEntry{}
+		if err := rows.Scan(&linkID, &entry.StartAt, &entry.Origin); err != nil {
+			return nil, err
+		}
+		schedules[linkID] = append(schedules[linkID], entry)
+	}
+	return schedules, rows.Err()
+}
+
+// insertScheduleTx inserts schedule of the link of linkID.
+func insertScheduleTx(tx *sql.Tx, linkID int64, schedule []*ScheduleEntry) error {
+	for _, entry := range schedule {
+		if _, err := tx.Exec("INSERT INTO link_schedule (link_id, start_at, origin) VALUES (?, ?, ?)", linkID, entry.StartAt, entry.Origin); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetSchedule replaces the schedule of the link. Empty schedule makes the link always redirect to its origin.
+func (db *DB) SetSchedule(domain string, tiny string, actor string, schedule []*ScheduleEntry) (*Link, error) {
+	if err := NormalizeSchedule(schedule); err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	before, err := getLinkTx(tx, "domain = ? AND tiny = ?", domain, tiny)
+	if err != nil {
+		return nil, err
+	}
+	if before == nil {
+		err = errLinkNotFound
+		return nil, err
+	}
+	if before.Schedule, err = getSchedule(tx, before.ID); err != nil {
+		return nil, err
+	}
+
+	if _, err = tx.Exec("DELETE FROM link_schedule WHERE link_id = ?", before.ID); err != nil {
+		return nil, err
+	}
+	if err = insertScheduleTx(tx, before.ID, schedule); err != nil {
+		return nil, err
+	}
+
+	after := *before
+	after.Schedule = schedule
+	if err = resetHealthTx(tx, &after); err != nil {
+		return nil, err
+	}
+	if err = db.writeChange(tx, actor, AUDIT_UPDATE, tiny, before, &after); err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	db.committed(&after)
+
+	Infof("Schedule of URL is updated. tiny:'%s' entries:%d by %s\n", tiny, len(schedule), actor)
+	return &after, nil
+}
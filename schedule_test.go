@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduledOrigin(t *testing.T) {
+	launch := time.Date(2021, 11, 26, 0, 0, 0, 0, time.UTC)
+	end := launch.Add(72 * time.Hour)
+	link := &Link{Origin: "https://example.com/", Schedule: []*ScheduleEntry{
+		{StartAt: end, Origin: "https://example.com/sale-ended"},
+		{StartAt: launch, Origin: "https://example.com/sale"},
+	}}
+	if err := NormalizeSchedule(link.Schedule); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, active, startAt := link.scheduledOrigin(launch.Add(-time.Second)); active || !startAt.Equal(launch) {
+		t.Fatalf("real: %v %v  expected: inactive until %v\n", active, startAt, launch)
+	}
+	tests := map[time.Time]string{
+		launch:                        "https://example.com/sale",
+		end.Add(-time.Second):         "https://example.com/sale",
+		end:                           "https://example.com/sale-ended",
+		end.Add(365 * 24 * time.Hour): "https://example.com/sale-ended",
+	}
+	for now, expected := range tests {
+		if origin, active, _ := link.scheduledOrigin(now); !active || origin != expected {
+			t.Fatalf("%v real: %s %v  expected: %s\n", now, origin, active, expected)
+		}
+	}
+
+	if origin, active, _ := (&Link{Origin: "https://example.com/"}).scheduledOrigin(launch); !active || origin != "https://example.com/" {
+		t.Fatalf("real: %s %v  expected: origin of the link\n", origin, active)
+	}
+
+	duplicated := []*ScheduleEntry{{StartAt: launch, Origin: "https://example.com/a"}, {StartAt: launch, Origin: "https://example.com/b"}}
+	if err := NormalizeSchedule(duplicated); err == nil {
+		t.Fatal("duplicated start time is expected to be invalid")
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const SQL_CREATE_LINK_TARGETS = `
+	create table link_targets (
+		id integer primary key autoincrement,
+		link_id integer not null,
+		position integer not null,
+		kind text not null,
+		match text not null,
+		origin text not null,
+		hits integer not null default 0
+	);
+	create index link_targets_link_id on link_targets(link_id, position);
+`
+
+const TARGET_DEVICE string = "device"
+const TARGET_LANGUAGE string = "language"
+const MAX_TARGETS int = 32
+
+// DEVICES maps a device of targeting rules to the function detecting it by User-Agent.
+var DEVICES = map[string]func(ua string) bool{
+	"ios":     isIOS,
+	"android": isAndroid,
+	"mobile":  isMobile,
+	"desktop": func(ua string) bool { return !isMobile(ua) },
+}
+
+func isIOS(ua string) bool {
+	return strings.Contains(ua, "iPhone") || strings.Contains(ua, "iPad") || strings.Contains(ua, "iPod")
+}
+
+func isAndroid(ua string) bool {
+	return strings.Contains(ua, "Android")
+}
+
+func isMobile(ua string) bool {
+	return isIOS(ua) || isAndroid(ua) || strings.Contains(ua, "Mobile")
+}
+
+var validLanguage = regexp.MustCompile(`^[a-zA-Z]{1,8}(-[a-zA-Z0-9]{1,8})*$`)
+
+// LinkTarget is a targeting rule of a link. Visitors matching the rule are sent to its origin instead of the link's.
+type LinkTarget struct {
+	ID int64 `json:"-"`
+	// Kind is "device" or "language".
+	Kind string `json:"Kind"`
+	// Match is a device (ios, android, mobile, desktop) or a language tag (e.g. "de" matches "de-AT").
+	Match  string `json:"Match"`
+	Origin string `json:"Origin"`
+	// Hits is the number of redirects by the rule.
+	Hits int64 `json:"Hits"`
+}
+
+func NormalizeTarget(target *LinkTarget) error {
+	target.Kind = strings.ToLower(strings.TrimSpace(target.Kind))
+	target.Match = strings.TrimSpace(target.Match)
+	switch target.Kind {
+	case TARGET_DEVICE:
+		target.Match = strings.ToLower(target.Match)
+		if _, ok := DEVICES[target.Match]; !ok {
+			return errors.New(fmt.Sprintf("device '%s' is invalid (valid: ios,android,mobile,desktop)", target.Match))
+		}
+	case TARGET_LANGUAGE:
+		if !validLanguage.MatchString(target.Match) {
+			return errors.New(fmt.Sprintf("language '%s' is invalid", target.Match))
+		}
+	default:
+		return errors.New(fmt.Sprintf("kind '%s' is invalid (valid: device,language)", target.Kind))
+	}
+	origin, err := normalizeOrigin(target.Origin)
+	if err != nil {
+		return err
+	}
+	target.Origin = origin
+	return nil
+}
+
+// Matches reports whether the visitor of r matches the rule.
+func (target *LinkTarget) Matches(r *http.Request) bool {
+	switch target.Kind {
+	case TARGET_DEVICE:
+		detect, ok := DEVICES[target.Match]
+		return ok && detect(r.UserAgent())
+	case TARGET_LANGUAGE:
+		lang := preferredLanguage(r.Header.Get("Accept-Language"))
+		return strings.EqualFold(lang, target.Match) || strings.HasPrefix(strings.ToLower(lang), strings.ToLower(target.Match)+"-")
+	}
+	return false
+}
+
+// preferredLanguage returns the language of the highest quality in Accept-Language header.
+func preferredLanguage(header string) string {
+	var lang string
+	best := 0.0
+	for _, part := range strings.Split(header, ",") {
+		tag := strings.TrimSpace(part)
+		q := 1.0
+		if i := strings.Index(tag, ";"); i >= 0 {
+			param := strings.TrimSpace(tag[i+1:])
+			tag = strings.TrimSpace(tag[:i])
+			if strings.HasPrefix(param, "q=") {
+				var err error
+				if q, err = strconv.ParseFloat(param[2:], 64); err != nil {
+					continue
+				}
+			}
+		}
+		if tag == "" || tag == "*" {
+			continue
+		}
+		if q > best {
+			lang, best = tag, q
+		}
+	}
+	return lang
+}
+
+// selectTarget returns the first rule of link matching r. nil means no rule matches and the link's origin is used.
+func (link *Link) selectTarget(r *http.Request) *LinkTarget {
+	for _, target := range link.Targets {
+		if target.Matches(r) {
+			return target
+		}
+	}
+	return nil
+}
+
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func getTargets(q queryer, linkID int64) ([]*LinkTarget, error) {
+	rows, err := q.Query("SELECT id, kind, match, origin, hits FROM link_targets WHERE link_id = ? ORDER BY position", linkID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var targets []*LinkTarget
+	for rows.Next() {
+		target := &LinkTarget{}
+		if err := rows.Scan(&target.ID, &target.Kind, &target.Match, &target.Origin, &target.Hits); err != nil {
+			return nil, err
+		}
+		targets = append(targets, target)
+	}
+	return targets, rows.Err()
+}
+
+// getAllTargets returns targets of all links by link ID.
+func getAllTargets(q queryer) (map[int64][]*LinkTarget, error) {
+	rows, err := q.Query("SELECT link_id, id, kind, match, origin, hits FROM link_targets ORDER BY link_id, position")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	targets := map[int64][]*LinkTarget{}
+	for rows.Next() {
+		var linkID int64
+		target := &LinkTarget{}
+		if err := rows.Scan(&linkID, &target.ID, &target.Kind, &target.Match, &target.Origin, &target.Hits); err != nil {
+			return nil, err
+		}
+		targets[linkID] = append(targets[linkID], target)
+	}
+	return targets, rows.Err()
+}
+
+// insertTargetsTx inserts targets of the link of linkID in order.
+func insertTargetsTx(tx *sql.Tx, linkID int64, targets []*LinkTarget) error {
+	for i, target := range targets {
+		result, err := tx.Exec("INSERT INTO link_targets (link_id, position, kind, match, origin, hits) VALUES (?, ?, ?, ?, ?, ?)",
+			linkID, i, target.Kind, target.Match, target.Origin, target.Hits)
+		if err != nil {
+			return err
+		}
+		if target.ID, err = result.LastInsertId(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func NormalizeTargets(targets []*LinkTarget) error {
+	if len(targets) > MAX_TARGETS {
+		return errors.New(fmt.Sprintf("a link can have up to %d targets", MAX_TARGETS))
+	}
+	for i, target := range targets {
+		if target == nil {
+			return errors.New(fmt.Sprintf("target %d is null", i))
+		}
+		if err := NormalizeTarget(target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetTargets replaces the targeting rules of the link. Hits of rules not changed are kept.
+func (db *DB) SetTargets(domain string, tiny string, actor string, targets []*LinkTarget) (*Link, error) {
+	if err := NormalizeTargets(targets); err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	restoreClicks := func() {}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			restoreClicks()
+		}
+	}()
+	// counted hits of targets are written before their rows are replaced with new ids.
+	if restoreClicks, err = db.flushClicksTx(tx); err != nil {
+		return nil, err
+	}
+
+	before, err := getLinkTx(tx, "domain = ? AND tiny = ?", domain, tiny)
+	if err != nil {
+		return nil, err
+	}
+	if before == nil {
+		err = errLinkNotFound
+		return nil, err
+	}
+	if before.Targets, err = getTargets(tx, before.ID); err != nil {
+		return nil, err
+	}
+	hits := map[LinkTarget]int64{}
+	for _, target := range before.Targets {
+		hits[LinkTarget{Kind: target.Kind, Match: target.Match, Origin: target.Origin}] = target.Hits
+	}
+
+	if _, err = tx.Exec("DELETE FROM link_targets WHERE link_id = ?", before.ID); err != nil {
+		return nil, err
+	}
+	for _, target := range targets {
+		target.Hits = hits[LinkTarget{Kind: target.Kind, Match: target.Match, Origin: target.Origin}]
+	}
+	if err = insertTargetsTx(tx, before.ID, targets); err != nil {
+		return nil, err
+	}
+
+	after := *before
+	after.Targets = targets
+	if err = resetHealthTx(tx, &after); err != nil {
+		return nil, err
+	}
+	if err = db.writeChange(tx, actor, AUDIT_UPDATE, tiny, before, &after); err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	db.committed(&after)
+
+	Infof("Targets of URL are updated. tiny:'%s' targets:%d by %s\n", tiny, len(targets), actor)
+	return &after, nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestPreferredLanguage(t *testing.T) {
+	tests := map[string]string{
+		"":                             "",
+		"de-DE":                        "de-DE",
+		"en-US,en;q=0.9,de;q=0.8":      "en-US",
+		"fr;q=0.5, de-AT;q=0.9, *;q=1": "de-AT",
+		"ja;q=0, en;q=0.1":             "en",
+		"de;q=invalid, it":             "it",
+	}
+	for header, expected := range tests {
+		if real := preferredLanguage(header); real != expected {
+			t.Fatalf("%s real: %s  expected: %s\n", header, real, expected)
+		}
+	}
+}
+
+func TestTargetMatches(t *testing.T) {
+	iphone := "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 Mobile/15E148"
+	android := "Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 Chrome/120.0 Mobile Safari/537.36"
+	desktop := "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 Chrome/120.0 Safari/537.36"
+	tests := []struct {
+		target   LinkTarget
+		ua       string
+		lang     string
+		expected bool
+	}{
+		{LinkTarget{Kind: TARGET_DEVICE, Match: "ios"}, iphone, "", true},
+		{LinkTarget{Kind: TARGET_DEVICE, Match: "ios"}, android, "", false},
+		{LinkTarget{Kind: TARGET_DEVICE, Match: "android"}, android, "", true},
+		{LinkTarget{Kind: TARGET_DEVICE, Match: "mobile"}, iphone, "", true},
+		{LinkTarget{Kind: TARGET_DEVICE, Match: "desktop"}, desktop, "", true},
+		{LinkTarget{Kind: TARGET_DEVICE, Match: "desktop"}, android, "", false},
+		{LinkTarget{Kind: TARGET_LANGUAGE, Match: "de"}, desktop, "de-AT,en;q=0.5", true},
+		{LinkTarget{Kind: TARGET_LANGUAGE, Match: "de"}, desktop, "en,de;q=0.5", false},
+		{LinkTarget{Kind: TARGET_LANGUAGE, Match: "pt-BR"}, desktop, "pt-br", true},
+		{LinkTarget{Kind: TARGET_LANGUAGE, Match: "de"}, desktop, "dex", false},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.Header.Set("User-Agent", test.ua)
+		r.Header.Set("Accept-Language", test.lang)
+		if real := test.target.Matches(r); real != test.expected {
+			t.Fatalf("%+v %s %s real: %v  expected: %v\n", test.target, test.ua, test.lang, real, test.expected)
+		}
+	}
+}
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	FORMAT_JSONL string = "jsonl"
+	FORMAT_CSV   string = "csv"
+
+	CONFLICT_SKIP      string = "skip"
+	CONFLICT_OVERWRITE string = "overwrite"
+	CONFLICT_FAIL      string = "fail"
+)
+
+var csvHeader = []string{"tiny", "origin", "created_at", "redirect_code", "password_hash", "remaining_clicks", "forward_query", "forward_path", "utm_template", "fallback_url",
+	"title", "description", "image", "site_name", "domain", "targets", "variants", "schedule"}
+
+var validTiny = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+type ImportResult struct {
+	Added   int `json:"Added"`
+	Updated int `json:"Updated"`
+	Deleted int `json:"Deleted"`
+	Skipped int `json:"Skipped"`
+}
+
+func IsValidFormat(format string) bool {
+	return format == FORMAT_JSONL || format == FORMAT_CSV
+}
+
+func IsValidConflictPolicy(policy string) bool {
+	return policy == CONFLICT_SKIP || policy == CONFLICT_OVERWRITE || policy == CONFLICT_FAIL
+}
+
+// ExportLinks writes all links to w in format, streaming rows one by one.
+// Targets, variants and schedule are written with links (as JSON columns in CSV).
+func (db *DB) ExportLinks(w io.Writer, format string) error {
+	if !IsValidFormat(format) {
+		return errors.New(fmt.Sprintf("Export format '%s' is invalid (valid: jsonl,csv)", format))
+	}
+	// they are read before links, since rows of links are open while exporting.
+	targets, err := getAllTargets(db)
+	if err != nil {
+		return err
+	}
+	variants, err := getAllVariants(db)
+	if err != nil {
+		return err
+	}
+	schedules, err := getAllSchedules(db)
+	if err != nil {
+		return err
+	}
+	rows, err := db.Query("SELECT " + selectLinkColumns + " FROM urls ORDER BY id")
+	if err != nil {
+		Warnf("Select query of urls table is failed. Error: %v\n", err)
+		return err
+	}
+	defer rows.Close()
+
+	enc := json.NewEncoder(w)
+	cw := csv.NewWriter(w)
+	if format == FORMAT_CSV {
+		if err = cw.Write(csvHeader); err != nil {
+			return err
+		}
+	}
+	for rows.Next() {
+		link, err := scanLink(rows)
+		if err != nil {
+			return err
+		}
+		link.Targets, link.Variants, link.Schedule = targets[link.ID], variants[link.ID], schedules[link.ID]
+		if format == FORMAT_JSONL {
+			err = enc.Encode(exportedLink{Link: link, PasswordHash: link.PasswordHash})
+		} else {
+			var remainingClicks string
+			if link.RemainingClicks != nil {
+				remainingClicks = strconv.FormatInt(*link.RemainingClicks, 10)
+			}
+			metadata := link.Metadata
+			if metadata == nil {
+				metadata = &LinkMetadata{}
+			}
+			var children [3]string
+			for i, v := range []interface{}{link.Targets, link.Variants, link.Schedule} {
+				if children[i], err = csvJSON(v); err != nil {
+					return err
+				}
+			}
+			err = cw.Write([]string{link.Tiny, link.Origin, formatCSVTime(link.CreatedAt), strconv.Itoa(link.RedirectCode), link.PasswordHash, remainingClicks,
+				strconv.FormatBool(link.ForwardQuery), strconv.FormatBool(link.ForwardPath), link.UTMTemplate, link.FallbackURL,
+				metadata.Title, metadata.Description, metadata.Image, metadata.SiteName, link.Domain, children[0], children[1], children[2]})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	if err = cw.Error(); err != nil {
+		return err
+	}
+	return rows.Err()
+}
+
+// ImportLinks validates, normalizes and upserts links read from r in a single transaction.
+// Records conflicting with existing links by tiny, or by origin with the same settings, are handled by policy:
+//
+//	skip: existing links are kept.
+//	overwrite: conflicting links are replaced by the imported one.
+//	fail: whole import is rollbacked.
+//
+// A record identical to the existing link is always skipped.
+func (db *DB) ImportLinks(r io.Reader, format string, policy string, actor string) (*ImportResult, error) {
+	if !IsValidFormat(format) {
+		return nil, errors.New(fmt.Sprintf("Import format '%s' is invalid (valid: jsonl,csv)", format))
+	}
+	if !IsValidConflictPolicy(policy) {
+		return nil, errors.New(fmt.Sprintf("Conflict policy '%s' is invalid (valid: skip,overwrite,fail)", policy))
+	}
+
+	var next func() (*Link, error)
+	if format == FORMAT_JSONL {
+		next = jsonlLinkReader(r)
+	} else {
+		next = csvLinkReader(r)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	restoreClicks := func() {}
+	defer func() {
+		if err != nil {
+			Warnf("Import transaction is rollbacked.")
+			tx.Rollback()
+			restoreClicks()
+		}
+	}()
+	// counted clicks are written before rows of targets and variants are replaced with new ids.
+	if restoreClicks, err = db.flushClicksTx(tx); err != nil {
+		return nil, err
+	}
+
+	result := &ImportResult{}
+	var changed []*Link
+	for n := 1; ; n++ {
+		var link *Link
+		link, err = next()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			if link.Domain == "" {
+				link.Domain = db.defaultDomain
+			}
+			// user IDs in the file may be of other users in this database. Replaced links keep their owner.
+			link.OwnerID = 0
+			err = NormalizeLink(link)
+		}
+		if err == nil {
+			err = normalizeLinkChildren(link)
+		}
+		if err != nil {
+			err = errors.New(fmt.Sprintf("Record %d: %v", n, err))
+			return nil, err
+		}
+		if err = db.importLink(tx, link, policy, actor, result, &changed); err != nil {
+			err = errors.New(fmt.Sprintf("Record %d: %v", n, err))
+			return nil, err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	db.committed(changed...)
+
+	Infof("Links are imported. added:%d updated:%d deleted:%d skipped:%d\n", result.Added, result.Updated, result.Deleted, result.Skipped)
+	return result, nil
+}
+
+// importLink upserts link in tx. Created, updated or deleted links are appended to changed.
+func (db *DB) importLink(tx *sql.Tx, link *Link, policy string, actor string, result *ImportResult, changed *[]*Link) error {
+	existing, err := getLinkTx(tx, "domain = ? AND tiny = ?", link.Domain, link.Tiny)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		if err = getLinkChildren(tx, existing); err != nil {
+			return err
+		}
+	}
+	// byOrigin is the link of the same origin and settings under another tiny, which AddLink would reuse.
+	var byOrigin *Link
+	tiny, err := reusableTiny(tx, link)
+	if err != nil {
+		return err
+	}
+	if tiny != "" && tiny != link.Tiny {
+		if byOrigin, err = getLinkTx(tx, "domain = ? AND tiny = ?", link.Domain, tiny); err != nil {
+			return err
+		}
+	}
+
+	if existing == nil && byOrigin == nil {
+		if err = insertLinkTx(tx, link); err != nil {
+			return err
+		}
+		if err = setLinkChildrenTx(tx, link); err != nil {
+			return err
+		}
+		result.Added++
+		*changed = append(*changed, link)
+		return db.writeChange(tx, actor, AUDIT_CREATE, link.Tiny, nil, link)
+	}
+	if existing != nil && byOrigin == nil && existing.Origin == link.Origin && existing.RedirectCode == link.RedirectCode && existing.PasswordHash == link.PasswordHash &&
+		equalRemainingClicks(existing.RemainingClicks, link.RemainingClicks) && existing.ForwardQuery == link.ForwardQuery && existing.ForwardPath == link.ForwardPath &&
+		existing.UTMTemplate == link.UTMTemplate && existing.FallbackURL == link.FallbackURL && sameLinkChildren(existing, link) {
+		result.Skipped++
+		return nil
+	}
+
+	switch policy {
+	case CONFLICT_SKIP:
+		result.Skipped++
+		return nil
+	case CONFLICT_FAIL:
+		return errors.New(fmt.Sprintf("tiny '%s' or origin '%s' is already registered", link.Tiny, link.Origin))
+	}
+
+	if byOrigin != nil {
+		if err = deleteLinkTx(tx, byOrigin); err != nil {
+			return err
+		}
+		result.Deleted++
+		*changed = append(*changed, byOrigin)
+		if err = db.writeChange(tx, actor, AUDIT_DELETE, byOrigin.Tiny, byOrigin, nil); err != nil {
+			return err
+		}
+	}
+	if existing == nil {
+		if err = insertLinkTx(tx, link); err != nil {
+			return err
+		}
+		if err = setLinkChildrenTx(tx, link); err != nil {
+			return err
+		}
+		result.Added++
+		*changed = append(*changed, link)
+		return db.writeChange(tx, actor, AUDIT_CREATE, link.Tiny, nil, link)
+	}
+	link.ID, link.OwnerID = existing.ID, existing.OwnerID
+	if err = updateLinkTx(tx, link); err != nil {
+		return err
+	}
+	if err = setLinkChildrenTx(tx, link); err != nil {
+		return err
+	}
+	if existing.Origin != link.Origin || !sameLinkChildren(existing, link) {
+		if err = resetHealthTx(tx, link); err != nil {
+			return err
+		}
+	}
+	result.Updated++
+	*changed = append(*changed, link)
+	return db.writeChange(tx, actor, AUDIT_UPDATE, link.Tiny, existing, link)
+}
+
+// normalizeLinkChildren validates targets, variants and schedule of the imported link.
+// Their counters are not imported as well as clicks of the link.
+func normalizeLinkChildren(link *Link) error {
+	if err := NormalizeTargets(link.Targets); err != nil {
+		return err
+	}
+	if err := NormalizeVariants(link.Variants); err != nil {
+		return err
+	}
+	if err := NormalizeSchedule(link.Schedule); err != nil {
+		return err
+	}
+	for _, target := range link.Targets {
+		target.Hits = 0
+	}
+	for _, variant := range link.Variants {
+		variant.Clicks = 0
+	}
+	return nil
+}
+
+// getLinkChildren reads targets, variants and schedule of link.
+func getLinkChildren(q queryer, link *Link) error {
+	var err error
+	if link.Targets, err = getTargets(q, link.ID); err != nil {
+		return err
+	}
+	if link.Variants, err = getVariants(q, link.ID); err != nil {
+		return err
+	}
+	link.Schedule, err = getSchedule(q, link.ID)
+	return err
+}
+
+// setLinkChildrenTx replaces targets, variants and schedule of link in tx.
+func setLinkChildrenTx(tx *sql.Tx, link *Link) error {
+	for _, query := range []string{
+		"DELETE FROM link_targets WHERE link_id = ?",
+		"DELETE FROM link_variants WHERE link_id = ?",
+		"DELETE FROM link_schedule WHERE link_id = ?",
+	} {
+		if _, err := tx.Exec(query, link.ID); err != nil {
+			return err
+		}
+	}
+	if err := insertTargetsTx(tx, link.ID, link.Targets); err != nil {
+		return err
+	}
+	if err := insertVariantsTx(tx, link.ID, link.Variants); err != nil {
+		return err
+	}
+	return insertScheduleTx(tx, link.ID, link.Schedule)
+}
+
+// sameLinkChildren reports whether a and b have the same targets, variants and schedule except counters.
+func sameLinkChildren(a *Link, b *Link) bool {
+	if len(a.Targets) != len(b.Targets) || len(a.Variants) != len(b.Variants) || len(a.Schedule) != len(b.Schedule) {
+		return false
+	}
+	for i, target := range a.Targets {
+		if target.Kind != b.Targets[i].Kind || target.Match != b.Targets[i].Match || target.Origin != b.Targets[i].Origin {
+			return false
+		}
+	}
+	for i, variant := range a.Variants {
+		if variant.Origin != b.Variants[i].Origin || variant.Weight != b.Variants[i].Weight {
+			return false
+		}
+	}
+	for i, entry := range a.Schedule {
+		if !entry.StartAt.Equal(b.Schedule[i].StartAt) || entry.Origin != b.Schedule[i].Origin {
+			return false
+		}
+	}
+	return true
+}
+
+// NormalizeLink validates link and normalizes its origin and domain (scheme and host are lowercased).
+// Zero CreatedAt is set to the current time.
+func NormalizeLink(link *Link) error {
+	link.Domain = strings.ToLower(strings.TrimSpace(link.Domain))
+	if link.Domain != "" && !validDomain.MatchString(link.Domain) {
+		return errors.New(fmt.Sprintf("domain '%s' is invalid", link.Domain))
+	}
+	link.Tiny = strings.TrimSpace(link.Tiny)
+	if !validTiny.MatchString(link.Tiny) {
+		return errors.New(fmt.Sprintf("tiny '%s' is invalid (valid: [a-zA-Z0-9_-]{1,64})", link.Tiny))
+	}
+	origin, err := normalizeOrigin(link.Origin)
+	if err != nil {
+		return err
+	}
+	link.Origin = origin
+	if link.RedirectCode != 0 && !IsValidRedirectCode(link.RedirectCode) {
+		return errors.New(fmt.Sprintf("redirect code '%d' is invalid (valid: 301,302,307,308)", link.RedirectCode))
+	}
+	if link.PasswordHash != "" && !isPasswordHash(link.PasswordHash) {
+		return errors.New("password hash is not bcrypt hash")
+	}
+	if link.RemainingClicks != nil && *link.RemainingClicks < 0 {
+		return errors.New(fmt.Sprintf("remaining clicks '%d' is invalid (valid: 0 or positive number)", *link.RemainingClicks))
+	}
+	if link.OwnerID < 0 {
+		return errors.New(fmt.Sprintf("owner ID '%d' is invalid (valid: 0 or positive number)", link.OwnerID))
+	}
+	if link.UTMTemplate != "" && !validTiny.MatchString(link.UTMTemplate) {
+		return errors.New(fmt.Sprintf("UTM template name '%s' is invalid", link.UTMTemplate))
+	}
+	if link.FallbackURL != "" {
+		if link.FallbackURL, err = normalizeOrigin(link.FallbackURL); err != nil {
+			return err
+		}
+	}
+	normalizeMetadata(link.Metadata)
+	if link.Metadata.isEmpty() {
+		link.Metadata = nil
+	}
+	if link.CreatedAt.IsZero() {
+		link.CreatedAt = time.Now()
+	}
+	link.CreatedAt = link.CreatedAt.UTC()
+	return nil
+}
+
+// exportedLink is a link in JSON Lines with the password hash, which Link never has in JSON.
+type exportedLink struct {
+	*Link
+	PasswordHash string `json:"PasswordHash,omitempty"`
+}
+
+func jsonlLinkReader(r io.Reader) func() (*Link, error) {
+	dec := json.NewDecoder(r)
+	return func() (*Link, error) {
+		exported := exportedLink{Link: &Link{}}
+		if err := dec.Decode(&exported); err != nil {
+			return nil, err
+		}
+		exported.Link.PasswordHash = exported.PasswordHash
+		return exported.Link, nil
+	}
+}
+
+func csvLinkReader(r io.Reader) func() (*Link, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	var columns map[string]int
+	return func() (*Link, error) {
+		if columns == nil {
+			header, err := cr.Read()
+			if err != nil {
+				return nil, err
+			}
+			columns = map[string]int{}
+			for i, name := range header {
+				columns[strings.ToLower(strings.TrimSpace(name))] = i
+			}
+			for _, name := range csvHeader[:2] {
+				if _, ok := columns[name]; !ok {
+					return nil, errors.New(fmt.Sprintf("CSV header must have '%s' column", name))
+				}
+			}
+		}
+		record, err := cr.Read()
+		if err != nil {
+			return nil, err
+		}
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return record[i]
+			}
+			return ""
+		}
+		link := &Link{Tiny: field("tiny"), Origin: field("origin"), PasswordHash: field("password_hash"), UTMTemplate: field("utm_template"),
+			FallbackURL: field("fallback_url"), Domain: field("domain")}
+		metadata := &LinkMetadata{Title: field("title"), Description: field("description"), Image: field("image"), SiteName: field("site_name")}
+		if !metadata.isEmpty() {
+			link.Metadata = metadata
+		}
+		if remaining := field("remaining_clicks"); remaining != "" {
+			n, err := strconv.ParseInt(remaining, 10, 64)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("remaining_clicks '%s' is not number", remaining))
+			}
+			link.RemainingClicks = &n
+		}
+		for name, flag := range map[string]*bool{"forward_query": &link.ForwardQuery, "forward_path": &link.ForwardPath} {
+			if v := field(name); v != "" {
+				b, err := strconv.ParseBool(v)
+				if err != nil {
+					return nil, errors.New(fmt.Sprintf("%s '%s' is not boolean", name, v))
+				}
+				*flag = b
+			}
+		}
+		if code := field("redirect_code"); code != "" {
+			if link.RedirectCode, err = strconv.Atoi(code); err != nil {
+				return nil, errors.New(fmt.Sprintf("redirect_code '%s' is not number", code))
+			}
+		}
+		for name, v := range map[string]interface{}{"targets": &link.Targets, "variants": &link.Variants, "schedule": &link.Schedule} {
+			if s := field(name); s != "" {
+				if err := json.Unmarshal([]byte(s), v); err != nil {
+					return nil, errors.New(fmt.Sprintf("%s '%s' is not JSON", name, s))
+				}
+			}
+		}
+		if t := field("created_at"); t != "" {
+			if link.CreatedAt, err = time.Parse(time.RFC3339, t); err != nil {
+				return nil, errors.New(fmt.Sprintf("created_at '%s' is not RFC3339 time", t))
+			}
+		}
+		return link, nil
+	}
+}
+
+// normalizeOrigin checks origin is absolute http(s) URL and lowercases its scheme and host.
+func normalizeOrigin(origin string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(origin))
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("origin '%s' is not URL", origin))
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	if !(u.Scheme == "http" || u.Scheme == "https") || u.Host == "" {
+		return "", errors.New(fmt.Sprintf("origin '%s' is not absolute http(s) URL", origin))
+	}
+	return u.String(), nil
+}
+
+func equalRemainingClicks(a *int64, b *int64) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// csvJSON returns v as JSON of a CSV column, or "" if v is empty.
+func csvJSON(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil || string(b) == "null" {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func formatCSVTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
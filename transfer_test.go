@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportAndImportLinks(t *testing.T) {
+	for _, format := range []string{FORMAT_JSONL, FORMAT_CSV} {
+		src := connectTempDB(t)
+		origins := []string{"https://example.com/a", "https://example.com/b?c=d"}
+		var tinies []string
+		for _, origin := range origins {
+			tiny, err := src.AddTinyURL(origin, "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			tinies = append(tinies, tiny)
+		}
+		if _, err := src.SetTargets("", tinies[0], "test", []*LinkTarget{{Kind: TARGET_LANGUAGE, Match: "de", Origin: "https://example.de/"}}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := src.SetVariants("", tinies[0], "test", []*LinkVariant{{Origin: "https://example.com/a1", Weight: 1}, {Origin: "https://example.com/a2", Weight: 2}}); err != nil {
+			t.Fatal(err)
+		}
+		startAt := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+		if _, err := src.SetSchedule("", tinies[1], "test", []*ScheduleEntry{{StartAt: startAt, Origin: "https://example.com/later"}}); err != nil {
+			t.Fatal(err)
+		}
+		hash, err := HashPassword("secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = src.UpdateLink("", tinies[1], "test", func(link *Link) error { link.PasswordHash = hash; return nil }); err != nil {
+			t.Fatal(err)
+		}
+		// the password hash is exported but never recorded in audit logs.
+		logs, err := src.GetAuditLogs(AuditFilter{Action: AUDIT_UPDATE, Tiny: tinies[1]})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(logs) == 0 || bytes.Contains(logs[len(logs)-1].After, []byte(hash)) {
+			t.Fatalf("audit log is expected not to have the password hash. real: %+v\n", logs)
+		}
+
+		var buf bytes.Buffer
+		if err := src.ExportLinks(&buf, format); err != nil {
+			t.Fatal(err)
+		}
+		t.Logf("%s:\n%s", format, buf.String())
+
+		dst := connectTempDB(t)
+		result, err := dst.ImportLinks(&buf, format, CONFLICT_FAIL, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Added != len(origins) {
+			t.Fatalf("real: %+v  expected: %d added\n", *result, len(origins))
+		}
+		for i, tiny := range tinies {
+			origin, err := dst.GetOriginURL("", tiny)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if origin != origins[i] {
+				t.Fatalf("real: %s  expected: %s\n", origin, origins[i])
+			}
+		}
+		if link, err := dst.LoadLink("", tinies[1]); err != nil || link.PasswordHash != hash {
+			t.Fatalf("real: %+v %v  expected: password hash %s\n", link, err, hash)
+		}
+		link, err := dst.LoadLink("", tinies[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(link.Targets) != 1 || link.Targets[0].Origin != "https://example.de/" || len(link.Variants) != 2 || link.Variants[1].Weight != 2 {
+			t.Fatalf("%s: targets and variants are not imported: %+v %+v\n", format, link.Targets, link.Variants)
+		}
+		if link, err = dst.LoadLink("", tinies[1]); err != nil {
+			t.Fatal(err)
+		}
+		if len(link.Schedule) != 1 || !link.Schedule[0].StartAt.Equal(startAt) {
+			t.Fatalf("%s: schedule is not imported: %+v\n", format, link.Schedule)
+		}
+		// links with targets are not shared by new links of the same origin.
+		if tiny, err := dst.AddTinyURL(origins[0], "test"); err != nil || tiny == tinies[0] {
+			t.Fatalf("real: %s %v  expected: new tiny\n", tiny, err)
+		}
+	}
+}
+
+func TestImportConflictPolicy(t *testing.T) {
+	db := connectTempDB(t)
+	if _, err := db.ImportLinks(strings.NewReader("tiny,origin\nabc,https://example.com/old\n"), FORMAT_CSV, CONFLICT_FAIL, "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	// scheme and host are normalized.
+	input := "tiny,origin\nabc,HTTPS://EXAMPLE.com/new\nxyz,https://example.com/xyz\n"
+	if _, err := db.ImportLinks(strings.NewReader(input), FORMAT_CSV, CONFLICT_FAIL, "test"); err == nil {
+		t.Fatal("conflict is expected to fail")
+	}
+	if _, err := db.GetOriginURL("", "xyz"); err == nil {
+		t.Fatal("failed import is expected to be rollbacked")
+	}
+
+	result, err := db.ImportLinks(strings.NewReader(input), FORMAT_CSV, CONFLICT_SKIP, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Added != 1 || result.Skipped != 1 {
+		t.Fatalf("real: %+v  expected: 1 added, 1 skipped\n", *result)
+	}
+	if origin, _ := db.GetOriginURL("", "abc"); origin != "https://example.com/old" {
+		t.Fatalf("real: %s  expected: https://example.com/old\n", origin)
+	}
+
+	result, err = db.ImportLinks(strings.NewReader(input), FORMAT_CSV, CONFLICT_OVERWRITE, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Updated != 1 || result.Skipped != 1 {
+		t.Fatalf("real: %+v  expected: 1 updated, 1 skipped\n", *result)
+	}
+	if origin, _ := db.GetOriginURL("", "abc"); origin != "https://example.com/new" {
+		t.Fatalf("real: %s  expected: https://example.com/new\n", origin)
+	}
+
+	// the link of the same origin and settings under another tiny is replaced.
+	input = "tiny,origin\nnew,https://example.com/xyz\n"
+	if _, err = db.ImportLinks(strings.NewReader(input), FORMAT_CSV, CONFLICT_FAIL, "test"); err == nil {
+		t.Fatal("conflict of origin is expected to fail")
+	}
+	result, err = db.ImportLinks(strings.NewReader(input), FORMAT_CSV, CONFLICT_OVERWRITE, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Added != 1 || result.Deleted != 1 {
+		t.Fatalf("real: %+v  expected: 1 added, 1 deleted\n", *result)
+	}
+	if _, err = db.GetOriginURL("", "xyz"); err == nil {
+		t.Fatal("link of the same origin is expected to be deleted")
+	}
+
+	if _, err = db.ImportLinks(strings.NewReader(`{"Tiny":"bad/tiny","Origin":"https://example.com"}`), FORMAT_JSONL, CONFLICT_SKIP, "test"); err == nil {
+		t.Fatal("invalid tiny is expected to fail")
+	}
+}
+
+func TestImportOwner(t *testing.T) {
+	db := connectTempDB(t)
+	alice, err := db.AddUser("alice", "alice-password", ROLE_USER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	owned, err := db.AddLink(&Link{Origin: "https://example.com/owned", OwnerID: alice.ID}, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// owners in the file are not trusted. A new link has no owner, and a replaced link keeps its owner.
+	input := fmt.Sprintf("{\"Tiny\":\"new\",\"Origin\":\"https://example.com/new\",\"OwnerID\":%d}\n", alice.ID) +
+		fmt.Sprintf("{\"Tiny\":\"%s\",\"Origin\":\"https://example.com/replaced\",\"OwnerID\":%d}\n", owned.Tiny, alice.ID+1)
+	result, err := db.ImportLinks(strings.NewReader(input), FORMAT_JSONL, CONFLICT_OVERWRITE, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Added != 1 || result.Updated != 1 {
+		t.Fatalf("real: %+v  expected: 1 added, 1 updated\n", *result)
+	}
+	for tiny, expected := range map[string]int64{"new": 0, owned.Tiny: alice.ID} {
+		link, err := db.GetLink("", tiny)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if link.OwnerID != expected {
+			t.Fatalf("%s real: %d  expected: %d\n", tiny, link.OwnerID, expected)
+		}
+	}
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const SQL_CREATE_USERS = `
+	create table users (
+		id integer primary key autoincrement,
+		username text not null unique,
+		password_hash text not null,
+		role text not null default 'user',
+		created_at datetime not null
+	);
+	create table sessions (
+		token_hash text not null primary key,
+		user_id integer not null,
+		csrf_token text not null,
+		created_at datetime not null,
+		expires_at datetime not null
+	);
+	create index sessions_user_id on sessions(user_id);
+	alter table urls add column owner_id integer;
+	create index urls_owner_id on urls(owner_id);
+`
+
+const (
+	// ROLE_USER can manage only their own links.
+	ROLE_USER string = "user"
+	// ROLE_ADMIN can manage all links and use admin API.
+	ROLE_ADMIN string = "admin"
+)
+
+var USER_ROLES = map[string]bool{
+	ROLE_USER:  true,
+	ROLE_ADMIN: true,
+}
+
+const SESSION_COOKIE string = "tinyurl_session"
+
+// CSRF_HEADER and CSRF_FORM_FIELD carry the CSRF token of the session in requests changing state.
+const CSRF_HEADER string = "X-CSRF-Token"
+const CSRF_FORM_FIELD string = "csrf_token"
+
+const SESSION_TOKEN_LENGTH uint32 = 32
+
+// '@' and '+' are allowed for email addresses of OIDC users.
+var validUsername = regexp.MustCompile(`^[a-z0-9][a-z0-9._@+-]{0,63}$`)
+
+var errUserExists = errors.New("user already exists")
+var errUserNotFound = errors.New("user is not found")
+var errInvalidCredentials = errors.New("username or password is wrong")
+
+// dummyPasswordHash is compared for unknown users so that they take as long as wrong passwords.
+var dummyPasswordHash string
+var dummyPasswordHashOnce sync.Once
+
+type User struct {
+	ID           int64     `json:"ID"`
+	Username     string    `json:"Username"`
+	PasswordHash string    `json:"-"`
+	Role         string    `json:"Role"`
+	CreatedAt    time.Time `json:"CreatedAt"`
+}
+
+func (u *User) IsAdmin() bool {
+	return u.Role == ROLE_ADMIN
+}
+
+// Session is a login of the user. Its token is kept only in the cookie, and the database has its hash.
+type Session struct {
+	User      *User
+	CSRFToken string
+	ExpiresAt time.Time
+}
+
+// normalizeUsername lowercases username so that usernames are case insensitive.
+func normalizeUsername(username string) (string, error) {
+	username = strings.ToLower(strings.TrimSpace(username))
+	if !validUsername.MatchString(username) {
+		return "", errors.New(fmt.Sprintf("username '%s' is invalid (valid: [a-z0-9._@+-]{1,64} starting with alphanumeric)", username))
+	}
+	return username, nil
+}
+
+func (db *DB) AddUser(username string, password string, role string) (*User, error) {
+	username, err := normalizeUsername(username)
+	if err != nil {
+		return nil, err
+	}
+	if !USER_ROLES[role] {
+		return nil, errors.New(fmt.Sprintf("role '%s' is invalid (valid: user,admin)", role))
+	}
+	hash, err := HashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	user := &User{Username: username, PasswordHash: hash, Role: role, CreatedAt: time.Now().UTC()}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	var exists bool
+	if err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE username = ?)", username).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, errUserExists
+	}
+	result, err := tx.Exec("INSERT INTO users(username, password_hash, role, created_at) VALUES(?, ?, ?, ?)",
+		user.Username, user.PasswordHash, user.Role, user.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if user.ID, err = result.LastInsertId(); err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	Infof("User '%s' (%s) is added.\n", user.Username, user.Role)
+	return user, nil
+}
+
+func scanUser(row rowScanner) (*User, error) {
+	var user User
+	if err := row.Scan(&user.ID, &user.Username, &user.PasswordHash, &user.Role, &user.CreatedAt); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// GetUser returns the user of username, or errUserNotFound.
+func (db *DB) GetUser(username string) (*User, error) {
+	user, err := scanUser(db.QueryRow("SELECT id, username, password_hash, role, created_at FROM users WHERE username = ?",
+		strings.ToLower(strings.TrimSpace(username))))
+	if err == sql.ErrNoRows {
+		return nil, errUserNotFound
+	}
+	return user, err
+}
+
+func (db *DB) GetUsers() ([]*User, error) {
+	rows, err := db.Query("SELECT id, username, password_hash, role, created_at FROM users ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []*User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+// SetUserPassword changes the password of the user and logs out all of their sessions.
+func (db *DB) SetUserPassword(username string, password string) error {
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	return db.updateUser(username, "password_hash = ?", hash)
+}
+
+func (db *DB) SetUserRole(username string, role string) error {
+	if !USER_ROLES[role] {
+		return errors.New(fmt.Sprintf("role '%s' is invalid (valid: user,admin)", role))
+	}
+	return db.updateUser(username, "role = ?", role)
+}
+
+// updateUser sets columns of the user and deletes their sessions, so that the change takes effect immediately.
+func (db *DB) updateUser(username string, set string, args ...interface{}) error {
+	user, err := db.GetUser(username)
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec("UPDATE users SET "+set+" WHERE id = ?", append(args, user.ID)...); err != nil {
+		return err
+	}
+	if _, err = tx.Exec("DELETE FROM sessions WHERE user_id = ?", user.ID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteUser deletes the user and their sessions. Their links are kept, and only admins can manage them.
+func (db *DB) DeleteUser(username string) error {
+	user, err := db.GetUser(username)
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec("DELETE FROM users WHERE id = ?", user.ID); err != nil {
+		return err
+	}
+	if _, err = tx.Exec("DELETE FROM sessions WHERE user_id = ?", user.ID); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	Infof("User '%s' is deleted.\n", user.Username)
+	return nil
+}
+
+// Authenticate returns the user of username if password is right, or errInvalidCredentials.
+func (db *DB) Authenticate(username string, password string) (*User, error) {
+	user, err := db.GetUser(username)
+	if err == errUserNotFound {
+		dummyPasswordHashOnce.Do(func() { dummyPasswordHash, _ = HashPassword("dummy password") })
+		CheckPassword(dummyPasswordHash, password)
+		return nil, errInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !CheckPassword(user.PasswordHash, password) {
+		return nil, errInvalidCredentials
+	}
+	return user, nil
+}
+
+func hashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateSession logs in user for ttl and returns the token of the session. Expired sessions are deleted.
+func (db *DB) CreateSession(user *User, ttl time.Duration) (token string, session *Session, err error) {
+	if token, err = MakeRandomStr(SESSION_TOKEN_LENGTH); err != nil {
+		return "", nil, err
+	}
+	csrfToken, err := MakeRandomStr(SESSION_TOKEN_LENGTH)
+	if err != nil {
+		return "", nil, err
+	}
+	now := time.Now().UTC()
+	session = &Session{User: user, CSRFToken: csrfToken, ExpiresAt: now.Add(ttl)}
+	if _, err = db.Exec("DELETE FROM sessions WHERE expires_at < ?", now); err != nil {
+		return "", nil, err
+	}
+	if _, err = db.Exec("INSERT INTO sessions(token_hash, user_id, csrf_token, created_at, expires_at) VALUES(?, ?, ?, ?, ?)",
+		hashSessionToken(token), user.ID, csrfToken, now, session.ExpiresAt); err != nil {
+		return "", nil, err
+	}
+	return token, session, nil
+}
+
+// GetSession returns the session of token, or nil if it is not found or expired.
+func (db *DB) GetSession(token string) (*Session, error) {
+	var session Session
+	user := &User{}
+	err := db.QueryRow(`SELECT users.id, users.username, users.password_hash, users.role, users.created_at, sessions.csrf_token, sessions.expires_at
+		FROM sessions JOIN users ON users.id = sessions.user_id WHERE sessions.token_hash = ?`, hashSessionToken(token)).
+		Scan(&user.ID, &user.Username, &user.PasswordHash, &user.Role, &user.CreatedAt, &session.CSRFToken, &session.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !time.Now().Before(session.ExpiresAt) {
+		return nil, nil
+	}
+	session.User = user
+	return &session, nil
+}
+
+func (db *DB) DeleteSession(token string) error {
+	_, err := db.Exec("DELETE FROM sessions WHERE token_hash = ?", hashSessionToken(token))
+	return err
+}
+
+// GetLinks returns links owned by ownerID, or all links if ownerID is 0. Newer links come first.
+func (db *DB) GetLinks(ownerID int64) ([]*Link, error) {
+	query := "SELECT " + selectLinkColumns + " FROM urls"
+	var args []interface{}
+	if ownerID != 0 {
+		query += " WHERE owner_id = ?"
+		args = append(args, ownerID)
+	}
+	rows, err := db.Query(query+" ORDER BY id DESC", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := []*Link{}
+	for rows.Next() {
+		link, err := scanLink(rows)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+	return links, rows.Err()
+}
+
+type sessionContextKey struct{}
+
+// withSession passes the session of the cookie to h in the request context. Requests changing state must have
+// the CSRF token of the session in CSRF_HEADER header or CSRF_FORM_FIELD of the form, or they are handled as anonymous.
+func withSession(cfg *Config, db *DB, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(SESSION_COOKIE)
+		if err != nil || cookie.Value == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		session, err := db.GetSession(cookie.Value)
+		if err != nil {
+			Errorf("Getting session is failed. Error: %v\n", err)
+		}
+		if session == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if r.Method != "GET" && r.Method != "HEAD" && r.Method != "OPTIONS" {
+			token, err := csrfToken(cfg, w, r)
+			if err == errBodyTooLarge {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				w.Write([]byte("Request body is too large.\n"))
+				return
+			}
+			if subtle.ConstantTimeCompare([]byte(token), []byte(session.CSRFToken)) != 1 {
+				Infof("Request '%s %s' of user '%s' without valid CSRF token from %s\n", r.Method, r.URL.Path, session.User.Username, r.RemoteAddr)
+				h.ServeHTTP(w, r)
+				return
+			}
+		}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), sessionContextKey{}, session)))
+	})
+}
+
+// withPostSession applies withSession only to POST, which creates links owned by the user.
+// Redirects, previews and QR codes never read sessions.
+func withPostSession(cfg *Config, db *DB, h http.Handler) http.Handler {
+	withS := withSession(cfg, db, h)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			withS.ServeHTTP(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// csrfToken returns the CSRF token sent with r. The body of forms is read, and r.Body is replaced to be read again.
+func csrfToken(cfg *Config, w http.ResponseWriter, r *http.Request) (string, error) {
+	if token := r.Header.Get(CSRF_HEADER); token != "" {
+		return token, nil
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != MEDIA_TYPE_FORM {
+		return "", nil
+	}
+	body, err := readBody(cfg, w, r)
+	if err != nil {
+		return "", err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return "", nil
+	}
+	return form.Get(CSRF_FORM_FIELD), nil
+}
+
+// requestSession returns the session of the logged in user sending r, or nil.
+func requestSession(r *http.Request) *Session {
+	session, _ := r.Context().Value(sessionContextKey{}).(*Session)
+	return session
+}
+
+// requestUser returns the logged in user sending r, or nil.
+func requestUser(r *http.Request) *User {
+	if session := requestSession(r); session != nil {
+		return session.User
+	}
+	return nil
+}
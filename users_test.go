@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAuthenticate(t *testing.T) {
+	db := connectTempDB(t)
+	if _, err := db.AddUser("Alice", "alice-password", ROLE_USER); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.AddUser("alice", "another-password", ROLE_USER); err != errUserExists {
+		t.Fatalf("real: %v  expected: %v\n", err, errUserExists)
+	}
+	for _, username := range []string{"", "-alice", "alice bob", "アリス"} {
+		if _, err := db.AddUser(username, "password", ROLE_USER); err == nil {
+			t.Fatalf("username '%s' is accepted.\n", username)
+		}
+	}
+	if _, err := db.AddUser("bob", "password", "owner"); err == nil {
+		t.Fatal("role 'owner' is accepted.")
+	}
+
+	tests := []struct {
+		username string
+		password string
+		ok       bool
+	}{
+		{"alice", "alice-password", true},
+		{" ALICE ", "alice-password", true},
+		{"alice", "wrong-password", false},
+		{"bob", "alice-password", false},
+	}
+	for _, test := range tests {
+		user, err := db.Authenticate(test.username, test.password)
+		if test.ok && (err != nil || user.Username != "alice") {
+			t.Fatalf("%s real: %v  expected: alice\n", test.username, err)
+		}
+		if !test.ok && err != errInvalidCredentials {
+			t.Fatalf("%s real: %v  expected: %v\n", test.username, err, errInvalidCredentials)
+		}
+	}
+}
+
+func TestSession(t *testing.T) {
+	db := connectTempDB(t)
+	user, err := db.AddUser("alice", "alice-password", ROLE_USER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, session, err := db.CreateSession(user, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := db.GetSession(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || got.User.ID != user.ID || got.CSRFToken != session.CSRFToken {
+		t.Fatalf("real: %+v  expected: %+v\n", got, session)
+	}
+	// only the hash of the token is stored.
+	var stored int
+	if err = db.QueryRow("SELECT COUNT(*) FROM sessions WHERE token_hash = ?", token).Scan(&stored); err != nil || stored != 0 {
+		t.Fatalf("real: %d %v  expected: 0\n", stored, err)
+	}
+
+	expiredToken, _, err := db.CreateSession(user, -time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err = db.GetSession(expiredToken); err != nil || got != nil {
+		t.Fatalf("real: %+v %v  expected: nil\n", got, err)
+	}
+
+	// changing the password logs out all sessions.
+	if err = db.SetUserPassword("alice", "new-password"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err = db.GetSession(token); err != nil || got != nil {
+		t.Fatalf("real: %+v %v  expected: nil\n", got, err)
+	}
+}
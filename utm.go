@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const SQL_CREATE_UTM_TEMPLATES = `
+	create table utm_templates (
+		name text not null primary key,
+		params text not null,
+		updated_at datetime not null
+	);
+`
+
+var errUTMTemplateNotFound = errors.New("UTM template is not found")
+var errUTMTemplateInUse = errors.New("UTM template is used by links")
+
+// utmTemplates are UTM templates saved by the admin API. They are kept in memory since they are read by every redirect.
+type utmTemplates struct {
+	mu        sync.RWMutex
+	templates map[string]map[string]string
+}
+
+// validateUTMTemplate reports why the template of name and params is invalid.
+func validateUTMTemplate(name string, params map[string]string) error {
+	if !validTiny.MatchString(name) {
+		return errors.New(fmt.Sprintf("UTM template name '%s' is invalid (valid: alphanumeric, '-' and '_')\n", name))
+	}
+	for key, value := range params {
+		if key == "" || value == "" {
+			return errors.New(fmt.Sprintf("UTM template '%s' has empty parameter '%s'\n", name, key))
+		}
+	}
+	return nil
+}
+
+func (db *DB) loadUTMTemplates() error {
+	rows, err := db.Query("SELECT name, params FROM utm_templates")
+	if err != nil {
+		Warnf("Select query of utm_templates table is failed.")
+		return err
+	}
+	defer rows.Close()
+	templates := map[string]map[string]string{}
+	for rows.Next() {
+		var name, params string
+		if err = rows.Scan(&name, &params); err != nil {
+			return err
+		}
+		var p map[string]string
+		if err = json.Unmarshal([]byte(params), &p); err != nil {
+			return err
+		}
+		templates[name] = p
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	db.utm.mu.Lock()
+	db.utm.templates = templates
+	db.utm.mu.Unlock()
+	return nil
+}
+
+// UTMTemplate returns the parameters of UTM template name. Templates saved by the admin API take precedence over config.
+func (db *DB) UTMTemplate(cfg *Config, name string) (map[string]string, bool) {
+	db.utm.mu.RLock()
+	params, ok := db.utm.templates[name]
+	db.utm.mu.RUnlock()
+	if ok {
+		return params, true
+	}
+	params, ok = cfg.UTMTemplates[name]
+	return params, ok
+}
+
+// UTMTemplates returns all UTM templates of config and the admin API.
+func (db *DB) UTMTemplates(cfg *Config) map[string]map[string]string {
+	templates := map[string]map[string]string{}
+	for name, params := range cfg.UTMTemplates {
+		templates[name] = params
+	}
+	db.utm.mu.RLock()
+	defer db.utm.mu.RUnlock()
+	for name, params := range db.utm.templates {
+		templates[name] = params
+	}
+	return templates
+}
+
+// PutUTMTemplate creates or replaces UTM template name. Links with the template redirect with the new parameters.
+func (db *DB) PutUTMTemplate(name string, params map[string]string, actor string) error {
+	if err := validateUTMTemplate(name, params); err != nil {
+		return err
+	}
+	b, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+
+	db.utm.mu.Lock()
+	defer db.utm.mu.Unlock()
+	if _, err = db.Exec("INSERT OR REPLACE INTO utm_templates (name, params, updated_at) VALUES (?, ?, ?)", name, string(b), time.Now()); err != nil {
+		return err
+	}
+	db.utm.templates[name] = params
+	Infof("UTM template is saved. name:'%s' by %s\n", name, actor)
+	return nil
+}
+
+// DeleteUTMTemplate deletes UTM template name saved by the admin API. Templates in config can't be deleted,
+// and templates used by links are deleted only if config has the template of the same name.
+func (db *DB) DeleteUTMTemplate(cfg *Config, name string, actor string) error {
+	db.utm.mu.Lock()
+	defer db.utm.mu.Unlock()
+	if _, ok := db.utm.templates[name]; !ok {
+		return errUTMTemplateNotFound
+	}
+	if _, ok := cfg.UTMTemplates[name]; !ok {
+		var used int
+		if err := db.QueryRow("SELECT count(*) FROM urls WHERE utm_template = ?", name).Scan(&used); err != nil {
+			return err
+		}
+		if used > 0 {
+			return errUTMTemplateInUse
+		}
+	}
+	if _, err := db.Exec("DELETE FROM utm_templates WHERE name = ?", name); err != nil {
+		return err
+	}
+	delete(db.utm.templates, name)
+	Infof("UTM template is deleted. name:'%s' by %s\n", name, actor)
+	return nil
+}
+
+// utmTemplatesHandleMiddle serves "/admin/utm-templates" and "/admin/utm-templates/{name}".
+func utmTemplatesHandleMiddle(cfg *Config, db *DB) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/utm-templates"), "/")
+		switch {
+		case name == "" && r.Method == "GET":
+			writeJSON(w, http.StatusOK, db.UTMTemplates(cfg))
+		case name != "" && r.Method == "GET":
+			params, ok := db.UTMTemplate(cfg, name)
+			if !ok {
+				writeJSON(w, http.StatusNotFound, ErrorResponse{Error: fmt.Sprintf("UTM template '%s' is not found.\n", name)})
+				return
+			}
+			writeJSON(w, http.StatusOK, params)
+		case name != "" && r.Method == "PUT":
+			var params map[string]string
+			if err := readJSON(cfg, w, r, &params); err != nil {
+				writeBodyError(w, err, "Request body must be JSON of parameters.\n")
+				return
+			}
+			if err := validateUTMTemplate(name, params); err != nil {
+				writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+				return
+			}
+			if err := db.PutUTMTemplate(name, params, requestActor(cfg, r)); err != nil {
+				Errorf("PutUTMTemplateError: %v\n", err)
+				writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "Internal server error.\n"})
+				return
+			}
+			writeJSON(w, http.StatusOK, params)
+		case name != "" && r.Method == "DELETE":
+			err := db.DeleteUTMTemplate(cfg, name, requestActor(cfg, r))
+			switch err {
+			case nil:
+				w.WriteHeader(http.StatusNoContent)
+			case errUTMTemplateNotFound:
+				writeJSON(w, http.StatusNotFound, ErrorResponse{Error: fmt.Sprintf("UTM template '%s' is not saved by API.\n", name)})
+			case errUTMTemplateInUse:
+				writeJSON(w, http.StatusConflict, ErrorResponse{Error: fmt.Sprintf("UTM template '%s' is used by links.\n", name)})
+			default:
+				Errorf("DeleteUTMTemplateError: %v\n", err)
+				writeJSON(w, http.StatusInternalServerError, ErrorResponse{Error: "Internal server error.\n"})
+			}
+		default:
+			Debugf("Request not allowed method '%s'\n", r.Method)
+			writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: fmt.Sprintf("HTTP method '%s' is not allowed.\n", r.Method)})
+		}
+	}
+}
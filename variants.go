@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+const SQL_CREATE_LINK_VARIANTS = `
+	create table link_variants (
+		id integer primary key autoincrement,
+		link_id integer not null,
+		position integer not null,
+		origin text not null,
+		weight integer not null,
+		clicks integer not null default 0
+	);
+	create index link_variants_link_id on link_variants(link_id, position);
+`
+
+const MAX_VARIANTS int = 16
+const MAX_VARIANT_WEIGHT int = 10000
+
+// VISITOR_COOKIE identifies a visitor so that the visitor is always sent to the same variant.
+const VISITOR_COOKIE string = "tinyurl_visitor"
+const VISITOR_COOKIE_MAX_AGE time.Duration = 365 * 24 * time.Hour
+
+var validVisitorID = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// LinkVariant is one of weighted origins of A/B split link.
+type LinkVariant struct {
+	ID     int64  `json:"-"`
+	Origin string `json:"Origin"`
+	// Weight is the relative share of visitors sent to the variant.
+	Weight int `json:"Weight"`
+	// Clicks is the number of redirects to the variant.
+	Clicks int64 `json:"Clicks"`
+}
+
+func NormalizeVariants(variants []*LinkVariant) error {
+	if len(variants) > MAX_VARIANTS {
+		return errors.New(fmt.Sprintf("a link can have up to %d variants", MAX_VARIANTS))
+	}
+	origins := map[string]bool{}
+	for i, variant := range variants {
+		if variant == nil {
+			return errors.New(fmt.Sprintf("variant %d is null", i))
+		}
+		origin, err := normalizeOrigin(variant.Origin)
+		if err != nil {
+			return err
+		}
+		variant.Origin = origin
+		if origins[origin] {
+			return errors.New(fmt.Sprintf("origin '%s' of variants is duplicated", origin))
+		}
+		origins[origin] = true
+		if variant.Weight < 1 || variant.Weight > MAX_VARIANT_WEIGHT {
+			return errors.New(fmt.Sprintf("weight '%d' is invalid (valid: 1-%d)", variant.Weight, MAX_VARIANT_WEIGHT))
+		}
+	}
+	return nil
+}
+
+// selectVariant chooses a variant of link for visitor by weight. The same visitor always gets the same variant
+// as long as variants are not changed. nil means the link has no variants.
+func (link *Link) selectVariant(visitor string) *LinkVariant {
+	total := 0
+	for _, variant := range link.Variants {
+		total += variant.Weight
+	}
+	if total == 0 {
+		return nil
+	}
+	h := fnv.New64a()
+	h.Write([]byte(link.Tiny + "\x00" + visitor))
+	point := int(h.Sum64() % uint64(total))
+	for _, variant := range link.Variants {
+		if point < variant.Weight {
+			return variant
+		}
+		point -= variant.Weight
+	}
+	return nil
+}
+
+// visitorID returns the visitor ID in the cookie. A visitor without the cookie is identified by
+// the hash of the client address and User-Agent, and the cookie is set so that the visitor stays sticky.
+func visitorID(w http.ResponseWriter, r *http.Request) string {
+	if c, err := r.Cookie(VISITOR_COOKIE); err == nil && validVisitorID.MatchString(c.Value) {
+		return c.Value
+	}
+	var id string
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		sum := sha256.Sum256([]byte(host + "\x00" + r.UserAgent()))
+		id = hex.EncodeToString(sum[:16])
+	} else {
+		b := make([]byte, 16)
+		rand.Read(b)
+		id = hex.EncodeToString(b)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     VISITOR_COOKIE,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   int(VISITOR_COOKIE_MAX_AGE.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return id
+}
+
+func getVariants(q queryer, linkID int64) ([]*LinkVariant, error) {
+	rows, err := q.Query("SELECT id, origin, weight, clicks FROM link_variants WHERE link_id = ? ORDER BY position", linkID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var variants []*LinkVariant
+	for rows.Next() {
+		variant := &LinkVariant{}
+		if err := rows.Scan(&variant.ID, &variant.Origin, &variant.Weight, &variant.Clicks); err != nil {
+			return nil, err
+		}
+		variants = append(variants, variant)
+	}
+	return variants, rows.Err()
+}
+
+// getAllVariants returns variants of all links by link ID.
+func getAllVariants(q queryer) (map[int64][]*LinkVariant, error) {
+	rows, err := q.Query("SELECT link_id, id, origin, weight, clicks FROM link_variants ORDER BY link_id, position")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	variants := map[int64][]*LinkVariant{}
+	for rows.Next() {
+		var linkID int64
+		variant := &LinkVariant{}
+		if err := rows.Scan(&linkID, &variant.ID, &variant.Origin, &variant.Weight, &variant.Clicks); err != nil {
+			return nil, err
+		}
+		variants[linkID] = append(variants[linkID], variant)
+	}
+	return variants, rows.Err()
+}
+
+// insertVariantsTx inserts variants of the link of linkID in order.
+func insertVariantsTx(tx *sql.Tx, linkID int64, variants []*LinkVariant) error {
+	for i, variant := range variants {
+		result, err := tx.Exec("INSERT INTO link_variants (link_id, position, origin, weight, clicks) VALUES (?, ?, ?, ?, ?)",
+			linkID, i, variant.Origin, variant.Weight, variant.Clicks)
+		if err != nil {
+			return err
+		}
+		if variant.ID, err = result.LastInsertId(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetVariants replaces the variants of the link. Clicks of variants whose origin is not changed are kept.
+func (db *DB) SetVariants(domain string, tiny string, actor string, variants []*LinkVariant) (*Link, error) {
+	if err := NormalizeVariants(variants); err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	restoreClicks := func() {}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			restoreClicks()
+		}
+	}()
+	// counted clicks of variants are written before their rows are replaced with new ids.
+	if restoreClicks, err = db.flushClicksTx(tx); err != nil {
+		return nil, err
+	}
+
+	before, err := getLinkTx(tx, "domain = ? AND tiny = ?", domain, tiny)
+	if err != nil {
+		return nil, err
+	}
+	if before == nil {
+		err = errLinkNotFound
+		return nil, err
+	}
+	if before.Variants, err = getVariants(tx, before.ID); err != nil {
+		return nil, err
+	}
+	clicks := map[string]int64{}
+	for _, variant := range before.Variants {
+		clicks[variant.Origin] = variant.Clicks
+	}
+
+	if _, err = tx.Exec("DELETE FROM link_variants WHERE link_id = ?", before.ID); err != nil {
+		return nil, err
+	}
+	for _, variant := range variants {
+		variant.Clicks = clicks[variant.Origin]
+	}
+	if err = insertVariantsTx(tx, before.ID, variants); err != nil {
+		return nil, err
+	}
+
+	after := *before
+	after.Variants = variants
+	if err = resetHealthTx(tx, &after); err != nil {
+		return nil, err
+	}
+	if err = db.writeChange(tx, actor, AUDIT_UPDATE, tiny, before, &after); err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	db.committed(&after)
+
+	Infof("Variants of URL are updated. tiny:'%s' variants:%d by %s\n", tiny, len(variants), actor)
+	return &after, nil
+}
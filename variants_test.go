@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSelectVariant(t *testing.T) {
+	link := &Link{Tiny: "abc", Variants: []*LinkVariant{
+		{Origin: "https://example.com/a", Weight: 3},
+		{Origin: "https://example.com/b", Weight: 1},
+	}}
+	counts := map[string]int{}
+	for i := 0; i < 4000; i++ {
+		visitor := fmt.Sprintf("%032x", i)
+		variant := link.selectVariant(visitor)
+		if variant == nil {
+			t.Fatal("variant is expected to be selected")
+		}
+		if again := link.selectVariant(visitor); again != variant {
+			t.Fatalf("real: %s  expected: %s for the same visitor\n", again.Origin, variant.Origin)
+		}
+		counts[variant.Origin]++
+	}
+	// 3:1 split with some tolerance.
+	if a := counts["https://example.com/a"]; a < 2800 || a > 3200 {
+		t.Fatalf("real: %v  expected: about 3000 and 1000\n", counts)
+	}
+
+	if variant := (&Link{Tiny: "abc"}).selectVariant("visitor"); variant != nil {
+		t.Fatalf("real: %+v  expected: nil\n", variant)
+	}
+}
+
+func TestNormalizeVariants(t *testing.T) {
+	invalid := [][]*LinkVariant{
+		{{Origin: "https://example.com/a", Weight: 0}},
+		{{Origin: "ftp://example.com/a", Weight: 1}},
+		{{Origin: "https://example.com/a", Weight: 1}, {Origin: "https://EXAMPLE.com/a", Weight: 2}},
+		{nil},
+	}
+	for _, variants := range invalid {
+		if err := NormalizeVariants(variants); err == nil {
+			t.Fatalf("variants %v are expected to be invalid\n", variants)
+		}
+	}
+}
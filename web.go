@@ -1,47 +1,120 @@
 package main
 
 import (
-	"encoding/json"
+	"bytes"
+	"crypto/subtle"
+	"errors"
 	"fmt"
 	"html/template"
-	"io"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
+	"path"
 	"strconv"
+	"strings"
 	"time"
 )
 
+// templates are parsed by StartTinyURLServer. They are nil if parsing is failed, and their pages are not served.
 var pageTemplate *template.Template
+var previewTemplate *template.Template
+var unlockTemplate *template.Template
+var messageTemplate *template.Template
+var myTemplate *template.Template
+
+const (
+	MEDIA_TYPE_JSON string = "application/json"
+	MEDIA_TYPE_FORM string = "application/x-www-form-urlencoded"
+	MEDIA_TYPE_TEXT string = "text/plain"
+	MEDIA_TYPE_HTML string = "text/html"
+)
+
+// REDIRECT_CODES maps allowed redirect status codes to whether browsers may cache them permanently.
+var REDIRECT_CODES = map[int]bool{
+	http.StatusMovedPermanently:  true,
+	http.StatusFound:             false,
+	http.StatusTemporaryRedirect: false,
+	http.StatusPermanentRedirect: true,
+}
+
+func IsValidRedirectCode(code int) bool {
+	_, ok := REDIRECT_CODES[code]
+	return ok
+}
 
 func StartTinyURLServer(cfg *Config, db *DB) error {
-	var err error
-	pageTemplate, err = template.New("page").Parse(pageHTML)
-	if err != nil {
-		Warnf("Create page html/template is failed. Error: %v\n", err)
-	}
+	parseTemplates()
 	s := CreateTinyURLServer(cfg, db)
 
 	// now, http only
 	return http.ListenAndServe(":"+strconv.Itoa(cfg.HTTPPort), s)
 }
 
-func CreateTinyURLServer(cfg *Config, db *DB) *http.ServeMux {
+func parseTemplates() {
+	var err error
+	if pageTemplate, err = template.New("page").Parse(pageHTML); err != nil {
+		Warnf("Create page html/template is failed. Error: %v\n", err)
+	}
+	if previewTemplate, err = template.New("preview").Parse(previewHTML); err != nil {
+		Warnf("Create preview html/template is failed. Error: %v\n", err)
+	}
+	if unlockTemplate, err = template.New("unlock").Parse(unlockHTML); err != nil {
+		Warnf("Create unlock html/template is failed. Error: %v\n", err)
+	}
+	if messageTemplate, err = template.New("message").Parse(messageHTML); err != nil {
+		Warnf("Create message html/template is failed. Error: %v\n", err)
+	}
+	if myTemplate, err = template.New("my").Parse(myHTML); err != nil {
+		Warnf("Create my html/template is failed. Error: %v\n", err)
+	}
+}
+
+func CreateTinyURLServer(cfg *Config, db *DB) http.Handler {
+	// sessions are read only by pages of accounts, admin API and POST, so that redirects don't look them up.
+	session := func(h func(http.ResponseWriter, *http.Request)) http.Handler {
+		return withSession(cfg, db, http.HandlerFunc(h))
+	}
 	server := http.NewServeMux()
-	server.HandleFunc("/page", pageHandleMiddle(cfg, db))
-	server.HandleFunc("/", tinyURLHandleMiddle(cfg, db))
-	return server
+	server.Handle("/page", session(pageHandleMiddle(cfg, db)))
+	server.Handle("/batch", session(batchHandleMiddle(cfg, db)))
+	server.Handle("/login", session(loginHandleMiddle(cfg, db)))
+	server.Handle("/signup", session(signupHandleMiddle(cfg, db)))
+	server.Handle("/logout", session(logoutHandleMiddle(cfg, db)))
+	server.Handle("/account", session(accountHandleMiddle(cfg, db)))
+	server.Handle("/my", session(myHandleMiddle(cfg, db)))
+	server.Handle("/my/links", session(myLinksHandleMiddle(cfg, db)))
+	server.Handle("/my/links/", session(myLinksHandleMiddle(cfg, db)))
+	if cfg.OIDC != nil {
+		oidc := NewOIDCClient(cfg.OIDC)
+		server.HandleFunc("/oidc/login", oidcLoginHandleMiddle(cfg, oidc))
+		server.HandleFunc("/oidc/callback", oidcCallbackHandleMiddle(cfg, db, oidc))
+	}
+	server.Handle("/admin/audit", session(adminHandleMiddle(cfg, auditHandleMiddle(cfg, db))))
+	server.Handle("/admin/export", session(adminHandleMiddle(cfg, exportHandleMiddle(cfg, db))))
+	server.Handle("/admin/import", session(adminHandleMiddle(cfg, importHandleMiddle(cfg, db))))
+	server.Handle("/admin/cache", session(adminHandleMiddle(cfg, cacheHandleMiddle(cfg, db))))
+	server.Handle("/admin/links/", session(adminHandleMiddle(cfg, linkHandleMiddle(cfg, db))))
+	server.Handle("/admin/broken", session(adminHandleMiddle(cfg, brokenHandleMiddle(cfg, db))))
+	server.Handle("/admin/utm-templates", session(adminHandleMiddle(cfg, utmTemplatesHandleMiddle(cfg, db))))
+	server.Handle("/admin/utm-templates/", session(adminHandleMiddle(cfg, utmTemplatesHandleMiddle(cfg, db))))
+	server.Handle("/", withPostSession(cfg, db, http.HandlerFunc(tinyURLHandleMiddle(cfg, db))))
+	return withBasePath(cfg.basePath(), server)
 }
 
 func pageHandleMiddle(cfg *Config, db *DB) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requestDomain(cfg, w, r); !ok {
+			return
+		}
 		switch r.Method {
 		case "GET":
 			if pageTemplate == nil {
-				msg := fmt.Sprintf("Page was not found.\n")
-				w.WriteHeader(http.StatusNotFound)
-				w.Write([]byte(msg))
+				writePageNotFound(w)
 				return
 			}
-			if err := pageTemplate.Execute(w, nil); err != nil {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			if err := pageTemplate.Execute(w, newPage(r, TinyPost{})); err != nil {
 				Errorf("Executing page template is failed.\n")
 				w.WriteHeader(http.StatusInternalServerError)
 				return
@@ -55,13 +128,41 @@ func pageHandleMiddle(cfg *Config, db *DB) func(http.ResponseWriter, *http.Reque
 	}
 }
 
+func writePageNotFound(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusNotFound)
+	w.Write([]byte("Page was not found.\n"))
+}
+
 func tinyURLHandleMiddle(cfg *Config, db *DB) func(http.ResponseWriter, *http.Request) {
+	limiter := NewAttemptLimiter(cfg.PasswordMaxAttempts, cfg.PasswordLockDuration)
 	return func(w http.ResponseWriter, r *http.Request) {
+		d, ok := requestDomain(cfg, w, r)
+		if !ok {
+			return
+		}
 		switch r.Method {
 		case "GET":
-			getTinyURL(cfg, db, w, r)
+			// preview and QR code are served only for "/{tiny}+" and "/{tiny}.png", not for forwarded paths.
+			if _, rest := splitTinyPath(r.URL.Path); rest == "" {
+				if strings.HasSuffix(r.URL.Path, "+") {
+					previewTinyURL(d, db, w, r)
+					return
+				}
+				if ext := path.Ext(r.URL.Path); ext == ".png" || ext == ".svg" {
+					qrTinyURL(d, db, w, r)
+					return
+				}
+			}
+			getTinyURL(cfg, d, db, w, r)
 		case "POST":
-			postTinyURL(cfg, db, w, r)
+			// "POST /{tiny}" of password protected link is unlocking. Others create a new link.
+			if tiny, _ := splitTinyPath(r.URL.Path); tiny != "" {
+				if link, err := db.GetLink(d.key, tiny); err == nil && link.PasswordHash != "" {
+					unlockTinyURL(cfg, d, db, limiter, link, w, r)
+					return
+				}
+			}
+			postTinyURL(cfg, d, db, w, r)
 		default:
 			Debugf("Request not allowed method '%s'\n", r.Method)
 			msg := fmt.Sprintf("HTTP method '%s' is not allowed.\n", r.Method)
@@ -71,70 +172,640 @@ func tinyURLHandleMiddle(cfg *Config, db *DB) func(http.ResponseWriter, *http.Re
 	}
 }
 
-func getTinyURL(cfg *Config, db *DB, w http.ResponseWriter, r *http.Request) {
+// requestDomain returns the domain r is sent to. Requests to hosts not served get 404.
+func requestDomain(cfg *Config, w http.ResponseWriter, r *http.Request) (*Domain, bool) {
+	host := requestHost(cfg, r)
+	d, ok := cfg.domainOf(host)
+	if !ok {
+		Infof("Request to unknown host '%s' from %s\n", host, r.RemoteAddr)
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(fmt.Sprintf("Host '%s' is not served.\n", host)))
+		return nil, false
+	}
+	d.baseURL = cfg.baseURL(d, host, r)
+	return d, true
+}
+
+func getTinyURL(cfg *Config, d *Domain, db *DB, w http.ResponseWriter, r *http.Request) {
 	Debugf("Request redirect of tiny '%s' from %s\n", r.URL.Path, r.RemoteAddr)
-	origin, err := db.GetOriginURL(r.URL.Path[1:])
+	tiny, rest := splitTinyPath(r.URL.Path)
+	link, err := db.GetLink(d.key, tiny)
+	if err != nil || (rest != "" && !link.ForwardPath) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(fmt.Sprintf("'%s' is not found.\n", r.RequestURI)))
+		return
+	}
+	if link.RemainingClicks != nil && *link.RemainingClicks <= 0 {
+		writeGone(w, r)
+		return
+	}
+	if _, active, startAt := link.scheduledOrigin(time.Now()); !active {
+		writeInactive(w, startAt)
+		return
+	}
+	if link.PasswordHash != "" {
+		writeUnlockForm(w, http.StatusOK, link, "")
+		return
+	}
+	code := link.RedirectCode
+	if code == 0 {
+		code = d.DefaultRedirectCode
+	}
+	redirectLink(cfg, d, db, w, r, link, code)
+}
+
+// redirectLink sends the visitor to the origin of link with code, and counts the click.
+// A click of a link with limited clicks is consumed before redirecting, and the link is gone if no click remains.
+// Broken links use the fallback URL of the domain if the link doesn't have its own.
+func redirectLink(cfg *Config, d *Domain, db *DB, w http.ResponseWriter, r *http.Request, link *Link, code int) {
+	origin, active, startAt := link.scheduledOrigin(time.Now())
+	if !active {
+		writeInactive(w, startAt)
+		return
+	}
+	fallback := false
+	if link.Broken && cfg.BrokenLinkAction != BROKEN_LINK_REDIRECT {
+		fallbackURL := link.FallbackURL
+		if fallbackURL == "" {
+			fallbackURL = d.FallbackURL
+		}
+		if cfg.BrokenLinkAction != BROKEN_LINK_FALLBACK || fallbackURL == "" {
+			writeBroken(w)
+			return
+		}
+		// the fallback is temporary until the origin recovers.
+		fallback = true
+		origin = fallbackURL
+		code = http.StatusFound
+	}
+
+	ok, err := db.CountClick(link)
 	if err != nil {
+		// the limit can't be guaranteed.
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Internal server error.\n"))
+		Errorf("Consuming click of '%s' is failed. Error: %v\n", link.Tiny, err)
+		return
+	}
+	if !ok {
+		writeGone(w, r)
+		return
+	}
+
+	// targeting rules take precedence over variants. origin by the schedule is used if neither applies.
+	var target *LinkTarget
+	if !fallback {
+		target = link.selectTarget(r)
+	}
+	if len(link.Targets) > 0 {
+		w.Header().Set("Vary", "User-Agent, Accept-Language")
+	}
+	if target != nil {
+		origin = target.Origin
+		db.CountTargetHit(target)
+	} else if len(link.Variants) > 0 && !fallback {
+		if variant := link.selectVariant(visitorID(w, r)); variant != nil {
+			origin = variant.Origin
+			db.CountVariantClick(variant)
+		}
+	}
+
+	// limited links must reach the server every time so that every click is consumed,
+	// links with UTM template so that changes of the template take effect, and split and scheduled links so that
+	// no client or intermediary caching a permanent redirect pins a variant or a schedule entry.
+	if link.RemainingClicks != nil || link.UTMTemplate != "" || len(link.Variants) > 0 || len(link.Schedule) > 0 {
+		code = temporaryRedirectCode(code)
+	}
+	// temporary redirects, split and scheduled links must reach the server every time,
+	// so that retargeting the link takes effect and every click of variants is counted.
+	if !REDIRECT_CODES[code] || len(link.Variants) > 0 || len(link.Schedule) > 0 {
+		w.Header().Set("Cache-Control", "private, no-cache, no-store, must-revalidate")
+	}
+	w.Header().Set("Location", destination(cfg, db, link, origin, r))
+	w.WriteHeader(code)
+}
+
+// temporaryRedirectCode returns the temporary redirect code of code (301 to 302, 308 to 307), which browsers do not cache.
+func temporaryRedirectCode(code int) int {
+	switch code {
+	case http.StatusMovedPermanently:
+		return http.StatusFound
+	case http.StatusPermanentRedirect:
+		return http.StatusTemporaryRedirect
+	}
+	return code
+}
+
+// splitTinyPath splits "/{tiny}/sub/path" into the tiny and "/sub/path".
+func splitTinyPath(p string) (tiny string, rest string) {
+	p = strings.TrimPrefix(p, "/")
+	if i := strings.Index(p, "/"); i >= 0 {
+		return p[:i], p[i:]
+	}
+	return p, ""
+}
+
+// destination returns the URL the visitor of link is sent to by request r, based on origin.
+// If the link forwards path, the path after the tiny is appended to the path of the origin.
+// Parameters of UTM template and then, if the link forwards query, parameters of the request are added to the origin.
+// Parameters added earlier take precedence, so the origin's own parameters are never overwritten.
+func destination(cfg *Config, db *DB, link *Link, origin string, r *http.Request) string {
+	_, rest := splitTinyPath(r.URL.EscapedPath())
+	forwardPath := link.ForwardPath && rest != ""
+	forwardQuery := link.ForwardQuery && r.URL.RawQuery != ""
+	var utm map[string]string
+	if link.UTMTemplate != "" {
+		var ok bool
+		if utm, ok = db.UTMTemplate(cfg, link.UTMTemplate); !ok {
+			Warnf("UTM template '%s' of '%s' is not in config.\n", link.UTMTemplate, link.Tiny)
+		}
+	}
+	if !forwardPath && !forwardQuery && len(utm) == 0 {
+		return origin
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		Warnf("Origin of '%s' can't be parsed. Error: %v\n", link.Tiny, err)
+		return origin
+	}
+	if forwardPath {
+		rawPath := strings.TrimSuffix(u.EscapedPath(), "/") + rest
+		if p, err := url.PathUnescape(rawPath); err == nil {
+			u.Path = p
+			u.RawPath = rawPath
+		}
+	}
+	if len(utm) > 0 {
+		params := url.Values{}
+		for key, value := range utm {
+			params.Set(key, value)
+		}
+		addQuery(u, params)
+	}
+	if forwardQuery {
+		addQuery(u, r.URL.Query())
+	}
+	return u.String()
+}
+
+// addQuery adds params to u except the ones u already has.
+func addQuery(u *url.URL, params url.Values) {
+	current := u.Query()
+	extra := url.Values{}
+	for key, values := range params {
+		if _, exist := current[key]; !exist {
+			extra[key] = values
+		}
+	}
+	if len(extra) == 0 {
+		return
+	}
+	if u.RawQuery != "" {
+		u.RawQuery += "&"
+	}
+	u.RawQuery += extra.Encode()
+}
+
+// writeInactive tells that the link starts redirecting at startAt.
+func writeInactive(w http.ResponseWriter, startAt time.Time) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(startAt).Seconds())+1))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	writeMessage(w, "This link is not active yet. It starts at "+startAt.UTC().Format(time.RFC3339)+".")
+}
+
+func writeMessage(w http.ResponseWriter, message string) {
+	if messageTemplate == nil {
+		w.Write([]byte(message + "\n"))
+		return
+	}
+	if err := messageTemplate.Execute(w, struct{ Message string }{message}); err != nil {
+		Errorf("Executing message template is failed. Error: %v\n", err)
+	}
+}
+
+// writeBroken tells that the origin of the link doesn't work now.
+func writeBroken(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusBadGateway)
+	writeMessage(w, "The destination of this link is not working now. Please try again later.")
+}
+
+// writeGone tells that the link has been used up.
+func writeGone(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusGone)
+	w.Write([]byte(fmt.Sprintf("'%s' is no longer available.\n", r.URL.Path)))
+}
+
+// unlockTinyURL checks the password posted to a protected link and redirects to its origin if it is correct.
+// Attempts are throttled per link, which is tiny path on the domain.
+func unlockTinyURL(cfg *Config, d *Domain, db *DB, limiter *AttemptLimiter, link *Link, w http.ResponseWriter, r *http.Request) {
+	Debugf("Request unlock of tiny '%s' from %s\n", link.Tiny, r.RemoteAddr)
+	key := cacheKey(link.Domain, link.Tiny)
+	if ok, retryAfter := limiter.Allow(key); !ok {
+		Warnf("Unlock of tiny '%s' is throttled. Request from %s\n", link.Tiny, r.RemoteAddr)
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+		writeUnlockForm(w, http.StatusTooManyRequests, link, "Too many attempts. Please try again later.")
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxBodySize)
+	if !CheckPassword(link.PasswordHash, r.PostFormValue("password")) {
+		Infof("Wrong password for tiny '%s' from %s\n", link.Tiny, r.RemoteAddr)
+		writeUnlockForm(w, http.StatusUnauthorized, link, "Password is incorrect.")
+		return
+	}
+	limiter.Reset(key)
+	// 303 makes the browser follow the origin by GET, and it must not be cached.
+	redirectLink(cfg, d, db, w, r, link, http.StatusSeeOther)
+}
+
+func writeUnlockForm(w http.ResponseWriter, status int, link *Link, message string) {
+	if unlockTemplate == nil {
+		w.Header().Set("Cache-Control", "no-store")
+		writePageNotFound(w)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := unlockTemplate.Execute(w, struct{ Message string }{message}); err != nil {
+		Errorf("Executing unlock template is failed. Error: %v\n", err)
+	}
+}
+
+type LinkPreview struct {
+	Tiny string `json:"Tiny"`
+	// Origin is where the link goes now by its schedule. It is empty if the link is protected by password,
+	// has limited clicks or is not active yet.
+	Origin    string `json:"Origin"`
+	Protected bool   `json:"Protected"`
+	// ActiveAt is the time the link becomes active if it is not active yet.
+	ActiveAt  *time.Time `json:"ActiveAt,omitempty"`
+	CreatedAt time.Time  `json:"CreatedAt"`
+	Clicks    int64      `json:"Clicks"`
+	// RemainingClicks is nil if the link is unlimited.
+	RemainingClicks *int64 `json:"RemainingClicks,omitempty"`
+	// Metadata is nil if Origin is empty or not the origin the metadata is read from.
+	Metadata *LinkMetadata `json:"Metadata,omitempty"`
+}
+
+// previewTinyURL shows where "/{tiny}+" goes without redirecting.
+func previewTinyURL(d *Domain, db *DB, w http.ResponseWriter, r *http.Request) {
+	tiny := strings.TrimSuffix(r.URL.Path[1:], "+")
+	Debugf("Request preview of tiny '%s' from %s\n", tiny, r.RemoteAddr)
+	wantsJSON := strings.Contains(r.Header.Get("Accept"), "application/json")
+
+	link, err := db.LoadLink(d.key, tiny)
+	if err != nil {
+		if wantsJSON {
+			writeJSON(w, http.StatusNotFound, ErrorResponse{Error: fmt.Sprintf("'%s' is not found.\n", tiny)})
+			return
+		}
 		w.WriteHeader(http.StatusNotFound)
 		w.Write([]byte(fmt.Sprintf("'%s' is not found.\n", r.RequestURI)))
 		return
 	}
-	w.Header().Set("Location", origin)
-	w.WriteHeader(http.StatusMovedPermanently)
+
+	origin, active, startAt := link.scheduledOrigin(time.Now())
+	preview := LinkPreview{
+		Tiny:      shortURL(d, link.Tiny),
+		Origin:    origin,
+		Protected: link.PasswordHash != "",
+		CreatedAt: link.CreatedAt,
+		Clicks:    link.Clicks,
+
+		RemainingClicks: link.RemainingClicks,
+		Metadata:        link.Metadata,
+	}
+	// the origin of limited links (e.g. one-time invitations) must be reached only by consuming a click.
+	if preview.Protected || preview.RemainingClicks != nil {
+		preview.Origin = ""
+	}
+	if !active {
+		preview.ActiveAt = &startAt
+	}
+	if preview.Origin != link.Origin {
+		preview.Metadata = nil
+	}
+	if wantsJSON {
+		writeJSON(w, http.StatusOK, preview)
+		return
+	}
+	if previewTemplate == nil {
+		writePageNotFound(w)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err = previewTemplate.Execute(w, preview); err != nil {
+		Errorf("Executing preview template is failed. Error: %v\n", err)
+	}
+}
+
+// qrTinyURL responds QR code of the tiny URL for "/{tiny}.png" and "/{tiny}.svg".
+func qrTinyURL(d *Domain, db *DB, w http.ResponseWriter, r *http.Request) {
+	ext := path.Ext(r.URL.Path)
+	tiny := strings.TrimSuffix(r.URL.Path[1:], ext)
+	Debugf("Request QR code of tiny '%s' from %s\n", tiny, r.RemoteAddr)
+
+	if _, err := db.GetLink(d.key, tiny); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(fmt.Sprintf("'%s' is not found.\n", r.RequestURI)))
+		return
+	}
+	opt, err := ParseQROptions(r.URL.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	}
+
+	var buf bytes.Buffer
+	if ext == ".png" {
+		w.Header().Set("Content-Type", "image/png")
+		err = WriteQRPNG(&buf, shortURL(d, tiny), opt)
+	} else {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		err = WriteQRSVG(&buf, shortURL(d, tiny), opt)
+	}
+	if err != nil {
+		Errorf("Creating QR code of '%s' is failed. Error: %v\n", tiny, err)
+		w.Header().Del("Content-Type")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Write(buf.Bytes())
+}
+
+// page is the data of pageTemplate. Account is nil if the user is not logged in.
+type page struct {
+	TinyPost
+	Account *Account
+}
+
+func newPage(r *http.Request, post TinyPost) page {
+	return page{TinyPost: post, Account: accountOf(requestSession(r))}
+}
+
+// shortURL returns the URL users access for tiny.
+func shortURL(d *Domain, tiny string) string {
+	return d.baseURL + "/" + tiny
 }
 
 type TinyPost struct {
-	Origin string `json:"Origin"`
-	Tiny   string `json:"Tiny"`
-	Error  string `json:"Error"`
+	Origin       string `json:"Origin"`
+	Tiny         string `json:"Tiny"`
+	RedirectCode int    `json:"RedirectCode,omitempty"`
+	// Password protects the new link. It is never returned.
+	Password string `json:"Password,omitempty"`
+	// MaxClicks limits the number of redirects. 0 means unlimited.
+	MaxClicks    int64 `json:"MaxClicks,omitempty"`
+	ForwardQuery bool  `json:"ForwardQuery,omitempty"`
+	ForwardPath  bool  `json:"ForwardPath,omitempty"`
+	// UTMTemplate is the name of UTM template in config.
+	UTMTemplate string `json:"UTMTemplate,omitempty"`
+	// Metadata is the title, description and Open Graph tags of the origin. It is ignored in requests.
+	Metadata *LinkMetadata `json:"Metadata,omitempty"`
+	Error    string        `json:"Error"`
 }
 
-func postTinyURL(cfg *Config, db *DB, w http.ResponseWriter, r *http.Request) {
+func postTinyURL(cfg *Config, d *Domain, db *DB, w http.ResponseWriter, r *http.Request) {
 	Debugf("New URL is posted from %s\n", r.RemoteAddr)
 
-	body := make([]byte, int(r.ContentLength))
-	_, err := r.Body.Read(body)
-	if err != io.EOF {
-		Warnf("Request's body might have been read all.\n")
+	data, mediaType, err := readTinyPost(cfg, w, r)
+	if err != nil {
+		status := http.StatusBadRequest
+		if err == errUnsupportedMediaType {
+			status = http.StatusUnsupportedMediaType
+		} else if err == errBodyTooLarge {
+			status = http.StatusRequestEntityTooLarge
+		}
+		Debugf("Posted body is invalid. Error: %v\n", err)
+		writeTinyPost(w, r, mediaType, status, TinyPost{Error: err.Error() + "\n"})
+		return
 	}
 
-	data := TinyPost{}
-	err = json.Unmarshal(body, &data)
+	link, status, message := newLinkFromPost(cfg, db, d, data)
+	if link == nil {
+		writeTinyPost(w, r, mediaType, status, TinyPost{Origin: data.Origin, Error: message})
+		return
+	}
+	if user := requestUser(r); user != nil {
+		link.OwnerID = user.ID
+	}
+
+	added, err := db.AddLinks([]*Link{link}, d.TinyLength, requestActor(cfg, r))
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		rBody, _ := json.Marshal(TinyPost{Error: "Internal server error.\n"})
-		w.Write(rBody)
-		Errorf("JsonUnmarshalError: %v\n", err)
+		writeTinyPost(w, r, mediaType, http.StatusInternalServerError, TinyPost{Origin: data.Origin, Error: "Internal server error.\n"})
+		Errorf("AddTinyURLError: %v\n", err)
 		return
 	}
 
+	writeTinyPost(w, r, mediaType, http.StatusOK, linkPost(d, added[0]))
+}
+
+var errUnsupportedMediaType = errors.New("Content-Type must be application/json, application/x-www-form-urlencoded or text/plain")
+
+// readTinyPost parses the body of "POST /" by its Content-Type, and returns the media type the body is parsed as.
+// JSON of TinyPost, form having "url" and options in snake case (e.g. "max_clicks"), and plain text of only the URL are accepted.
+// Bodies starting with '{' are parsed as JSON whatever Content-Type is, since `curl -d '{...}'` sends JSON as form.
+func readTinyPost(cfg *Config, w http.ResponseWriter, r *http.Request) (data *TinyPost, mediaType string, err error) {
+	mediaType = MEDIA_TYPE_TEXT
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		if mediaType, _, err = mime.ParseMediaType(contentType); err != nil {
+			return nil, MEDIA_TYPE_TEXT, errUnsupportedMediaType
+		}
+	}
+	body, err := readBody(cfg, w, r)
+	if err != nil {
+		return nil, mediaType, err
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(body), []byte("{")) {
+		mediaType = MEDIA_TYPE_JSON
+	}
+
+	data = &TinyPost{}
+	switch mediaType {
+	case MEDIA_TYPE_JSON:
+		if err = decodeJSON(body, data); err != nil {
+			return nil, mediaType, errors.New(fmt.Sprintf("JSON is invalid: %v", err))
+		}
+	case MEDIA_TYPE_FORM:
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil, mediaType, errors.New(fmt.Sprintf("form is invalid: %v", err))
+		}
+		if err = parseTinyPostForm(form, data); err != nil {
+			return nil, mediaType, err
+		}
+	case MEDIA_TYPE_TEXT:
+		data.Origin = strings.TrimSpace(string(body))
+		if strings.ContainsAny(data.Origin, " \t\r\n") {
+			return nil, mediaType, errors.New("plain text must have only an URL")
+		}
+	default:
+		return nil, MEDIA_TYPE_TEXT, errUnsupportedMediaType
+	}
+	if data.Origin == "" {
+		return nil, mediaType, errors.New("URL is required")
+	}
+	return data, mediaType, nil
+}
+
+func parseTinyPostForm(form url.Values, data *TinyPost) error {
+	data.Origin = strings.TrimSpace(form.Get("url"))
+	data.Password = form.Get("password")
+	data.UTMTemplate = form.Get("utm_template")
+	var err error
+	if v := form.Get("redirect_code"); v != "" {
+		if data.RedirectCode, err = strconv.Atoi(v); err != nil {
+			return errors.New(fmt.Sprintf("redirect_code '%s' is not number", v))
+		}
+	}
+	if v := form.Get("max_clicks"); v != "" {
+		if data.MaxClicks, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return errors.New(fmt.Sprintf("max_clicks '%s' is not number", v))
+		}
+	}
+	for name, flag := range map[string]*bool{"forward_query": &data.ForwardQuery, "forward_path": &data.ForwardPath} {
+		// checked checkboxes send "on".
+		if v := form.Get(name); v == "on" {
+			*flag = true
+		} else if v != "" {
+			if *flag, err = strconv.ParseBool(v); err != nil {
+				return errors.New(fmt.Sprintf("%s '%s' is not boolean", name, v))
+			}
+		}
+	}
+	return nil
+}
+
+// writeTinyPost writes post in the first of JSON, HTML and plain text found in Accept header.
+// If Accept has none of them, the media type of the request is used (plain text for forms). HTML is skipped if the page template isn't parsed.
+// Plain text is the tiny URL or the error message, and HTML is the page showing the result.
+func writeTinyPost(w http.ResponseWriter, r *http.Request, requestMediaType string, status int, post TinyPost) {
+	mediaType := requestMediaType
+	if mediaType != MEDIA_TYPE_JSON {
+		mediaType = MEDIA_TYPE_TEXT
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if t, _, err := mime.ParseMediaType(accept); err == nil && (t == MEDIA_TYPE_JSON || (t == MEDIA_TYPE_HTML && pageTemplate != nil) || t == MEDIA_TYPE_TEXT) {
+			mediaType = t
+			break
+		}
+	}
+
+	switch mediaType {
+	case MEDIA_TYPE_JSON:
+		writeJSON(w, status, post)
+	case MEDIA_TYPE_HTML:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(status)
+		if err := pageTemplate.Execute(w, newPage(r, post)); err != nil {
+			Errorf("Executing page template is failed. Error: %v\n", err)
+		}
+	default:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(status)
+		if post.Error != "" {
+			w.Write([]byte(post.Error))
+		} else {
+			w.Write([]byte(post.Tiny + "\n"))
+		}
+	}
+}
+
+// newLinkFromPost validates data and requests the origin, and returns the link to add with metadata of the origin.
+// If link is nil, status and message describe why data is invalid.
+func newLinkFromPost(cfg *Config, db *DB, d *Domain, data *TinyPost) (link *Link, status int, message string) {
+	if data.RedirectCode != 0 && !IsValidRedirectCode(data.RedirectCode) {
+		return nil, http.StatusBadRequest, "Redirect code must be 301, 302, 307 or 308.\n"
+	}
+	if _, ok := db.UTMTemplate(cfg, data.UTMTemplate); data.UTMTemplate != "" && !ok {
+		return nil, http.StatusBadRequest, fmt.Sprintf("UTM template '%s' is not found.\n", data.UTMTemplate)
+	}
+	if data.MaxClicks < 0 {
+		return nil, http.StatusBadRequest, "Max clicks must be 0 or positive number.\n"
+	}
+	var remainingClicks *int64
+	if data.MaxClicks > 0 {
+		maxClicks := data.MaxClicks
+		remainingClicks = &maxClicks
+	}
+
+	var passwordHash string
+	if data.Password != "" {
+		var err error
+		if passwordHash, err = HashPassword(data.Password); err != nil {
+			return nil, http.StatusBadRequest, err.Error() + "\n"
+		}
+	}
+
 	c := http.Client{Timeout: time.Second * 10}
-	if resp, err := c.Get(data.Origin); err != nil || resp.StatusCode >= 300 || resp.StatusCode < 200 {
+	resp, err := c.Get(data.Origin)
+	if err != nil || resp.StatusCode >= 300 || resp.StatusCode < 200 {
 		if err != nil {
 			Warnf("HEAD request for origin is failed. Error: %v\n", err)
 		} else {
+			resp.Body.Close()
 			Infof("Unexpected status code '%d' is returned by HEAD request for origin\n", resp.StatusCode)
 		}
-		w.WriteHeader(http.StatusUnprocessableEntity)
-		rBody, _ := json.Marshal(TinyPost{Error: "Content of requested URL is invalid.\n"})
-		w.Write(rBody)
-		return
+		return nil, http.StatusUnprocessableEntity, "Content of requested URL is invalid.\n"
 	}
+	metadata := ReadMetadata(resp)
 
-	tiny, err := db.AddTinyURL(data.Origin)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		rBody, _ := json.Marshal(TinyPost{Error: "Internal server error.\n"})
-		w.Write(rBody)
-		Errorf("AddTinyURLError: %v\n", err)
-		return
+	return &Link{Domain: d.key, Origin: data.Origin, RedirectCode: data.RedirectCode, PasswordHash: passwordHash, RemainingClicks: remainingClicks,
+		ForwardQuery: data.ForwardQuery, ForwardPath: data.ForwardPath, UTMTemplate: data.UTMTemplate, Metadata: metadata}, http.StatusOK, ""
+}
+
+// linkPost is the response of the link added by POST.
+func linkPost(d *Domain, link *Link) TinyPost {
+	post := TinyPost{
+		Origin:       link.Origin,
+		Tiny:         shortURL(d, link.Tiny),
+		RedirectCode: link.RedirectCode,
+		ForwardQuery: link.ForwardQuery,
+		ForwardPath:  link.ForwardPath,
+		UTMTemplate:  link.UTMTemplate,
+		Metadata:     link.Metadata,
+	}
+	if link.RemainingClicks != nil {
+		post.MaxClicks = *link.RemainingClicks
+	}
+	return post
+}
+
+// apiKeyName returns the name of API key sent by "Authorization: Bearer <key>" header.
+func apiKeyName(cfg *Config, r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return "", false
+	}
+	key := []byte(strings.TrimPrefix(auth, "Bearer "))
+	for name, k := range cfg.APIKeys {
+		if subtle.ConstantTimeCompare(key, []byte(k)) == 1 {
+			return name, true
+		}
 	}
+	return "", false
+}
 
-	rBody, _ := json.Marshal(TinyPost{
-		Origin: data.Origin,
-		Tiny:   cfg.Protocol + "://" + r.Host + "/" + tiny,
-	})
-	w.Write(rBody)
+// requestActor returns who is sending the request, used for audit logs.
+func requestActor(cfg *Config, r *http.Request) string {
+	if name, ok := apiKeyName(cfg, r); ok {
+		return "key:" + name
+	}
+	if user := requestUser(r); user != nil {
+		return "user:" + user.Username
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
 }
 
 const pageHTML string = `
@@ -146,21 +817,33 @@ const pageHTML string = `
     <meta name="viewport" content="width=device-width,initial-scale=1.0,minimum-scale=1.0" />
   <body>
     <div class="title">tiny-url</div>
-    <div class="form">
-      <input id="url" type="text" placeholder="input text you want to shorten and enter!">
-      <div class="result">
-        tiny -> <span>http://yahoo.com/hogehoge</span>
+    <div class="account">{{with .Account}}{{.Username}} · {{end}}<a href="my">{{if .Account}}my links{{else}}login{{end}}</a></div>
+    <form class="form" method="POST" action="./">
+      {{with .Account}}<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">{{end}}
+      <input id="url" name="url" type="text" value="{{.Origin}}" placeholder="input text you want to shorten and enter!">
+      <div class="error">{{.Error}}</div>
+      <div class="result"{{if .Tiny}} style="display: block"{{end}}>
+        tiny -> <span>{{.Tiny}}</span>
+        <div class="meta">{{with .Metadata}}{{.Title}}{{end}}</div>
+        <img class="qr" alt="QR code" width="160" height="160"{{if .Tiny}} src="{{.Tiny}}.svg?size=160"{{end}}>
       </div>
-    </div>
+    </form>
     <script>
-      document.getElementById("url").addEventListener("change",()=> {
+      // without JavaScript, the form is submitted and the result page is returned.
+      document.querySelector(".form").addEventListener("submit", (e) => {
+        e.preventDefault();
         document.querySelector(".result").style.display = "none";
+        document.querySelector(".error").innerText = "";
         if(document.getElementById("url").value.match(/(http|https):\/\//) === null) {
           alert("Invalid format for URL.");
           return;
         }
         let xhr = new XMLHttpRequest();
-        xhr.open("POST", location.href+"api"); 
+        xhr.open("POST", e.target.action);
+        xhr.setRequestHeader("Content-Type", "application/json");
+        xhr.setRequestHeader("Accept", "application/json");
+        let csrfToken = document.querySelector("input[name=csrf_token]");
+        if (csrfToken) xhr.setRequestHeader("X-CSRF-Token", csrfToken.value);
         xhr.onload = () => {
 		  console.log("HTTP status code: " + xhr.statusText)
 	      if (xhr.status.toString().match(/2[0-9]{2}/) === null) {
@@ -169,8 +852,11 @@ const pageHTML string = `
 		  	alert("Request is failed.");
 			return;
 		  }
-          let tiny = JSON.parse(xhr.responseText).Tiny;
+          let res = JSON.parse(xhr.responseText);
+          let tiny = res.Tiny;
           document.querySelector(".result span").innerText = tiny;
+          document.querySelector(".result .meta").innerText = res.Metadata && res.Metadata.Title ? res.Metadata.Title : "";
+          document.querySelector(".result img").src = tiny + ".svg?size=160";
           document.querySelector(".result").style.display = "block";
         }
         xhr.send(JSON.stringify({Origin: document.getElementById("url").value}));
@@ -192,6 +878,10 @@ const pageHTML string = `
       font-size: 40px;
       text-align: center;
     }
+    .account {
+      margin-bottom: 10px;
+      text-align: center;
+    }
     .form {
       text-align: center;
       width: 80vw;
@@ -221,6 +911,19 @@ const pageHTML string = `
     .result span {
       user-select: all;
     }
+    .error {
+      margin-top: 10px;
+      color: rgb(200, 60, 60);
+    }
+    .result img {
+      display: block;
+      margin-top: 10px;
+    }
+    .result .meta {
+      margin-top: 5px;
+      font-size: 0.8em;
+      color: rgb(163, 162, 162);
+    }
 
     @media (min-width: 640px) {
       .title{
@@ -268,3 +971,198 @@ const pageHTML string = `
     </style>
 </html>
 `
+
+const previewHTML string = `
+<!DOCTYPE html>
+<html>
+  <head>
+    <meta charset="UTF-8" />
+    <title>{{with .Metadata}}{{.Title}} - {{end}}tiny-url preview</title>
+    <meta name="viewport" content="width=device-width,initial-scale=1.0,minimum-scale=1.0" />
+    <meta name="robots" content="noindex" />
+    <meta property="og:type" content="website" />
+    <meta property="og:url" content="{{.Tiny}}" />
+    {{with .Metadata}}
+    <meta property="og:title" content="{{if .Title}}{{.Title}}{{else}}{{$.Tiny}}{{end}}" />
+    {{if .Description}}<meta property="og:description" content="{{.Description}}" />{{end}}
+    {{if .SiteName}}<meta property="og:site_name" content="{{.SiteName}}" />{{end}}
+    {{if .Image}}<meta property="og:image" content="{{.Image}}" />{{end}}
+    <meta name="twitter:card" content="{{if .Image}}summary_large_image{{else}}summary{{end}}" />
+    {{else}}
+    <meta property="og:title" content="{{.Tiny}}" />
+    <meta name="twitter:card" content="summary" />
+    {{end}}
+  </head>
+  <body>
+    <div class="title">tiny-url</div>
+    <div class="preview">
+      <div class="tiny">{{.Tiny}}</div>
+      {{if .Protected}}
+      <div class="origin">This link is protected by password.</div>
+      {{else if .RemainingClicks}}
+      <div class="origin">This link can be opened only a limited number of times.</div>
+      {{else if .ActiveAt}}
+      <div class="origin">This link is not active yet. It starts at {{.ActiveAt.UTC.Format "2006-01-02 15:04 MST"}}.</div>
+      {{else}}
+      <div>goes to</div>
+      {{with .Metadata}}{{if .Title}}<div class="meta-title">{{.Title}}</div>{{end}}{{end}}
+      <div class="origin">{{.Origin}}</div>
+      {{with .Metadata}}{{if .Description}}<div class="meta-description">{{.Description}}</div>{{end}}{{end}}
+      {{end}}
+      <table>
+        <tr><th>Created</th><td>{{if .CreatedAt.IsZero}}-{{else}}{{.CreatedAt.Format "2006-01-02 15:04 MST"}}{{end}}</td></tr>
+        <tr><th>Clicks</th><td>{{.Clicks}}</td></tr>
+        {{if .RemainingClicks}}<tr><th>Remaining</th><td>{{.RemainingClicks}}</td></tr>{{end}}
+      </table>
+      <a class="continue" href="{{if .Origin}}{{.Origin}}{{else}}{{.Tiny}}{{end}}" rel="noopener noreferrer">Continue</a>
+    </div>
+  </body>
+  <style>
+    body,div {
+      margin:0px;
+      padding:0px;
+    }
+    body {
+      color: rgb(68, 67, 67);
+      font-family: 'Segoe UI', Tahoma, Geneva, Verdana, sans-serif;
+    }
+    .title {
+      margin-top: 80px;
+      margin-bottom: 15px;
+      font-size: 40px;
+      text-align: center;
+    }
+    .preview {
+      width: 80vw;
+      margin: 0px auto;
+      font-size: 16px;
+      text-align: center;
+    }
+    .origin {
+      margin: 10px 0px;
+      font-size: 20px;
+      word-break: break-all;
+    }
+    .meta-title {
+      margin-top: 10px;
+      font-size: 24px;
+    }
+    .meta-description {
+      color: rgb(120, 119, 119);
+    }
+    .preview table {
+      margin: 10px auto;
+      text-align: left;
+    }
+    .preview th {
+      padding-right: 15px;
+      font-weight: normal;
+      color: rgb(163, 162, 162);
+    }
+    .continue {
+      display: inline-block;
+      margin-top: 15px;
+      padding: 6px 24px;
+      border-radius: 4px;
+      color: white;
+      background-color: rgb(68, 67, 67);
+      text-decoration: none;
+    }
+    @media (min-width: 960px) {
+      .preview {
+        width: 50%;
+      }
+    }
+  </style>
+</html>
+`
+
+const messageHTML string = `
+<!DOCTYPE html>
+<html>
+  <head>
+    <meta charset="UTF-8" />
+    <title>tiny-url</title>
+    <meta name="viewport" content="width=device-width,initial-scale=1.0,minimum-scale=1.0" />
+    <meta name="robots" content="noindex" />
+  </head>
+  <body>
+    <div class="title">tiny-url</div>
+    <div class="message">{{.Message}}</div>
+  </body>
+  <style>
+    body,div {
+      margin:0px;
+      padding:0px;
+    }
+    body {
+      color: rgb(68, 67, 67);
+      font-family: 'Segoe UI', Tahoma, Geneva, Verdana, sans-serif;
+    }
+    .title {
+      margin-top: 80px;
+      margin-bottom: 15px;
+      font-size: 40px;
+      text-align: center;
+    }
+    .message {
+      width: 80vw;
+      margin: 0px auto;
+      font-size: 16px;
+      text-align: center;
+    }
+  </style>
+</html>
+`
+
+const unlockHTML string = `
+<!DOCTYPE html>
+<html>
+  <head>
+    <meta charset="UTF-8" />
+    <title>tiny-url</title>
+    <meta name="viewport" content="width=device-width,initial-scale=1.0,minimum-scale=1.0" />
+    <meta name="robots" content="noindex" />
+  </head>
+  <body>
+    <div class="title">tiny-url</div>
+    <form class="form" method="POST">
+      <div>This link is protected by password.</div>
+      <input name="password" type="password" placeholder="password" autofocus required>
+      <input type="submit" value="Continue">
+      {{if .Message}}<div class="message">{{.Message}}</div>{{end}}
+    </form>
+  </body>
+  <style>
+    body,div {
+      margin:0px;
+      padding:0px;
+    }
+    body {
+      color: rgb(68, 67, 67);
+      font-family: 'Segoe UI', Tahoma, Geneva, Verdana, sans-serif;
+    }
+    .title {
+      margin-top: 80px;
+      margin-bottom: 15px;
+      font-size: 40px;
+      text-align: center;
+    }
+    .form {
+      width: 80vw;
+      margin: 0px auto;
+      font-size: 16px;
+      text-align: center;
+    }
+    .form input {
+      margin-top: 10px;
+      font-size: 16px;
+      padding: 4px 10px;
+    }
+    .message {
+      margin-top: 10px;
+      color: rgb(200, 50, 50);
+    }
+  </style>
+</html>
+`
@@ -0,0 +1,1255 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testAPIKey = "test-api-key"
+
+func TestMain(m *testing.M) {
+	parseTemplates()
+	os.Exit(m.Run())
+}
+
+// startTestServer starts tiny-url server with a temporary database.
+func startTestServer(t *testing.T) (*httptest.Server, *Config, *DB) {
+	db := connectTempDB(t)
+	cfg := testDBConfig("")
+	cfg.APIKeys = map[string]string{"test": testAPIKey}
+	server := httptest.NewServer(CreateTinyURLServer(cfg, db))
+	t.Cleanup(server.Close)
+	return server, cfg, db
+}
+
+// noRedirectClient returns redirect responses as they are.
+var noRedirectClient = &http.Client{
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+func adminRequest(t *testing.T, method string, url string, body string) *http.Response {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+// getPreview returns the preview of tinyURL as JSON.
+func getPreview(t *testing.T, tinyURL string) LinkPreview {
+	req, _ := http.NewRequest("GET", tinyURL+"+", nil)
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var preview LinkPreview
+	if err = json.NewDecoder(resp.Body).Decode(&preview); err != nil {
+		t.Fatal(err)
+	}
+	return preview
+}
+
+func TestRedirectCode(t *testing.T) {
+	server, _, db := startTestServer(t)
+
+	permanent, err := db.AddLink(&Link{Origin: "https://example.com/"}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	temporary, err := db.AddLink(&Link{Origin: "https://example.com/", RedirectCode: http.StatusFound}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if permanent.Tiny == temporary.Tiny {
+		t.Fatal("links with different redirect codes are expected not to be shared")
+	}
+
+	resp, err := noRedirectClient.Get(server.URL + "/" + permanent.Tiny)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMovedPermanently || resp.Header.Get("Cache-Control") != "" {
+		t.Fatalf("real: %d %s  expected: 301 without Cache-Control\n", resp.StatusCode, resp.Header.Get("Cache-Control"))
+	}
+
+	resp, err = noRedirectClient.Get(server.URL + "/" + temporary.Tiny)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound || !strings.Contains(resp.Header.Get("Cache-Control"), "no-store") {
+		t.Fatalf("real: %d %s  expected: 302 with no-store\n", resp.StatusCode, resp.Header.Get("Cache-Control"))
+	}
+
+	// retarget the link by admin API.
+	resp = adminRequest(t, "PATCH", server.URL+"/admin/links/"+temporary.Tiny, `{"Origin":"https://example.com/new","RedirectCode":307}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("real: %d  expected: 200\n", resp.StatusCode)
+	}
+	resp, err = noRedirectClient.Get(server.URL + "/" + temporary.Tiny)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTemporaryRedirect || resp.Header.Get("Location") != "https://example.com/new" {
+		t.Fatalf("real: %d %s  expected: 307 https://example.com/new\n", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	resp = adminRequest(t, "PATCH", server.URL+"/admin/links/"+temporary.Tiny, `{"RedirectCode":303}`)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("real: %d  expected: 400\n", resp.StatusCode)
+	}
+
+	resp = adminRequest(t, "DELETE", server.URL+"/admin/links/"+temporary.Tiny, "")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("real: %d  expected: 204\n", resp.StatusCode)
+	}
+	resp, err = noRedirectClient.Get(server.URL + "/" + temporary.Tiny)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("real: %d  expected: 404\n", resp.StatusCode)
+	}
+
+	logs, err := db.GetAuditLogs(AuditFilter{Tiny: temporary.Tiny})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 3 || logs[1].Action != AUDIT_UPDATE || logs[2].Action != AUDIT_DELETE || logs[2].Actor != "key:test" {
+		t.Fatalf("unexpected logs: %+v\n", logs)
+	}
+}
+
+func TestPreview(t *testing.T) {
+	server, _, db := startTestServer(t)
+	link, err := db.AddLink(&Link{Origin: "https://example.com/preview?a=b"}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		resp, err := noRedirectClient.Get(server.URL + "/" + link.Tiny)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	resp, err := http.Get(server.URL + "/" + link.Tiny + "+")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "https://example.com/preview?a=b") {
+		t.Fatalf("real: %d\n%s\n", resp.StatusCode, body)
+	}
+
+	if err = db.FlushClicks(); err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", server.URL+"/"+link.Tiny+"+", nil)
+	req.Header.Set("Accept", "application/json")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var preview LinkPreview
+	err = json.NewDecoder(resp.Body).Decode(&preview)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if preview.Origin != link.Origin || preview.Clicks != 2 || preview.Tiny != server.URL+"/"+link.Tiny {
+		t.Fatalf("unexpected preview: %+v\n", preview)
+	}
+
+	resp, err = http.Get(server.URL + "/notfound+")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("real: %d  expected: 404\n", resp.StatusCode)
+	}
+}
+
+func TestQRCode(t *testing.T) {
+	server, _, db := startTestServer(t)
+	link, err := db.AddLink(&Link{Origin: "https://example.com/qr"}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ext, contentType := range map[string]string{".png": "image/png", ".svg": "image/svg+xml"} {
+		resp, err := http.Get(server.URL + "/" + link.Tiny + ext + "?size=128")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != contentType {
+			t.Fatalf("real: %d %s  expected: 200 %s\n", resp.StatusCode, resp.Header.Get("Content-Type"), contentType)
+		}
+	}
+
+	resp, err := http.Get(server.URL + "/" + link.Tiny + ".png?level=X")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("real: %d  expected: 400\n", resp.StatusCode)
+	}
+}
+
+func TestPasswordProtectedLink(t *testing.T) {
+	server, cfg, db := startTestServer(t)
+	hash, err := HashPassword("open sesame")
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, err := db.AddLink(&Link{Origin: "https://example.com/secret", PasswordHash: hash}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// unlock form is served instead of redirecting.
+	resp, err := noRedirectClient.Get(server.URL + "/" + link.Tiny)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Location") != "" {
+		t.Fatalf("real: %d %s  expected: 200 without Location\n", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	resp, err = noRedirectClient.PostForm(server.URL+"/"+link.Tiny, url.Values{"password": {"open sesame"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != link.Origin {
+		t.Fatalf("real: %d %s  expected: 303 %s\n", resp.StatusCode, resp.Header.Get("Location"), link.Origin)
+	}
+
+	for i := 0; i < cfg.PasswordMaxAttempts; i++ {
+		resp, err = noRedirectClient.PostForm(server.URL+"/"+link.Tiny, url.Values{"password": {"wrong"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("real: %d  expected: 401\n", resp.StatusCode)
+		}
+	}
+	// even the correct password is throttled after too many failures.
+	resp, err = noRedirectClient.PostForm(server.URL+"/"+link.Tiny, url.Values{"password": {"open sesame"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("real: %d  expected: 429 with Retry-After\n", resp.StatusCode)
+	}
+
+	// preview doesn't reveal the origin.
+	req, _ := http.NewRequest("GET", server.URL+"/"+link.Tiny+"+", nil)
+	req.Header.Set("Accept", "application/json")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var preview LinkPreview
+	err = json.NewDecoder(resp.Body).Decode(&preview)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !preview.Protected || preview.Origin != "" {
+		t.Fatalf("unexpected preview: %+v\n", preview)
+	}
+}
+
+func TestMaxClicks(t *testing.T) {
+	server, _, _ := startTestServer(t)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer origin.Close()
+	resp, err := http.Post(server.URL+"/", "application/json", strings.NewReader(`{"Origin":"`+origin.URL+`/","MaxClicks":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var post TinyPost
+	err = json.NewDecoder(resp.Body).Decode(&post)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || post.MaxClicks != 1 {
+		t.Fatalf("real: %d %+v  expected: 200 with MaxClicks 1\n", resp.StatusCode, post)
+	}
+
+	// preview doesn't tell the origin, which would bypass the limit.
+	if preview := getPreview(t, post.Tiny); preview.Origin != "" || preview.RemainingClicks == nil || *preview.RemainingClicks != 1 {
+		t.Fatalf("unexpected preview: %+v\n", preview)
+	}
+
+	// the default 301 is replaced by 302, which browsers don't cache.
+	for _, expected := range []int{http.StatusFound, http.StatusGone, http.StatusGone} {
+		resp, err = noRedirectClient.Get(post.Tiny)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Fatalf("real: %d  expected: %d\n", resp.StatusCode, expected)
+		}
+		if expected == http.StatusFound && !strings.Contains(resp.Header.Get("Cache-Control"), "no-store") {
+			t.Fatalf("real: %s  expected: no-store\n", resp.Header.Get("Cache-Control"))
+		}
+	}
+
+	// the limit can be reset by admin API.
+	tiny := post.Tiny[strings.LastIndex(post.Tiny, "/")+1:]
+	resp = adminRequest(t, "PATCH", server.URL+"/admin/links/"+tiny, `{"RemainingClicks":-1}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("real: %d  expected: 200\n", resp.StatusCode)
+	}
+	resp, err = noRedirectClient.Get(post.Tiny)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMovedPermanently {
+		t.Fatalf("real: %d  expected: 301\n", resp.StatusCode)
+	}
+}
+
+func TestForwardPathAndQuery(t *testing.T) {
+	server, _, db := startTestServer(t)
+	forward, err := db.AddLink(&Link{Origin: "https://example.com/docs/?lang=en", ForwardQuery: true, ForwardPath: true}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := db.AddLink(&Link{Origin: "https://example.com/docs/?lang=en"}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if forward.Tiny == plain.Tiny {
+		t.Fatal("links with different forwarding are expected not to be shared")
+	}
+
+	tests := []struct {
+		path     string
+		status   int
+		location string
+	}{
+		{"/" + forward.Tiny, http.StatusMovedPermanently, "https://example.com/docs/?lang=en"},
+		{"/" + forward.Tiny + "?utm_source=x", http.StatusMovedPermanently, "https://example.com/docs/?lang=en&utm_source=x"},
+		// parameters of the origin take precedence.
+		{"/" + forward.Tiny + "?lang=de&utm_source=x", http.StatusMovedPermanently, "https://example.com/docs/?lang=en&utm_source=x"},
+		{"/" + forward.Tiny + "/guide/a%20b?x=1", http.StatusMovedPermanently, "https://example.com/docs/guide/a%20b?lang=en&x=1"},
+		{"/" + plain.Tiny + "?utm_source=x", http.StatusMovedPermanently, "https://example.com/docs/?lang=en"},
+		{"/" + plain.Tiny + "/guide", http.StatusNotFound, ""},
+		// preview and QR code are not served for forwarded paths.
+		{"/" + forward.Tiny + "/logo.png", http.StatusMovedPermanently, "https://example.com/docs/logo.png?lang=en"},
+	}
+	for _, test := range tests {
+		resp, err := noRedirectClient.Get(server.URL + test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status || resp.Header.Get("Location") != test.location {
+			t.Fatalf("%s real: %d %s  expected: %d %s\n", test.path, resp.StatusCode, resp.Header.Get("Location"), test.status, test.location)
+		}
+	}
+}
+
+func TestUTMTemplate(t *testing.T) {
+	server, cfg, db := startTestServer(t)
+	cfg.UTMTemplates = map[string]map[string]string{
+		"newsletter": {"utm_source": "newsletter", "utm_medium": "email"},
+	}
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer origin.Close()
+
+	resp, err := http.Post(server.URL+"/", "application/json", strings.NewReader(`{"Origin":"`+origin.URL+`/sale?utm_medium=web","UTMTemplate":"unknown"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("real: %d  expected: 400\n", resp.StatusCode)
+	}
+
+	link, err := db.AddLink(&Link{Origin: origin.URL + "/sale?utm_medium=web", UTMTemplate: "newsletter", ForwardQuery: true}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := origin.URL + "/sale?utm_medium=web&utm_source=newsletter"
+	resp, err = noRedirectClient.Get(server.URL + "/" + link.Tiny + "?utm_source=x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get("Location") != expected {
+		t.Fatalf("real: %s  expected: %s\n", resp.Header.Get("Location"), expected)
+	}
+
+	// changing the template changes destinations of existing links.
+	cfg.UTMTemplates["newsletter"]["utm_source"] = "weekly"
+	resp, err = noRedirectClient.Get(server.URL + "/" + link.Tiny)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	expected = origin.URL + "/sale?utm_medium=web&utm_source=weekly"
+	if resp.Header.Get("Location") != expected {
+		t.Fatalf("real: %s  expected: %s\n", resp.Header.Get("Location"), expected)
+	}
+	// the redirect is not cached, so that the change reaches visitors who have clicked already.
+	if resp.StatusCode != http.StatusFound || !strings.Contains(resp.Header.Get("Cache-Control"), "no-store") {
+		t.Fatalf("real: %d %s  expected: 302 no-store\n", resp.StatusCode, resp.Header.Get("Cache-Control"))
+	}
+
+	// templates saved by admin API take precedence over config.
+	resp = adminRequest(t, "PUT", server.URL+"/admin/utm-templates/newsletter", `{"utm_source":"api"}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("real: %d  expected: 200\n", resp.StatusCode)
+	}
+	resp, err = noRedirectClient.Get(server.URL + "/" + link.Tiny)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	expected = origin.URL + "/sale?utm_medium=web&utm_source=api"
+	if resp.Header.Get("Location") != expected {
+		t.Fatalf("real: %s  expected: %s\n", resp.Header.Get("Location"), expected)
+	}
+	if resp = adminRequest(t, "PUT", server.URL+"/admin/utm-templates/campaign", `{"utm_source":""}`); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("real: %d  expected: 400\n", resp.StatusCode)
+	}
+
+	// the template of config is used again after the saved one is deleted.
+	if resp = adminRequest(t, "DELETE", server.URL+"/admin/utm-templates/newsletter", ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("real: %d  expected: 204\n", resp.StatusCode)
+	}
+	if resp = adminRequest(t, "DELETE", server.URL+"/admin/utm-templates/newsletter", ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("real: %d  expected: 404\n", resp.StatusCode)
+	}
+	// templates used by links can't be deleted.
+	if resp = adminRequest(t, "PUT", server.URL+"/admin/utm-templates/campaign", `{"utm_source":"campaign"}`); resp.StatusCode != http.StatusOK {
+		t.Fatalf("real: %d  expected: 200\n", resp.StatusCode)
+	}
+	if _, err = db.AddLink(&Link{Origin: origin.URL + "/campaign", UTMTemplate: "campaign"}, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if resp = adminRequest(t, "DELETE", server.URL+"/admin/utm-templates/campaign", ""); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("real: %d  expected: 409\n", resp.StatusCode)
+	}
+}
+
+func TestTargetedRedirect(t *testing.T) {
+	server, _, db := startTestServer(t)
+	link, err := db.AddLink(&Link{Origin: "https://example.com/"}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := adminRequest(t, "PUT", server.URL+"/admin/links/"+link.Tiny+"/targets", `[{"Kind":"device","Match":"watch","Origin":"https://example.com/watch"}]`)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("real: %d  expected: 400\n", resp.StatusCode)
+	}
+	resp = adminRequest(t, "PUT", server.URL+"/admin/links/"+link.Tiny+"/targets", `[
+		{"Kind":"device","Match":"ios","Origin":"https://apps.apple.com/app/id1"},
+		{"Kind":"device","Match":"android","Origin":"https://play.google.com/store/apps/details?id=x"},
+		{"Kind":"language","Match":"de","Origin":"https://example.de/"}
+	]`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("real: %d  expected: 200\n", resp.StatusCode)
+	}
+
+	tests := []struct {
+		ua       string
+		lang     string
+		location string
+	}{
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X)", "de-DE", "https://apps.apple.com/app/id1"},
+		{"Mozilla/5.0 (Linux; Android 14; Pixel 8)", "en", "https://play.google.com/store/apps/details?id=x"},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64)", "de-DE,en;q=0.5", "https://example.de/"},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64)", "de-AT", "https://example.de/"},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64)", "en-US", "https://example.com/"},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", server.URL+"/"+link.Tiny, nil)
+		req.Header.Set("User-Agent", test.ua)
+		req.Header.Set("Accept-Language", test.lang)
+		resp, err := noRedirectClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.Header.Get("Location") != test.location || resp.Header.Get("Vary") == "" {
+			t.Fatalf("%s %s real: %s  expected: %s with Vary\n", test.ua, test.lang, resp.Header.Get("Location"), test.location)
+		}
+	}
+
+	if err = db.FlushClicks(); err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", server.URL+"/admin/links/"+link.Tiny+"/targets", nil)
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var targets []*LinkTarget
+	err = json.NewDecoder(resp.Body).Decode(&targets)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 3 || targets[0].Hits != 1 || targets[1].Hits != 1 || targets[2].Hits != 2 {
+		body, _ := json.Marshal(targets)
+		t.Fatalf("unexpected targets: %s\n", body)
+	}
+
+	// hits of unchanged rules are kept.
+	resp = adminRequest(t, "PUT", server.URL+"/admin/links/"+link.Tiny+"/targets", `[{"Kind":"language","Match":"de","Origin":"https://example.de/"}]`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("real: %d  expected: 200\n", resp.StatusCode)
+	}
+	loaded, err := db.LoadLink("", link.Tiny)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Targets) != 1 || loaded.Targets[0].Hits != 2 {
+		t.Fatalf("unexpected targets: %+v\n", loaded.Targets)
+	}
+}
+
+func TestSplitRedirect(t *testing.T) {
+	server, _, db := startTestServer(t)
+	link, err := db.AddLink(&Link{Origin: "https://example.com/"}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := adminRequest(t, "PUT", server.URL+"/admin/links/"+link.Tiny+"/variants", `[
+		{"Origin":"https://example.com/a","Weight":1},
+		{"Origin":"https://example.com/b","Weight":1}
+	]`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("real: %d  expected: 200\n", resp.StatusCode)
+	}
+
+	// a visitor keeps the cookie and is always sent to the same variant.
+	resp, err = noRedirectClient.Get(server.URL + "/" + link.Tiny)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	first := resp.Header.Get("Location")
+	cookies := resp.Cookies()
+	if resp.StatusCode != http.StatusFound || len(cookies) != 1 || cookies[0].Name != VISITOR_COOKIE || !strings.Contains(resp.Header.Get("Cache-Control"), "no-store") {
+		t.Fatalf("real: %d %v %s  expected: 302 with visitor cookie and no-store\n", resp.StatusCode, cookies, resp.Header.Get("Cache-Control"))
+	}
+	for i := 0; i < 4; i++ {
+		req, _ := http.NewRequest("GET", server.URL+"/"+link.Tiny, nil)
+		req.AddCookie(cookies[0])
+		resp, err = noRedirectClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.Header.Get("Location") != first {
+			t.Fatalf("real: %s  expected: %s\n", resp.Header.Get("Location"), first)
+		}
+	}
+
+	if err = db.FlushClicks(); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := db.LoadLink("", link.Tiny)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, variant := range loaded.Variants {
+		expected := int64(0)
+		if variant.Origin == first {
+			expected = 5
+		}
+		if variant.Clicks != expected {
+			t.Fatalf("%s real: %d  expected: %d\n", variant.Origin, variant.Clicks, expected)
+		}
+	}
+
+	resp = adminRequest(t, "PUT", server.URL+"/admin/links/"+link.Tiny+"/variants", `[{"Origin":"https://example.com/a","Weight":-1}]`)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("real: %d  expected: 400\n", resp.StatusCode)
+	}
+}
+
+func TestScheduledLink(t *testing.T) {
+	server, _, db := startTestServer(t)
+	link, err := db.AddLink(&Link{Origin: "https://example.com/"}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	launch := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	resp := adminRequest(t, "PUT", server.URL+"/admin/links/"+link.Tiny+"/schedule", `[{"StartAt":"`+launch+`","Origin":"https://example.com/sale"}]`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("real: %d  expected: 200\n", resp.StatusCode)
+	}
+	resp, err = noRedirectClient.Get(server.URL + "/" + link.Tiny)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("real: %d  expected: 503 with Retry-After\n", resp.StatusCode)
+	}
+	if preview := getPreview(t, server.URL+"/"+link.Tiny); preview.Origin != "" || preview.ActiveAt == nil {
+		t.Fatalf("unexpected preview: %+v\n", preview)
+	}
+
+	started := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	resp = adminRequest(t, "PUT", server.URL+"/admin/links/"+link.Tiny+"/schedule", `[
+		{"StartAt":"`+launch+`","Origin":"https://example.com/sale-ended"},
+		{"StartAt":"`+started+`","Origin":"https://example.com/sale"}
+	]`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("real: %d  expected: 200\n", resp.StatusCode)
+	}
+	resp, err = noRedirectClient.Get(server.URL + "/" + link.Tiny)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "https://example.com/sale" || !strings.Contains(resp.Header.Get("Cache-Control"), "no-store") {
+		t.Fatalf("real: %d %s %s  expected: 302 https://example.com/sale with no-store\n", resp.StatusCode, resp.Header.Get("Location"), resp.Header.Get("Cache-Control"))
+	}
+	// preview shows the origin by the schedule, not the origin of the link.
+	if preview := getPreview(t, server.URL+"/"+link.Tiny); preview.Origin != "https://example.com/sale" || preview.ActiveAt != nil {
+		t.Fatalf("unexpected preview: %+v\n", preview)
+	}
+
+	resp = adminRequest(t, "PUT", server.URL+"/admin/links/"+link.Tiny+"/schedule", `[{"StartAt":"tomorrow","Origin":"https://example.com/sale"}]`)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("real: %d  expected: 400\n", resp.StatusCode)
+	}
+}
+
+func TestBrokenLinkAction(t *testing.T) {
+	server, cfg, db := startTestServer(t)
+	link, err := db.AddLink(&Link{Origin: "https://example.com/broken", FallbackURL: "https://example.com/fallback"}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("UPDATE urls SET broken = 1 WHERE id = ?", link.ID); err != nil {
+		t.Fatal(err)
+	}
+	db.invalidate(link)
+
+	tests := []struct {
+		action   string
+		status   int
+		location string
+	}{
+		{BROKEN_LINK_REDIRECT, http.StatusMovedPermanently, "https://example.com/broken"},
+		{BROKEN_LINK_FALLBACK, http.StatusFound, "https://example.com/fallback"},
+		{BROKEN_LINK_PAGE, http.StatusBadGateway, ""},
+	}
+	for _, test := range tests {
+		cfg.BrokenLinkAction = test.action
+		resp, err := noRedirectClient.Get(server.URL + "/" + link.Tiny)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status || resp.Header.Get("Location") != test.location {
+			t.Fatalf("%s real: %d %s  expected: %d %s\n", test.action, resp.StatusCode, resp.Header.Get("Location"), test.status, test.location)
+		}
+	}
+}
+
+func TestLinkMetadata(t *testing.T) {
+	server, _, db := startTestServer(t)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if r.URL.Path == "/plain" {
+			w.Write([]byte(`<html><body>plain</body></html>`))
+			return
+		}
+		w.Write([]byte(`<html><head><title>Example</title><meta property="og:description" content="An &quot;example&quot; page">` +
+			`<meta property="og:image" content="/image.png"></head><body>` + strings.Repeat("x", int(METADATA_MAX_BYTES)) + `</body></html>`))
+	}))
+	defer origin.Close()
+
+	resp, err := http.Post(server.URL+"/", "application/json", strings.NewReader(`{"Origin":"`+origin.URL+`/page"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var post TinyPost
+	err = json.NewDecoder(resp.Body).Decode(&post)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := LinkMetadata{Title: "Example", Description: `An "example" page`, Image: origin.URL + "/image.png"}
+	if resp.StatusCode != http.StatusOK || post.Metadata == nil || *post.Metadata != expected {
+		t.Fatalf("real: %d %+v  expected: 200 %+v\n", resp.StatusCode, post.Metadata, expected)
+	}
+
+	resp, err = http.Get(post.Tiny + "+")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	for _, tag := range []string{
+		`<meta property="og:title" content="Example" />`,
+		`<meta property="og:description" content="An &#34;example&#34; page" />`,
+		`<meta property="og:image" content="` + origin.URL + `/image.png" />`,
+		`<meta property="og:url" content="` + post.Tiny + `" />`,
+	} {
+		if !strings.Contains(string(body), tag) {
+			t.Fatalf("preview doesn't have '%s'\n%s\n", tag, body)
+		}
+	}
+
+	// metadata of the old origin is not kept for the new one.
+	tiny := strings.TrimPrefix(post.Tiny, server.URL+"/")
+	resp = adminRequest(t, "PATCH", server.URL+"/admin/links/"+tiny, `{"Origin":"`+origin.URL+`/plain"}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("real: %d  expected: 200\n", resp.StatusCode)
+	}
+	link, err := db.LoadLink("", tiny)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link.Metadata != nil {
+		t.Fatalf("real: %+v  expected: <nil>\n", link.Metadata)
+	}
+}
+
+func TestPostFormats(t *testing.T) {
+	server, _, _ := startTestServer(t)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer origin.Close()
+
+	tests := []struct {
+		contentType string
+		accept      string
+		body        string
+		status      int
+		// resultType is Content-Type of the response, and result is what the body must have.
+		resultType string
+		result     string
+	}{
+		{"application/x-www-form-urlencoded", "", "url=" + url.QueryEscape(origin.URL+"/form") + "&max_clicks=2&forward_query=on", http.StatusOK, "text/plain", server.URL + "/"},
+		{"text/plain", "", origin.URL + "/text\n", http.StatusOK, "text/plain", server.URL + "/"},
+		{"text/plain; charset=utf-8", "application/json", origin.URL + "/text", http.StatusOK, "application/json", `"Tiny":"` + server.URL + "/"},
+		// `curl -d '{...}'` sends JSON as form.
+		{"application/x-www-form-urlencoded", "*/*", `{"Origin":"` + origin.URL + `/json"}`, http.StatusOK, "application/json", `"Tiny":"` + server.URL + "/"},
+		{"application/x-www-form-urlencoded", "text/html,application/xhtml+xml,*/*;q=0.8", "url=" + url.QueryEscape(origin.URL+"/html"), http.StatusOK, "text/html", `<span>` + server.URL + "/"},
+		{"application/json", "", `{"Origin":`, http.StatusBadRequest, "application/json", `"Error":"JSON is invalid`},
+		{"application/x-www-form-urlencoded", "", "url=&max_clicks=2", http.StatusBadRequest, "text/plain", "URL is required"},
+		{"application/x-www-form-urlencoded", "", "url=x&max_clicks=many", http.StatusBadRequest, "text/plain", "max_clicks 'many' is not number"},
+		{"application/x-www-form-urlencoded", "", "url=%zz", http.StatusBadRequest, "text/plain", "form is invalid"},
+		{"text/plain", "", origin.URL + " " + origin.URL, http.StatusBadRequest, "text/plain", "plain text must have only an URL"},
+		{"application/x-www-form-urlencoded", "text/html", "url=", http.StatusBadRequest, "text/html", "URL is required"},
+		{"multipart/form-data; boundary=x", "", "--x--", http.StatusUnsupportedMediaType, "text/plain", "Content-Type must be"},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest("POST", server.URL+"/", strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", test.contentType)
+		if test.accept != "" {
+			req.Header.Set("Accept", test.accept)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != test.status || !strings.HasPrefix(resp.Header.Get("Content-Type"), test.resultType) || !strings.Contains(string(body), test.result) {
+			t.Fatalf("%s %s real: %d %s %s  expected: %d %s %s\n", test.contentType, test.body, resp.StatusCode, resp.Header.Get("Content-Type"), body,
+				test.status, test.resultType, test.result)
+		}
+	}
+
+	resp, err := http.Get(server.URL + "/page")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `<form class="form" method="POST" action="./">`) {
+		t.Fatalf("real: %d %s  expected: 200 with form\n", resp.StatusCode, body)
+	}
+}
+
+func TestRequestBody(t *testing.T) {
+	server, cfg, _ := startTestServer(t)
+	cfg.MaxBodySize = 256
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer origin.Close()
+
+	large := `{"Origin":"` + origin.URL + `/?q=` + strings.Repeat("x", 300) + `"}`
+	tests := []struct {
+		path    string
+		body    string
+		chunked bool
+		status  int
+	}{
+		{"/", `{"Origin":"` + origin.URL + `/chunked"}`, true, http.StatusOK},
+		{"/", `{"Origin":"` + origin.URL + `/length"}`, false, http.StatusOK},
+		{"/", large, true, http.StatusRequestEntityTooLarge},
+		{"/", large, false, http.StatusRequestEntityTooLarge},
+		{"/", `{"Origin":"` + origin.URL + `/","Orgin":"x"}`, false, http.StatusBadRequest},
+		{"/", `{"Origin":"` + origin.URL + `/"}{"Origin":"x"}`, true, http.StatusBadRequest},
+		{"/batch", `[{"Origin":"` + origin.URL + `/batch"}]`, true, http.StatusOK},
+		{"/batch", `[` + large + `]`, true, http.StatusRequestEntityTooLarge},
+		{"/batch", `[{"Origin":"` + origin.URL + `/","MaxClick":1}]`, false, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		var body io.Reader = strings.NewReader(test.body)
+		if test.chunked {
+			// Content-Length is unknown for readers other than strings.Reader, bytes.Reader and bytes.Buffer.
+			body = ioutil.NopCloser(body)
+		}
+		req, err := http.NewRequest("POST", server.URL+test.path, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+testAPIKey)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rBody, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Fatalf("%s %s chunked:%v real: %d %s  expected: %d\n", test.path, test.body, test.chunked, resp.StatusCode, rBody, test.status)
+		}
+	}
+
+	resp := adminRequest(t, "PATCH", server.URL+"/admin/links/none", `{"Orgin":"https://example.com/"}`)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("real: %d  expected: 400\n", resp.StatusCode)
+	}
+}
+
+func TestDomains(t *testing.T) {
+	server, cfg, db := startTestServer(t)
+	cfg.BrokenLinkAction = BROKEN_LINK_FALLBACK
+	cfg.Domains = []*Domain{
+		{Host: "a.example"},
+		{Host: "b.example", Protocol: "https", TinyLength: 6, DefaultRedirectCode: http.StatusFound, FallbackURL: "https://b.example/broken"},
+	}
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer origin.Close()
+
+	request := func(method string, host string, path string, body string) *http.Response {
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = host
+		req.Header.Set("Authorization", "Bearer "+testAPIKey)
+		resp, err := noRedirectClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// links created before Domains are moved to the default domain, which must be set explicitly.
+	a, err := db.AddLink(&Link{Origin: "https://example.com/a"}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.moveLegacyLinks(cfg); err == nil {
+		t.Fatal("links created before Domains are expected not to be moved without DefaultDomain")
+	}
+	cfg.DefaultDomain = "a.example"
+	if err = db.moveLegacyLinks(cfg); err != nil {
+		t.Fatal(err)
+	}
+	a.Domain = "a.example"
+	logs, err := db.GetAuditLogs(AuditFilter{Domain: "a.example", Tiny: a.Tiny})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 1 {
+		t.Fatalf("real: %d  expected: 1 log moved to a.example\n", len(logs))
+	}
+
+	resp := request("POST", "b.example:8080", "/", `{"Origin":"`+origin.URL+`/b"}`)
+	var post TinyPost
+	err = json.NewDecoder(resp.Body).Decode(&post)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(post.Tiny, "https://b.example:8080/") {
+		t.Fatalf("real: %d %s  expected: %d https://b.example:8080/...\n", resp.StatusCode, post.Tiny, http.StatusOK)
+	}
+	tiny := strings.TrimPrefix(post.Tiny, "https://b.example:8080/")
+	if len(tiny) != 6 {
+		t.Fatalf("real: %s  expected: 6 characters\n", tiny)
+	}
+	if logs, err = db.GetAuditLogs(AuditFilter{Domain: "b.example", Tiny: tiny}); err != nil || len(logs) != 1 {
+		t.Fatalf("real: %d %v  expected: 1 log on b.example\n", len(logs), err)
+	}
+	// the same tiny on another domain is another link.
+	if _, err := db.Exec("UPDATE urls SET tiny = ? WHERE id = ?", tiny, a.ID); err != nil {
+		t.Fatal(err)
+	}
+	db.invalidate(a)
+
+	tests := []struct {
+		host     string
+		status   int
+		location string
+	}{
+		{"a.example", http.StatusMovedPermanently, "https://example.com/a"},
+		{"A.Example.", http.StatusMovedPermanently, "https://example.com/a"},
+		{"b.example", http.StatusFound, origin.URL + "/b"},
+		{"c.example", http.StatusNotFound, ""},
+	}
+	for _, test := range tests {
+		resp := request("GET", test.host, "/"+tiny, "")
+		resp.Body.Close()
+		if resp.StatusCode != test.status || resp.Header.Get("Location") != test.location {
+			t.Fatalf("%s real: %d %s  expected: %d %s\n", test.host, resp.StatusCode, resp.Header.Get("Location"), test.status, test.location)
+		}
+	}
+
+	// broken links without fallback URL use the fallback URL of the domain.
+	if _, err := db.Exec("UPDATE urls SET broken = 1"); err != nil {
+		t.Fatal(err)
+	}
+	db.invalidate(&Link{Domain: "b.example", Tiny: tiny})
+	resp = request("GET", "b.example", "/"+tiny, "")
+	resp.Body.Close()
+	if resp.Header.Get("Location") != "https://b.example/broken" {
+		t.Fatalf("real: %s  expected: https://b.example/broken\n", resp.Header.Get("Location"))
+	}
+
+	// admin API selects the domain by "domain" parameter.
+	adminTests := []struct {
+		query  string
+		status int
+		origin string
+	}{
+		{"", http.StatusOK, "https://example.com/a"},
+		{"?domain=a.example", http.StatusOK, "https://example.com/a"},
+		{"?domain=b.example", http.StatusOK, origin.URL + "/b"},
+		{"?domain=c.example", http.StatusNotFound, ""},
+	}
+	for _, test := range adminTests {
+		resp := request("GET", "c.example", "/admin/links/"+tiny+test.query, "")
+		var link Link
+		json.NewDecoder(resp.Body).Decode(&link)
+		resp.Body.Close()
+		if resp.StatusCode != test.status || link.Origin != test.origin {
+			t.Fatalf("%s real: %d %s  expected: %d %s\n", test.query, resp.StatusCode, link.Origin, test.status, test.origin)
+		}
+	}
+}
+
+func TestPublicBaseURL(t *testing.T) {
+	server, cfg, db := startTestServer(t)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer origin.Close()
+
+	post := func(path string, header map[string]string) (int, string) {
+		req, err := http.NewRequest("POST", server.URL+path, strings.NewReader(`{"Origin":"`+origin.URL+`"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for key, value := range header {
+			req.Header.Set(key, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var result TinyPost
+		json.NewDecoder(resp.Body).Decode(&result)
+		return resp.StatusCode, result.Tiny
+	}
+	forwarded := map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "public.example"}
+
+	// forwarded headers are ignored unless the request is from a trusted proxy.
+	if _, tiny := post("/", forwarded); !strings.HasPrefix(tiny, server.URL+"/") {
+		t.Fatalf("real: %s  expected: %s/...\n", tiny, server.URL)
+	}
+	cfg.trustedProxies, _ = parseTrustedProxies([]string{"127.0.0.1"})
+	if _, tiny := post("/", forwarded); !strings.HasPrefix(tiny, "https://public.example/") {
+		t.Fatalf("real: %s  expected: https://public.example/...\n", tiny)
+	}
+
+	// PublicBaseURL takes precedence over the request, and paths are served under its path.
+	cfg.PublicBaseURL = "https://short.example/s"
+	server = httptest.NewServer(CreateTinyURLServer(cfg, db))
+	defer server.Close()
+	status, tiny := post("/s", forwarded)
+	if status != http.StatusOK || !strings.HasPrefix(tiny, "https://short.example/s/") {
+		t.Fatalf("real: %d %s  expected: %d https://short.example/s/...\n", status, tiny, http.StatusOK)
+	}
+	tiny = strings.TrimPrefix(tiny, "https://short.example/s/")
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/s/" + tiny, http.StatusMovedPermanently},
+		{"/s/" + tiny + "+", http.StatusOK},
+		{"/s/page", http.StatusOK},
+		{"/" + tiny, http.StatusNotFound},
+		{"/s" + tiny, http.StatusNotFound},
+		{"/page", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		resp, err := noRedirectClient.Get(server.URL + test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Fatalf("%s real: %d  expected: %d\n", test.path, resp.StatusCode, test.status)
+		}
+	}
+}
+
+func TestLoginLimiterPerClient(t *testing.T) {
+	server, cfg, db := startTestServer(t)
+	trustedProxies, err := parseTrustedProxies([]string{"127.0.0.1", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.trustedProxies = trustedProxies
+	if _, err := db.AddUser("alice", "alice-password", ROLE_USER); err != nil {
+		t.Fatal(err)
+	}
+	login := func(password string, ip string) int {
+		req, err := http.NewRequest("POST", server.URL+"/login", strings.NewReader(`{"Username":"alice","Password":"`+password+`"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Forwarded-For", ip)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	for i := 0; i < cfg.PasswordMaxAttempts; i++ {
+		if status := login("wrong", "203.0.113.1"); status != http.StatusUnauthorized {
+			t.Fatalf("real: %d  expected: 401\n", status)
+		}
+	}
+	if status := login("alice-password", "203.0.113.1"); status != http.StatusTooManyRequests {
+		t.Fatalf("real: %d  expected: 429\n", status)
+	}
+	// failures from another client don't lock the user out.
+	if status := login("alice-password", "203.0.113.2"); status != http.StatusOK {
+		t.Fatalf("real: %d  expected: 200\n", status)
+	}
+}
+
+func TestAccounts(t *testing.T) {
+	server, cfg, db := startTestServer(t)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer origin.Close()
+	for _, u := range []struct{ name, role string }{{"alice", ROLE_USER}, {"bob", ROLE_USER}, {"root", ROLE_ADMIN}} {
+		if _, err := db.AddUser(u.name, u.name+"-password", u.role); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// login returns the CSRF token and keeps the session in the cookie jar.
+	login := func(username string) (*http.Client, string) {
+		jar, err := cookiejar.New(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := &http.Client{Jar: jar, CheckRedirect: noRedirectClient.CheckRedirect}
+		resp, err := client.Post(server.URL+"/login", "application/json", strings.NewReader(`{"Username":"`+username+`","Password":"`+username+`-password"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var account Account
+		json.NewDecoder(resp.Body).Decode(&account)
+		if resp.StatusCode != http.StatusOK || account.Username != username || account.CSRFToken == "" {
+			t.Fatalf("real: %d %+v  expected: %d %s\n", resp.StatusCode, account, http.StatusOK, username)
+		}
+		return client, account.CSRFToken
+	}
+	request := func(client *http.Client, method string, path string, csrfToken string, body string) *http.Response {
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if csrfToken != "" {
+			req.Header.Set(CSRF_HEADER, csrfToken)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	decode := func(resp *http.Response, v interface{}) {
+		defer resp.Body.Close()
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resp, err := http.Post(server.URL+"/login", "application/json", strings.NewReader(`{"Username":"alice","Password":"wrong"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("real: %d  expected: %d\n", resp.StatusCode, http.StatusUnauthorized)
+	}
+	resp, err = http.Post(server.URL+"/signup", "application/json", strings.NewReader(`{"Username":"carol","Password":"carol-password"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("real: %d  expected: %d\n", resp.StatusCode, http.StatusNotFound)
+	}
+
+	alice, aliceToken := login("alice")
+	bob, bobToken := login("bob")
+	root, rootToken := login("root")
+
+	// links are owned only if the CSRF token is sent.
+	var owned, anonymous TinyPost
+	decode(request(alice, "POST", "/", aliceToken, `{"Origin":"`+origin.URL+`/owned"}`), &owned)
+	decode(request(alice, "POST", "/", "", `{"Origin":"`+origin.URL+`/anonymous"}`), &anonymous)
+	ownedTiny := strings.TrimPrefix(owned.Tiny, server.URL+"/")
+	var links []*Link
+	decode(request(alice, "GET", "/my/links", "", ""), &links)
+	if len(links) != 1 || links[0].Tiny != ownedTiny {
+		t.Fatalf("real: %d links  expected: %s\n", len(links), ownedTiny)
+	}
+	decode(request(root, "GET", "/my/links", "", ""), &links)
+	if len(links) != 2 {
+		t.Fatalf("real: %d links  expected: 2\n", len(links))
+	}
+
+	tests := []struct {
+		client    *http.Client
+		csrfToken string
+		origin    string
+		status    int
+	}{
+		{alice, "", "/no-token", http.StatusUnauthorized},
+		{alice, bobToken, "/other-token", http.StatusUnauthorized},
+		{bob, bobToken, "/bob", http.StatusNotFound},
+		{http.DefaultClient, "", "/anonymous", http.StatusUnauthorized},
+		{alice, aliceToken, "/alice", http.StatusOK},
+		{root, rootToken, "/root", http.StatusOK},
+	}
+	for _, test := range tests {
+		resp := request(test.client, "PATCH", "/my/links/"+ownedTiny, test.csrfToken, `{"Origin":"`+origin.URL+test.origin+`"}`)
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Fatalf("%s real: %d  expected: %d\n", test.origin, resp.StatusCode, test.status)
+		}
+	}
+	logs, err := db.GetAuditLogs(AuditFilter{Tiny: ownedTiny})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 3 || logs[1].Actor != "user:alice" {
+		t.Fatalf("real: %+v  expected: 3 logs by user:alice\n", logs)
+	}
+
+	// admins can use admin API, and users can't.
+	resp = request(root, "GET", "/admin/links/"+ownedTiny, "", "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("real: %d  expected: %d\n", resp.StatusCode, http.StatusOK)
+	}
+	resp = request(alice, "GET", "/admin/links/"+ownedTiny, "", "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("real: %d  expected: %d\n", resp.StatusCode, http.StatusUnauthorized)
+	}
+
+	// logout needs the CSRF token, and the session can't be used after logout.
+	for _, test := range []struct {
+		csrfToken string
+		status    int
+	}{{"", http.StatusUnauthorized}, {aliceToken, http.StatusNoContent}, {aliceToken, http.StatusUnauthorized}} {
+		resp := request(alice, "POST", "/logout", test.csrfToken, "")
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Fatalf("real: %d  expected: %d\n", resp.StatusCode, test.status)
+		}
+	}
+
+	// forms log in by redirecting to my page, and signup creates a user.
+	cfg.AllowSignup = true
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	carol := &http.Client{Jar: jar, CheckRedirect: noRedirectClient.CheckRedirect}
+	resp, err = carol.PostForm(server.URL+"/signup", url.Values{"username": {"carol"}, "password": {"carol-password"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/my" {
+		t.Fatalf("real: %d %s  expected: %d /my\n", resp.StatusCode, resp.Header.Get("Location"), http.StatusSeeOther)
+	}
+	resp, err = carol.Get(server.URL + "/my")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), "carol") || !strings.Contains(string(body), `name="csrf_token"`) {
+		t.Fatalf("real: %s  expected: my page of carol\n", body)
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const SQL_CREATE_WEBHOOK_OUTBOX = `
+	create table webhook_outbox (
+		id integer primary key autoincrement,
+		webhook text not null,
+		event text not null,
+		payload text not null,
+		status text not null default 'pending',
+		attempts integer not null default 0,
+		next_attempt_at datetime not null,
+		last_error text not null default '',
+		created_at datetime not null
+	);
+	create index webhook_outbox_due on webhook_outbox(status, next_attempt_at);
+`
+
+const (
+	EVENT_LINK_CREATED string = "link.created"
+	EVENT_LINK_UPDATED string = "link.updated"
+	EVENT_LINK_DELETED string = "link.deleted"
+	EVENT_LINK_CLICKED string = "link.clicked"
+)
+
+var WEBHOOK_EVENTS = map[string]bool{
+	EVENT_LINK_CREATED: true,
+	EVENT_LINK_UPDATED: true,
+	EVENT_LINK_DELETED: true,
+	EVENT_LINK_CLICKED: true,
+}
+
+// AUDIT_EVENTS maps an audit action to the webhook event of it.
+var AUDIT_EVENTS = map[string]string{
+	AUDIT_CREATE: EVENT_LINK_CREATED,
+	AUDIT_UPDATE: EVENT_LINK_UPDATED,
+	AUDIT_DELETE: EVENT_LINK_DELETED,
+}
+
+const (
+	OUTBOX_PENDING string = "pending"
+	OUTBOX_FAILED  string = "failed"
+)
+
+const WEBHOOK_BATCH_SIZE int = 100
+const WEBHOOK_MAX_BACKOFF time.Duration = time.Hour
+const WEBHOOK_SIGNATURE_HEADER string = "X-TinyURL-Signature"
+const WEBHOOK_TIMESTAMP_HEADER string = "X-TinyURL-Timestamp"
+
+// WEBHOOK_TIMESTAMP_TOLERANCE is how old deliveries receivers should accept, so that captured deliveries can't be replayed later.
+const WEBHOOK_TIMESTAMP_TOLERANCE time.Duration = 5 * time.Minute
+
+// Webhook is a subscription of link events. Payloads are signed by HMAC-SHA256 with Secret.
+type Webhook struct {
+	Name   string `yaml:"Name"`
+	URL    string `yaml:"URL"`
+	Secret string `yaml:"Secret"`
+	// Events to be sent. Empty means all events.
+	Events []string `yaml:"Events"`
+}
+
+func (hook *Webhook) Subscribes(event string) bool {
+	if len(hook.Events) == 0 {
+		return true
+	}
+	for _, e := range hook.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookPayload is the JSON body of webhook requests.
+type WebhookPayload struct {
+	Event      string    `json:"Event"`
+	Tiny       string    `json:"Tiny"`
+	Actor      string    `json:"Actor,omitempty"`
+	Link       *Link     `json:"Link"`
+	Before     *Link     `json:"Before,omitempty"`
+	OccurredAt time.Time `json:"OccurredAt"`
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// enqueueWebhooks stores event in the outbox for every webhook subscribing it.
+// Within tx, the event is committed or rollbacked together with the mutation.
+// The dispatcher must be woken after the commit.
+func (db *DB) enqueueWebhooks(e execer, event string, actor string, tiny string, link *Link, before *Link, occurredAt time.Time) error {
+	var payload []byte
+	for _, hook := range db.webhooks {
+		if !hook.Subscribes(event) {
+			continue
+		}
+		if payload == nil {
+			var err error
+			if payload, err = json.Marshal(&WebhookPayload{
+				Event:      event,
+				Tiny:       tiny,
+				Actor:      actor,
+				Link:       link,
+				Before:     before,
+				OccurredAt: occurredAt,
+			}); err != nil {
+				return err
+			}
+		}
+		now := time.Now()
+		if _, err := e.Exec("INSERT INTO webhook_outbox (webhook, event, payload, next_attempt_at, created_at) VALUES (?, ?, ?, ?, ?)",
+			hook.Name, event, string(payload), now, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeChange records a mutation of a link by the audit log and webhook events in tx.
+func (db *DB) writeChange(tx *sql.Tx, actor string, action string, tiny string, before *Link, after *Link) error {
+	// nil links must be passed as nil interfaces so that they are stored as NULL.
+	var b, a interface{}
+	if before != nil {
+		b = before
+	}
+	if after != nil {
+		a = after
+	}
+	link := after
+	if link == nil {
+		link = before
+	}
+	if err := writeAuditLog(tx, actor, action, link.Domain, tiny, b, a); err != nil {
+		return err
+	}
+	if action == AUDIT_CREATE {
+		before = nil
+	}
+	return db.enqueueWebhooks(tx, AUDIT_EVENTS[action], actor, tiny, link, before, time.Now().UTC())
+}
+
+func (db *DB) wakeWebhookDispatcher() {
+	select {
+	case db.webhookWake <- struct{}{}:
+	default:
+	}
+}
+
+type outboxEntry struct {
+	ID       int64
+	Webhook  string
+	Event    string
+	Payload  string
+	Attempts int
+}
+
+// WebhookDeliverer sends webhook events in the outbox.
+type WebhookDeliverer struct {
+	db          *DB
+	client      *http.Client
+	hooks       map[string]*Webhook
+	maxAttempts int
+	backoff     time.Duration
+}
+
+func NewWebhookDeliverer(cfg *Config, db *DB) *WebhookDeliverer {
+	hooks := map[string]*Webhook{}
+	for _, hook := range cfg.Webhooks {
+		hooks[hook.Name] = hook
+	}
+	return &WebhookDeliverer{
+		db:          db,
+		client:      &http.Client{Timeout: cfg.WebhookTimeout},
+		hooks:       hooks,
+		maxAttempts: cfg.WebhookMaxAttempts,
+		backoff:     cfg.WebhookRetryBackoff,
+	}
+}
+
+// DeliverDue sends events whose next attempt time has come, and returns the number of delivered events.
+// Events of the same webhook are sent in order, and different webhooks are sent concurrently.
+func (d *WebhookDeliverer) DeliverDue() (int, error) {
+	// events after an event waiting for retry are not due, so that events of a webhook are delivered in order.
+	now := time.Now()
+	rows, err := d.db.Query(`SELECT id, webhook, event, payload, attempts FROM webhook_outbox o
+		WHERE status = ? AND next_attempt_at <= ? AND NOT EXISTS (
+			SELECT 1 FROM webhook_outbox w WHERE w.webhook = o.webhook AND w.status = ? AND w.id < o.id AND w.next_attempt_at > ?
+		) ORDER BY id LIMIT ?`,
+		OUTBOX_PENDING, now, OUTBOX_PENDING, now, WEBHOOK_BATCH_SIZE)
+	if err != nil {
+		return 0, err
+	}
+	byHook := map[string][]*outboxEntry{}
+	for rows.Next() {
+		entry := &outboxEntry{}
+		if err = rows.Scan(&entry.ID, &entry.Webhook, &entry.Event, &entry.Payload, &entry.Attempts); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		byHook[entry.Webhook] = append(byHook[entry.Webhook], entry)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	delivered := 0
+	for name, entries := range byHook {
+		wg.Add(1)
+		go func(hook *Webhook, name string, entries []*outboxEntry) {
+			defer wg.Done()
+			for _, entry := range entries {
+				// later events wait for the failed one to keep the order.
+				if !d.deliver(hook, name, entry) {
+					return
+				}
+				mu.Lock()
+				delivered++
+				mu.Unlock()
+			}
+		}(d.hooks[name], name, entries)
+	}
+	wg.Wait()
+	return delivered, nil
+}
+
+// deliver sends entry and updates the outbox by the result.
+func (d *WebhookDeliverer) deliver(hook *Webhook, name string, entry *outboxEntry) bool {
+	var err error
+	if hook == nil {
+		err = errors.New(fmt.Sprintf("webhook '%s' is not in config", name))
+	} else {
+		err = d.send(hook, entry)
+	}
+	if err == nil {
+		if _, err := d.db.Exec("DELETE FROM webhook_outbox WHERE id = ?", entry.ID); err != nil {
+			Errorf("Deleting delivered webhook event %d is failed. Error: %v\n", entry.ID, err)
+		}
+		Debugf("Webhook event %d (%s) is delivered to '%s'\n", entry.ID, entry.Event, name)
+		return true
+	}
+
+	attempts := entry.Attempts + 1
+	status := OUTBOX_PENDING
+	if attempts >= d.maxAttempts {
+		status = OUTBOX_FAILED
+		Errorf("Webhook event %d (%s) to '%s' is given up after %d attempts. Error: %v\n", entry.ID, entry.Event, name, attempts, err)
+	} else {
+		Warnf("Webhook event %d (%s) to '%s' is failed (attempt %d). Error: %v\n", entry.ID, entry.Event, name, attempts, err)
+	}
+	if _, err := d.db.Exec("UPDATE webhook_outbox SET status = ?, attempts = ?, next_attempt_at = ?, last_error = ? WHERE id = ?",
+		status, attempts, time.Now().Add(webhookBackoff(d.backoff, attempts)), err.Error(), entry.ID); err != nil {
+		Errorf("Updating webhook event %d is failed. Error: %v\n", entry.ID, err)
+	}
+	return false
+}
+
+func (d *WebhookDeliverer) send(hook *Webhook, entry *outboxEntry) error {
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader([]byte(entry.Payload)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "tiny-url-webhook")
+	req.Header.Set("X-TinyURL-Event", entry.Event)
+	req.Header.Set("X-TinyURL-Delivery", strconv.FormatInt(entry.ID, 10))
+	// every attempt has its own timestamp, so that retries are accepted by receivers.
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(WEBHOOK_TIMESTAMP_HEADER, timestamp)
+	req.Header.Set(WEBHOOK_SIGNATURE_HEADER, SignWebhookPayload(hook.Secret, timestamp, []byte(entry.Payload)))
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.New(fmt.Sprintf("unexpected status code %d", resp.StatusCode))
+	}
+	return nil
+}
+
+// webhookBackoff returns the delay before the next attempt after attempts failures. It doubles every failure.
+func webhookBackoff(base time.Duration, attempts int) time.Duration {
+	delay := base
+	for i := 1; i < attempts && delay < WEBHOOK_MAX_BACKOFF; i++ {
+		delay *= 2
+	}
+	if delay > WEBHOOK_MAX_BACKOFF {
+		delay = WEBHOOK_MAX_BACKOFF
+	}
+	return delay
+}
+
+// SignWebhookPayload returns the value of signature header, "sha256=" and hex of HMAC-SHA256 of
+// timestamp (Unix time in seconds), "." and payload.
+// Receivers should compare it with their own signature by constant time comparison.
+func SignWebhookPayload(secret string, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhookSignature reports whether signature is of timestamp and payload, and timestamp is within
+// WEBHOOK_TIMESTAMP_TOLERANCE of now.
+func VerifyWebhookSignature(secret string, timestamp string, signature string, payload []byte, now time.Time) bool {
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if d := now.Sub(time.Unix(sec, 0)); d > WEBHOOK_TIMESTAMP_TOLERANCE || d < -WEBHOOK_TIMESTAMP_TOLERANCE {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(SignWebhookPayload(secret, timestamp, payload)))
+}
+
+// StartWebhookDispatcher delivers webhook events in the background until ctx is done.
+// The outbox is checked every WebhookPollInterval and whenever a new event is enqueued.
+func StartWebhookDispatcher(ctx context.Context, cfg *Config, db *DB) {
+	if len(cfg.Webhooks) == 0 {
+		return
+	}
+	Infof("Webhook events are delivered to %d webhooks.\n", len(cfg.Webhooks))
+	d := NewWebhookDeliverer(cfg, db)
+	go func() {
+		ticker := time.NewTicker(cfg.WebhookPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			case <-db.webhookWake:
+			}
+			for {
+				n, err := d.DeliverDue()
+				if err != nil {
+					Errorf("WebhookError: %v\n", err)
+				}
+				// a full batch may be followed by more due events.
+				if err != nil || n < WEBHOOK_BATCH_SIZE {
+					break
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver records payloads with valid signatures. The first requests fail as many times as failures.
+type webhookReceiver struct {
+	mu       sync.Mutex
+	failures int
+	payloads []WebhookPayload
+	received chan struct{}
+}
+
+func startWebhookReceiver(t *testing.T, secret string, failures int) (*httptest.Server, *webhookReceiver) {
+	recv := &webhookReceiver{failures: failures, received: make(chan struct{}, 100)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if !VerifyWebhookSignature(secret, r.Header.Get(WEBHOOK_TIMESTAMP_HEADER), r.Header.Get(WEBHOOK_SIGNATURE_HEADER), body, time.Now()) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		recv.mu.Lock()
+		defer recv.mu.Unlock()
+		if recv.failures > 0 {
+			recv.failures--
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var payload WebhookPayload
+		if err := json.Unmarshal(body, &payload); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		recv.payloads = append(recv.payloads, payload)
+		recv.received <- struct{}{}
+	}))
+	t.Cleanup(server.Close)
+	return server, recv
+}
+
+func webhookTestConfig(url string, events ...string) *Config {
+	cfg := testDBConfig("")
+	cfg.Webhooks = []*Webhook{{Name: "test", URL: url, Secret: "secret", Events: events}}
+	cfg.WebhookRetryBackoff = time.Millisecond
+	cfg.WebhookMaxAttempts = 3
+	return cfg
+}
+
+func TestWebhookDeliveryAndRetry(t *testing.T) {
+	server, recv := startWebhookReceiver(t, "secret", 1)
+	cfg := webhookTestConfig(server.URL, EVENT_LINK_CREATED, EVENT_LINK_CLICKED)
+	db := connectTempDB(t)
+	db.webhooks = cfg.Webhooks
+	d := NewWebhookDeliverer(cfg, db)
+
+	hash, err := HashPassword("secret link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, err := db.AddLink(&Link{Origin: "https://example.com/hook", PasswordHash: hash}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// not subscribed.
+	if _, err = db.UpdateLink("", link.Tiny, "test", func(l *Link) error { l.RedirectCode = 302; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.CountClick(link); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.FlushClicks(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first attempt fails and the events are retried in order.
+	if n, err := d.DeliverDue(); err != nil || n != 0 {
+		t.Fatalf("real: %d %v  expected: 0 delivered\n", n, err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if n, err := d.DeliverDue(); err != nil || n != 2 {
+		t.Fatalf("real: %d %v  expected: 2 delivered\n", n, err)
+	}
+
+	if len(recv.payloads) != 2 || recv.payloads[0].Event != EVENT_LINK_CREATED || recv.payloads[1].Event != EVENT_LINK_CLICKED {
+		t.Fatalf("unexpected payloads: %+v\n", recv.payloads)
+	}
+	if p := recv.payloads[0]; p.Tiny != link.Tiny || p.Actor != "test" || p.Link.Origin != link.Origin || p.Link.PasswordHash != "" {
+		t.Fatalf("unexpected payload: %+v\n", p)
+	}
+	var pending int
+	if err := db.QueryRow("SELECT count(*) FROM webhook_outbox").Scan(&pending); err != nil || pending != 0 {
+		t.Fatalf("real: %d %v  expected: empty outbox\n", pending, err)
+	}
+}
+
+func TestWebhookGiveUp(t *testing.T) {
+	server, _ := startWebhookReceiver(t, "another secret", 0)
+	cfg := webhookTestConfig(server.URL)
+	db := connectTempDB(t)
+	db.webhooks = cfg.Webhooks
+	d := NewWebhookDeliverer(cfg, db)
+
+	if _, err := db.AddLink(&Link{Origin: "https://example.com/unsigned"}, "test"); err != nil {
+		t.Fatal(err)
+	}
+	// signatures never match, so every attempt fails.
+	for i := 0; i < cfg.WebhookMaxAttempts+1; i++ {
+		if n, err := d.DeliverDue(); err != nil || n != 0 {
+			t.Fatalf("real: %d %v  expected: 0 delivered\n", n, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	var status string
+	var attempts int
+	if err := db.QueryRow("SELECT status, attempts FROM webhook_outbox").Scan(&status, &attempts); err != nil {
+		t.Fatal(err)
+	}
+	if status != OUTBOX_FAILED || attempts != cfg.WebhookMaxAttempts {
+		t.Fatalf("real: %s %d  expected: %s %d\n", status, attempts, OUTBOX_FAILED, cfg.WebhookMaxAttempts)
+	}
+}
+
+func TestWebhookDispatcher(t *testing.T) {
+	server, recv := startWebhookReceiver(t, "secret", 0)
+	cfg := webhookTestConfig(server.URL)
+	cfg.WebhookPollInterval = time.Hour
+	db := connectTempDB(t)
+	db.webhooks = cfg.Webhooks
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	StartWebhookDispatcher(ctx, cfg, db)
+
+	// the dispatcher is woken by the commit without waiting for the poll interval.
+	link, err := db.AddLink(&Link{Origin: "https://example.com/dispatch"}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteLink("", link.Tiny, "test"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-recv.received:
+		case <-time.After(5 * time.Second):
+			t.Fatal("webhook events are not delivered")
+		}
+	}
+	recv.mu.Lock()
+	defer recv.mu.Unlock()
+	if recv.payloads[1].Event != EVENT_LINK_DELETED || recv.payloads[1].Link.Tiny != link.Tiny {
+		t.Fatalf("unexpected payload: %+v\n", recv.payloads[1])
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	tests := map[int]time.Duration{1: 10 * time.Second, 2: 20 * time.Second, 4: 80 * time.Second, 20: WEBHOOK_MAX_BACKOFF}
+	for attempts, expected := range tests {
+		if real := webhookBackoff(10*time.Second, attempts); real != expected {
+			t.Fatalf("%d real: %v  expected: %v\n", attempts, real, expected)
+		}
+	}
+}